@@ -0,0 +1,660 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Each record in an AppendLog starts with a 16-byte header: a CRC-32C over the
+// remainder of the record, the key, the value size, and a CRC-32C over the key
+// plus the value size, all in big-endian. The latter tells a torn write apart
+// from a corrupt value size.
+const logHeaderSize = 16
+
+// Deletes append a record with the tombstone flag set on the key, and no value.
+const logTombstone = 1 << 31
+
+// SegmentMax applies when zero is passed to OpenAppendLog.
+const logSegmentMaxDefault = 64 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errLogClosed = errors.New("mqtt: append log closed")
+
+// AppendLog is a Persistence with all records in a segmented, append-only log.
+// Each Save takes one append plus an fsync, as opposed to the file creation,
+// fsync and rename from FileSystem. The log is compacted when the obsolete
+// records exceed both the live ones, and the maximum segment size.
+//
+// Recovery from a crash truncates any partial record at the end of the log.
+// Corrupt records elsewhere fail OpenAppendLog. Any corruption found by Load
+// is a *CorruptionError.
+// Saves return only after their record is synced to storage.
+//
+// Multiple goroutines may invoke methods on an AppendLog simultaneously.
+type AppendLog struct {
+	dir        string
+	segmentMax int64
+
+	mutex    sync.RWMutex
+	err      error            // sticky write failure
+	segments []*logSegment    // in order of appearance
+	index    map[uint]logSpot // latest value per key
+
+	// Byte counts for compaction.
+	liveSize, totalSize int64
+	// Automatic compaction waits for totalSize to reach compactRetry after
+	// a failure.
+	compactRetry int64
+}
+
+// LogSegment is a log file, identified by a sequence number.
+type logSegment struct {
+	seqNo uint64
+	file  *os.File // may be opened under a temporary name
+	size  int64    // write offset
+}
+
+// LogSpot locates a value in the log.
+type logSpot struct {
+	segment *logSegment
+	offset  int64 // value start
+	size    int   // value length
+}
+
+// OpenAppendLog continues with, or starts a new log in the directory. Callers
+// must ensure the availability, including write permission for the user. New
+// records go to a new segment file once the current one exceeds segmentMax in
+// bytes. Zero defaults to 64 MiB. The AppendLog must be closed after use.
+func OpenAppendLog(dir string, segmentMax int64) (*AppendLog, error) {
+	if segmentMax <= 0 {
+		segmentMax = logSegmentMaxDefault
+	}
+	l := &AppendLog{
+		dir:        dir,
+		segmentMax: segmentMax,
+		index:      make(map[uint]logSpot),
+	}
+
+	// leftover from an interrupted compaction
+	err := os.Remove(l.compactFile())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	names, err := readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqNos []uint64
+	for _, name := range names {
+		if strings.HasSuffix(name, ".spool") {
+			// leftover from an interrupted SaveFrom
+			err := os.Remove(filepath.Join(dir, name))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			continue
+		}
+		if len(name) != 20 || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		seqNo, err := strconv.ParseUint(name[:16], 16, 64)
+		if err != nil {
+			continue
+		}
+		seqNos = append(seqNos, seqNo)
+	}
+	sort.Slice(seqNos, func(i, j int) bool { return seqNos[i] < seqNos[j] })
+
+	for i, seqNo := range seqNos {
+		f, err := os.OpenFile(l.segmentFile(seqNo), os.O_RDWR, 0)
+		if err != nil {
+			l.closeSegments()
+			return nil, err
+		}
+		s := &logSegment{seqNo: seqNo, file: f}
+		l.segments = append(l.segments, s)
+
+		err = l.replay(s, i == len(seqNos)-1)
+		if err != nil {
+			l.closeSegments()
+			return nil, err
+		}
+	}
+
+	if len(l.segments) == 0 {
+		err := l.addSegment(1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *AppendLog) segmentFile(seqNo uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016x.log", seqNo))
+}
+
+func (l *AppendLog) compactFile() string {
+	return filepath.Join(l.dir, "compact.tmp")
+}
+
+// Replay reads all records from a segment into the index. A partial record is
+// truncated from the last segment, when it is the last record, and when its
+// header is intact. Any other segment must be complete.
+func (l *AppendLog) replay(s *logSegment, last bool) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+
+	r := io.NewSectionReader(s.file, 0, fileSize)
+	var header [logHeaderSize]byte
+	var buf []byte
+	var torn bool // end of file reached by the failed record
+	for s.size < fileSize {
+		_, err := r.ReadAt(header[:], s.size)
+		if err != nil {
+			if err == io.EOF {
+				torn = true // partial header
+				break
+			}
+			return err
+		}
+		if crc32.Checksum(header[4:12], castagnoli) != binary.BigEndian.Uint32(header[12:16]) {
+			break // corrupt header
+		}
+		key := uint(binary.BigEndian.Uint32(header[4:8]))
+		size := int64(binary.BigEndian.Uint32(header[8:12]))
+		if key&logTombstone != 0 && size != 0 {
+			break // corrupt header
+		}
+		end := s.size + logHeaderSize + size
+		if end > fileSize {
+			torn = true // partial value
+			break
+		}
+
+		if cap(buf) < int(size) {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		_, err = r.ReadAt(buf, s.size+logHeaderSize)
+		if err != nil {
+			return err
+		}
+		digest := crc32.Update(0, castagnoli, header[4:])
+		digest = crc32.Update(digest, castagnoli, buf)
+		if digest != binary.BigEndian.Uint32(header[:4]) {
+			torn = end == fileSize // last record
+			break
+		}
+
+		l.apply(key, logSpot{segment: s, offset: s.size + logHeaderSize, size: int(size)})
+		s.size += logHeaderSize + size
+	}
+	l.totalSize += s.size
+
+	if s.size == fileSize {
+		return nil
+	}
+	if !last || !torn {
+		return fmt.Errorf("mqtt: append log segment %q corrupt at offset %d", s.file.Name(), s.size)
+	}
+	// torn write at the end of the log
+	err = s.file.Truncate(s.size)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("mqtt: append log recovery of torn write: %w", err)
+	}
+	return nil
+}
+
+// Apply updates the index with a record. The key has the tombstone flag, if
+// any. The mutex must be held.
+func (l *AppendLog) apply(key uint, spot logSpot) {
+	if old, ok := l.index[key&^logTombstone]; ok {
+		l.liveSize -= logHeaderSize + int64(old.size)
+	}
+	if key&logTombstone != 0 {
+		delete(l.index, key&^logTombstone)
+	} else {
+		l.index[key] = spot
+		l.liveSize += logHeaderSize + int64(spot.size)
+	}
+}
+
+// AddSegment installs a new segment file for appends. The mutex must be held.
+func (l *AppendLog) addSegment(seqNo uint64) error {
+	f, err := os.OpenFile(l.segmentFile(seqNo), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(l.dir); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	l.segments = append(l.segments, &logSegment{seqNo: seqNo, file: f})
+	return nil
+}
+
+// Load implements the Persistence interface.
+func (l *AppendLog) Load(key uint) ([]byte, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.index == nil {
+		return nil, errLogClosed
+	}
+	spot, ok := l.index[key]
+	if !ok {
+		return nil, nil
+	}
+
+	record := make([]byte, logHeaderSize+spot.size)
+	_, err := spot.segment.file.ReadAt(record, spot.offset-logHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	digest := crc32.Checksum(record[4:], castagnoli)
+	if want := binary.BigEndian.Uint32(record[:4]); digest != want {
+		return nil, &CorruptionError{Key: key, Want: want, Got: digest}
+	}
+	return record[logHeaderSize:], nil
+}
+
+// Save implements the Persistence interface.
+func (l *AppendLog) Save(key uint, value net.Buffers) error {
+	record, size := logRecord(key, value)
+	return l.append(func(f *os.File) error {
+		_, err := record.WriteTo(f)
+		return err
+	}, logEntry{key, size})
+}
+
+// SaveBatch implements the batchSaver interface with one sync for all values.
+func (l *AppendLog) saveBatch(keys []uint, values []net.Buffers) []error {
+	var records net.Buffers
+	entries := make([]logEntry, len(keys))
+	for i, key := range keys {
+		record, size := logRecord(key, values[i])
+		records = append(records, record...)
+		entries[i] = logEntry{key, size}
+	}
+	err := l.append(func(f *os.File) error {
+		_, err := records.WriteTo(f)
+		return err
+	}, entries...)
+
+	errs := make([]error, len(keys))
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// LogRecord composes a record without modification of value.
+func logRecord(key uint, value net.Buffers) (record net.Buffers, size int) {
+	for _, buf := range value {
+		size += len(buf)
+	}
+	header := logHeader(key, size)
+	digest := crc32.Update(0, castagnoli, header[4:])
+	for _, buf := range value {
+		digest = crc32.Update(digest, castagnoli, buf)
+	}
+	binary.BigEndian.PutUint32(header[:4], digest)
+
+	record = make(net.Buffers, 0, len(value)+1)
+	record = append(record, header[:])
+	record = append(record, value...)
+	return record, size
+}
+
+// SaveFrom implements the Spooler interface. The value goes to a temporary file
+// first, such that the reader does not hold up any other writes.
+func (l *AppendLog) SaveFrom(key uint, r io.Reader, size int) error {
+	l.mutex.RLock()
+	closed := l.index == nil
+	l.mutex.RUnlock()
+	if closed {
+		return errLogClosed
+	}
+
+	spool, err := os.CreateTemp(l.dir, "*.spool")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	header := logHeader(key, size)
+	digest := crc32.New(castagnoli)
+	digest.Write(header[4:])
+	_, err = io.CopyN(io.MultiWriter(spool, digest), r, int64(size))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	binary.BigEndian.PutUint32(header[:4], digest.Sum32())
+
+	return l.append(func(f *os.File) error {
+		if _, err := f.Write(header[:]); err != nil {
+			return err
+		}
+		_, err := io.Copy(f, io.NewSectionReader(spool, 0, int64(size)))
+		return err
+	}, logEntry{key, size})
+}
+
+// LogHeader returns the header of a record without the checksum of the record.
+func logHeader(key uint, size int) (header [logHeaderSize]byte) {
+	binary.BigEndian.PutUint32(header[4:8], uint32(key))
+	binary.BigEndian.PutUint32(header[8:12], uint32(size))
+	binary.BigEndian.PutUint32(header[12:16], crc32.Checksum(header[4:12], castagnoli))
+	return
+}
+
+// Delete implements the Persistence interface.
+func (l *AppendLog) Delete(key uint) error {
+	l.mutex.RLock()
+	closed := l.index == nil
+	_, ok := l.index[key]
+	l.mutex.RUnlock()
+	if closed {
+		return errLogClosed
+	}
+	if !ok {
+		return nil // absent
+	}
+
+	header := logHeader(key|logTombstone, 0)
+	binary.BigEndian.PutUint32(header[:4], crc32.Checksum(header[4:], castagnoli))
+	return l.append(func(f *os.File) error {
+		_, err := f.Write(header[:])
+		return err
+	}, logEntry{key | logTombstone, 0})
+}
+
+// LogEntry is a record summary.
+type logEntry struct {
+	key  uint // with tombstone flag, if any
+	size int  // value length
+}
+
+// Append writes the records of entries with writeRecords, and it syncs the
+// result before the index update. Any partial write is truncated.
+func (l *AppendLog) append(writeRecords func(*os.File) error, entries ...logEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.index == nil {
+		return errLogClosed
+	}
+	if l.err != nil {
+		return l.err
+	}
+
+	var writeSize int64
+	for _, e := range entries {
+		writeSize += logHeaderSize + int64(e.size)
+	}
+	s := l.segments[len(l.segments)-1]
+	if s.size != 0 && s.size+writeSize > l.segmentMax {
+		if err := l.addSegment(s.seqNo + 1); err != nil {
+			return err
+		}
+		s = l.segments[len(l.segments)-1]
+	}
+
+	_, err := s.file.Seek(s.size, io.SeekStart)
+	if err == nil {
+		err = writeRecords(s.file)
+		if err == nil {
+			err = s.file.Sync()
+		}
+	}
+	if err != nil {
+		// undo partial write, if any
+		truncErr := s.file.Truncate(s.size)
+		if truncErr != nil {
+			l.err = fmt.Errorf("mqtt: append log unusable after write error %q: %w", err, truncErr)
+			return l.err
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		l.apply(e.key, logSpot{segment: s, offset: s.size + logHeaderSize, size: e.size})
+		s.size += logHeaderSize + int64(e.size)
+	}
+	l.totalSize += writeSize
+
+	if garbage := l.totalSize - l.liveSize; garbage > l.liveSize && garbage > l.segmentMax && l.totalSize >= l.compactRetry {
+		// Compaction failure does not affect the append. Another
+		// attempt waits for one more segment of growth.
+		if err := l.compact(); err != nil {
+			l.compactRetry = l.totalSize + l.segmentMax
+		}
+	}
+	return nil
+}
+
+// List implements the Persistence interface.
+func (l *AppendLog) List() (keys []uint, err error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.index == nil {
+		return nil, errLogClosed
+	}
+	keys = make([]uint, 0, len(l.index))
+	for key := range l.index {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Open implements the Spooler interface.
+func (l *AppendLog) Open(key uint) (value io.ReadCloser, size int, err error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.index == nil {
+		return nil, 0, errLogClosed
+	}
+	spot, ok := l.index[key]
+	if !ok {
+		return nil, 0, nil
+	}
+
+	record := make([]byte, logHeaderSize)
+	_, err = spot.segment.file.ReadAt(record, spot.offset-logHeaderSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	// A file of its own survives compaction.
+	f, err := os.Open(l.segmentFile(spot.segment.seqNo))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &logValueReader{
+		SectionReader: io.NewSectionReader(f, spot.offset, int64(spot.size)),
+		file:          f,
+		key:           key,
+		want:          binary.BigEndian.Uint32(record[:4]),
+		digest:        crc32.Update(0, castagnoli, record[4:]),
+	}, spot.size, nil
+}
+
+// LogValueReader verifies the checksum on the last read.
+type logValueReader struct {
+	*io.SectionReader
+	file   *os.File
+	key    uint // for error reporting
+	want   uint32
+	digest uint32
+}
+
+// Read implements the io.Reader interface.
+func (r *logValueReader) Read(p []byte) (n int, err error) {
+	n, err = r.SectionReader.Read(p)
+	r.digest = crc32.Update(r.digest, castagnoli, p[:n])
+	if err == io.EOF && r.digest != r.want {
+		err = &CorruptionError{Key: r.key, Want: r.want, Got: r.digest}
+	}
+	return n, err
+}
+
+// Close implements the io.Closer interface.
+func (r *logValueReader) Close() error {
+	return r.file.Close()
+}
+
+// Compact rewrites the live records into a new segment, and it removes all of
+// the previous segments.
+func (l *AppendLog) Compact() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.index == nil {
+		return errLogClosed
+	}
+	if l.err != nil {
+		return l.err
+	}
+	return l.compact()
+}
+
+// Compact is the implementation of Compact. The mutex must be held.
+func (l *AppendLog) compact() error {
+	f, err := os.OpenFile(l.compactFile(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	s := &logSegment{seqNo: l.segments[len(l.segments)-1].seqNo + 1, file: f}
+
+	// copy records in order of appearance
+	keys := make([]uint, 0, len(l.index))
+	for key := range l.index {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := l.index[keys[i]], l.index[keys[j]]
+		if a.segment != b.segment {
+			return a.segment.seqNo < b.segment.seqNo
+		}
+		return a.offset < b.offset
+	})
+	index := make(map[uint]logSpot, len(keys))
+	for _, key := range keys {
+		spot := l.index[key]
+		recordSize := logHeaderSize + int64(spot.size)
+		r := io.NewSectionReader(spot.segment.file, spot.offset-logHeaderSize, recordSize)
+		_, err = io.Copy(f, r)
+		if err != nil {
+			break
+		}
+		index[key] = logSpot{segment: s, offset: s.size + logHeaderSize, size: spot.size}
+		s.size += recordSize
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	name := f.Name()
+	if err == nil {
+		err = os.Rename(name, l.segmentFile(s.seqNo))
+		if err == nil {
+			name = l.segmentFile(s.seqNo)
+		}
+	}
+	if err == nil {
+		err = syncDir(l.dir)
+	}
+	if err != nil {
+		f.Close()
+		// The old segments still have all records.
+		os.Remove(name)
+		return fmt.Errorf("mqtt: append log compaction: %w", err)
+	}
+
+	// Remove in order of appearance, such that any segments left over, in
+	// case of failure, are newer than the ones removed.
+	old := l.segments
+	l.segments = []*logSegment{s}
+	l.index = index
+	l.liveSize = s.size
+	l.totalSize = s.size
+	for i, o := range old {
+		err := os.Remove(l.segmentFile(o.seqNo))
+		if err != nil {
+			// retain for next compaction
+			l.segments = append(old[i:len(old):len(old)], s)
+			for _, o := range old[i:] {
+				l.totalSize += o.size
+			}
+			return fmt.Errorf("mqtt: append log compaction left segment: %w", err)
+		}
+		o.file.Close()
+	}
+	return syncDir(l.dir)
+}
+
+// Close releases all resources. Any further operations are denied.
+func (l *AppendLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.index == nil {
+		return nil // already closed
+	}
+	l.index = nil
+	return l.closeSegments()
+}
+
+func (l *AppendLog) closeSegments() error {
+	var err error
+	for _, s := range l.segments {
+		if closeErr := s.file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	l.segments = nil
+	return err
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(0)
+}
+
+// SyncDir persists directory entries, i.e., file creation, rename and removal.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
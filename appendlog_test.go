@@ -0,0 +1,335 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestAppendLog(t *testing.T, segmentMax int64) *AppendLog {
+	l, err := OpenAppendLog(t.TempDir(), segmentMax)
+	if err != nil {
+		t.Fatal("OpenAppendLog error:", err)
+	}
+	t.Cleanup(func() {
+		if err := l.Close(); err != nil {
+			t.Error("append log Close error:", err)
+		}
+	})
+	return l
+}
+
+func TestAppendLogTornTail(t *testing.T) {
+	partialValue := logHeader(7, 9)
+	checksumMismatch := logHeader(7, 3)
+	for _, tail := range []string{
+		"\x00\x00\x00",                      // partial header
+		string(partialValue[:]) + "abc",     // partial value
+		string(checksumMismatch[:]) + "abc", // checksum mismatch
+	} {
+		dir := t.TempDir()
+		l, err := OpenAppendLog(dir, 0)
+		if err != nil {
+			t.Fatal("OpenAppendLog error:", err)
+		}
+		if err := l.Save(1, net.Buffers{[]byte("one")}); err != nil {
+			t.Fatal("Save 1 error:", err)
+		}
+		if err := l.Save(2, net.Buffers{[]byte("two")}); err != nil {
+			t.Fatal("Save 2 error:", err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal("Close error:", err)
+		}
+
+		name := filepath.Join(dir, "0000000000000001.log")
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(tail); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		l, err = OpenAppendLog(dir, 0)
+		if err != nil {
+			t.Fatalf("OpenAppendLog with tail %q got error: %s", tail, err)
+		}
+		if info2, err := os.Stat(name); err != nil {
+			t.Fatal(err)
+		} else if info2.Size() != info.Size() {
+			t.Errorf("tail %q got size %d after recovery, want %d", tail, info2.Size(), info.Size())
+		}
+		if err := l.Save(3, net.Buffers{[]byte("three")}); err != nil {
+			t.Errorf("Save after recovery of tail %q got error: %s", tail, err)
+		}
+		for key, want := range map[uint]string{1: "one", 2: "two", 3: "three"} {
+			if got, err := l.Load(key); err != nil {
+				t.Errorf("Load %d after recovery of tail %q got error: %s", key, tail, err)
+			} else if string(got) != want {
+				t.Errorf("Load %d after recovery of tail %q got %q, want %q", key, tail, got, want)
+			}
+		}
+		l.Close()
+	}
+}
+
+func TestAppendLogCorrupt(t *testing.T) {
+	for _, c := range []struct {
+		desc   string
+		offset int64
+		patch  string
+	}{
+		{"value of the first record", logHeaderSize, "One"},
+		{"size of the first record", 8, "\x00\x00\x10\x00"},
+	} {
+		dir := t.TempDir()
+		l, err := OpenAppendLog(dir, 0)
+		if err != nil {
+			t.Fatal("OpenAppendLog error:", err)
+		}
+		if err := l.Save(1, net.Buffers{[]byte("one")}); err != nil {
+			t.Fatal("Save 1 error:", err)
+		}
+		if err := l.Save(2, net.Buffers{[]byte("two")}); err != nil {
+			t.Fatal("Save 2 error:", err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal("Close error:", err)
+		}
+
+		name := filepath.Join(dir, "0000000000000001.log")
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte(c.patch), c.offset); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if l, err := OpenAppendLog(dir, 0); err == nil {
+			l.Close()
+			t.Errorf("OpenAppendLog got no error for corrupt %s", c.desc)
+		}
+		if info2, err := os.Stat(name); err != nil {
+			t.Fatal(err)
+		} else if info2.Size() != info.Size() {
+			t.Errorf("got size %d after corrupt %s, want %d unchanged", info2.Size(), c.desc, info.Size())
+		}
+	}
+}
+
+func TestAppendLogLoadCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenAppendLog(dir, 0)
+	if err != nil {
+		t.Fatal("OpenAppendLog error:", err)
+	}
+	defer l.Close()
+	if err := l.Save(1, net.Buffers{[]byte("one")}); err != nil {
+		t.Fatal("Save error:", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "0000000000000001.log"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("One"), logHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	_, err = l.Load(1)
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) || corrupt.Key != 1 {
+		t.Errorf("Load got error %v, want a CorruptionError for key 1", err)
+	}
+}
+
+func TestAppendLogCompactRetry(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenAppendLog(dir, 64)
+	if err != nil {
+		t.Fatal("OpenAppendLog error:", err)
+	}
+	defer l.Close()
+
+	// block compaction with a directory in place of its file
+	if err := os.MkdirAll(filepath.Join(l.compactFile(), "block"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; l.compactRetry == 0; i++ {
+		if i > 100 {
+			t.Fatal("no compaction attempt")
+		}
+		if err := l.Save(7, net.Buffers{[]byte{byte(i)}}); err != nil {
+			t.Fatal("Save during compaction failure got error:", err)
+		}
+	}
+	retry := l.compactRetry
+	if err := l.Save(7, net.Buffers{[]byte("x")}); err != nil {
+		t.Fatal("Save error:", err)
+	}
+	if l.compactRetry != retry {
+		t.Errorf("compaction retried before %d bytes", retry)
+	}
+
+	if err := os.RemoveAll(l.compactFile()); err != nil {
+		t.Fatal(err)
+	}
+	for n := l.totalSize; n < retry; n += logHeaderSize + 1 {
+		if err := l.Save(7, net.Buffers{[]byte("y")}); err != nil {
+			t.Fatal("Save error:", err)
+		}
+	}
+	if len(l.segments) != 1 {
+		t.Errorf("got %d segments after retry, want 1 from compaction", len(l.segments))
+	}
+}
+
+func TestAppendLogCompact(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenAppendLog(dir, 64)
+	if err != nil {
+		t.Fatal("OpenAppendLog error:", err)
+	}
+	defer func() {
+		l.Close()
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := l.Save(7, net.Buffers{[]byte{byte(i)}}); err != nil {
+			t.Fatal("Save error:", err)
+		}
+	}
+	if err := l.Save(8, net.Buffers{[]byte("gone")}); err != nil {
+		t.Fatal("Save error:", err)
+	}
+	if err := l.Delete(8); err != nil {
+		t.Fatal("Delete error:", err)
+	}
+	if err := l.Compact(); err != nil {
+		t.Fatal("Compact error:", err)
+	}
+
+	names, err := readDirNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("got files %q after Compact, want 1 segment", names)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal("Close error:", err)
+	}
+	l, err = OpenAppendLog(dir, 64)
+	if err != nil {
+		t.Fatal("OpenAppendLog after compaction error:", err)
+	}
+	if got, err := l.Load(7); err != nil {
+		t.Error("Load 7 got error:", err)
+	} else if len(got) != 1 || got[0] != 99 {
+		t.Errorf("Load 7 got %#x, want 0x63", got)
+	}
+	if got, err := l.Load(8); err != nil {
+		t.Error("Load 8 got error:", err)
+	} else if got != nil {
+		t.Errorf("Load deleted 8 got %#x, want nil", got)
+	}
+}
+
+func TestAppendLogAdoptSession(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		Dialer: func(context.Context) (net.Conn, error) {
+			return nil, errors.New("dialer call not allowed for test")
+		},
+	}
+
+	l, err := OpenAppendLog(dir, 0)
+	if err != nil {
+		t.Fatal("OpenAppendLog error:", err)
+	}
+	client, err := InitSession("test-client", l, config)
+	if err != nil {
+		t.Fatal("InitSession error:", err)
+	}
+	client.Close()
+	l.Close()
+
+	// record cut short by a crash
+	f, err := os.OpenFile(filepath.Join(dir, "0000000000000001.log"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := logHeader(0x8000, 0x20)
+	f.Write(header[:])
+	f.WriteString("PUB")
+	f.Close()
+
+	l, err = OpenAppendLog(dir, 0)
+	if err != nil {
+		t.Fatal("OpenAppendLog with torn tail error:", err)
+	}
+	defer l.Close()
+	client, warn, err := AdoptSession(l, config)
+	if err != nil {
+		t.Fatal("AdoptSession error:", err)
+	}
+	defer client.Close()
+	for _, err := range warn {
+		t.Error("AdoptSession warning:", err)
+	}
+}
+
+func TestAppendLogSaveFromSlowReader(t *testing.T) {
+	l := newTestAppendLog(t, 0)
+
+	r, w := io.Pipe()
+	saveFromErr := make(chan error, 1)
+	go func() {
+		saveFromErr <- l.SaveFrom(1, r, 3)
+	}()
+	if _, err := w.Write([]byte("on")); err != nil {
+		t.Fatal("pipe write error:", err)
+	}
+
+	// reader pending
+	if err := l.Save(2, net.Buffers{[]byte("two")}); err != nil {
+		t.Error("Save during SaveFrom got error:", err)
+	}
+	if _, err := w.Write([]byte("e")); err != nil {
+		t.Fatal("pipe write error:", err)
+	}
+	if err := <-saveFromErr; err != nil {
+		t.Fatal("SaveFrom error:", err)
+	}
+
+	for key, want := range map[uint]string{1: "one", 2: "two"} {
+		if got, err := l.Load(key); err != nil {
+			t.Errorf("Load %d got error: %s", key, err)
+		} else if string(got) != want {
+			t.Errorf("Load %d got %q, want %q", key, got, want)
+		}
+	}
+	if names, err := readDirNames(l.dir); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 {
+		t.Errorf("got files %q, want 1 segment only", names)
+	}
+}
@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Backoff returns the delay before a connect retry. N counts the number of
+// consecutive failed connect attempts so far, with err as the latest cause.
+// Connections lost within a minute count as a failed attempt too. The count
+// resets only after a connection lasted longer.
+type Backoff func(n int, err error) time.Duration
+
+// NewBackoff returns a truncated exponential backoff with jitter. The delay
+// starts at min, and it doubles with each consecutive failure up to max. Denial
+// from the broker, i.e., IsConnectionRefused, gets the refused delay instead,
+// as such retries rarely succeed any time soon. Zero durations apply defaults,
+// which are 1 second, 2 minutes and 15 minutes respectively. Each delay is cut
+// by a random amount of up to half its duration to spread reconnects.
+func NewBackoff(min, max, refused time.Duration) Backoff {
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 2 * time.Minute
+	}
+	if max < min {
+		max = min
+	}
+	if refused <= 0 {
+		refused = 15 * time.Minute
+	}
+
+	return func(n int, err error) time.Duration {
+		d := refused
+		if !IsConnectionRefused(err) {
+			d = min
+			for ; n > 1 && d < max; n-- {
+				d *= 2
+			}
+			if d > max {
+				d = max
+			}
+		}
+		return d - time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+}
+
+// BackoffResetAfter is the minimum duration of a connection to clear the count
+// of consecutive connect failures. Connections which get lost any sooner count
+// as a failure, such that a broker which drops clients right after CONNACK is
+// not flooded with reconnects.
+const backoffResetAfter = time.Minute
+
+// ErrConnectUnstable is the Backoff cause for connections which got lost within
+// backoffResetAfter.
+var errConnectUnstable = errors.New("mqtt: connection lost shortly after connect")
+
+// ConnectWithBackoff applies the Backoff policy, if any, before a connect retry.
+// Close and Disconnect interrupt the delay.
+func (c *Client) connectWithBackoff() error {
+	if !c.connectTime.IsZero() {
+		// previous connection lost
+		if time.Since(c.connectTime) < backoffResetAfter {
+			c.connectFailN++
+			c.connectFailErr = errConnectUnstable
+		} else {
+			c.connectFailN = 0
+			c.connectFailErr = nil
+		}
+		c.connectTime = time.Time{}
+	}
+
+	if c.Backoff != nil && c.connectFailN != 0 {
+		timer := time.NewTimer(c.Backoff(c.connectFailN, c.connectFailErr))
+		select {
+		case <-timer.C:
+			break
+		case <-c.dialCtx.Done():
+			timer.Stop() // connect aborts with ErrClosed
+		}
+	}
+
+	err := c.connect()
+	if err != nil && err != ErrSessionLost {
+		c.connectFailN++
+		c.connectFailErr = err
+	} else {
+		c.connectTime = time.Now()
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+func TestNewBackoff(t *testing.T) {
+	backoff := mqtt.NewBackoff(time.Second, 5*time.Second, time.Minute)
+	errTransient := errors.New("transient test error")
+	tests := []struct {
+		n        int
+		err      error
+		min, max time.Duration
+	}{
+		{1, errTransient, time.Second / 2, time.Second},
+		{2, errTransient, time.Second, 2 * time.Second},
+		{3, errTransient, 2 * time.Second, 4 * time.Second},
+		{4, errTransient, 5 * time.Second / 2, 5 * time.Second},
+		{99, errTransient, 5 * time.Second / 2, 5 * time.Second},
+		{1, mqtt.ErrAuth, time.Minute / 2, time.Minute},
+		{9, mqtt.ErrUnavailable, time.Minute / 2, time.Minute},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			got := backoff(test.n, test.err)
+			if got < test.min || got > test.max {
+				t.Errorf("backoff(%d, %q) got %s, want in range [%s, %s]", test.n, test.err, got, test.min, test.max)
+				break
+			}
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	errDial := errors.New("dial test error")
+	var attemptN int
+	var backoffArgs []int
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer: func(context.Context) (net.Conn, error) {
+			attemptN++
+			return nil, errDial
+		},
+		Backoff: func(n int, err error) time.Duration {
+			if !errors.Is(err, errDial) {
+				t.Errorf("backoff got error %v, want dial error", err)
+			}
+			backoffArgs = append(backoffArgs, n)
+			if n < 3 {
+				return time.Millisecond
+			}
+			return time.Hour
+		},
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, _, _, err := client.ReadSlices(); !errors.Is(err, errDial) {
+			t.Fatalf("ReadSlices got error %v, want dial error", err)
+		}
+	}
+	if attemptN != 3 {
+		t.Errorf("got %d dial attempts, want 3", attemptN)
+	}
+
+	// interrupt the hour delay
+	time.AfterFunc(time.Second/8, func() { client.Close() })
+	if _, _, _, err := client.ReadSlices(); !errors.Is(err, mqtt.ErrClosed) {
+		t.Errorf("ReadSlices got error %v, want mqtt.ErrClosed", err)
+	}
+	if got := fmt.Sprint(backoffArgs); got != "[1 2 3]" {
+		t.Errorf("backoff invoked with failure counts %s, want [1 2 3]", got)
+	}
+}
+
+func TestBackoffUnstable(t *testing.T) {
+	t.Parallel()
+
+	clientConns := make([]net.Conn, 3)
+	brokerConns := make([]net.Conn, 3)
+	for i := range clientConns {
+		clientConns[i], brokerConns[i] = net.Pipe()
+	}
+	var backoffArgs []int
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientConns...),
+		Backoff: func(n int, err error) time.Duration {
+			if err == nil {
+				t.Error("backoff got no error")
+			}
+			backoffArgs = append(backoffArgs, n)
+			return time.Millisecond
+		},
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	readRoutineDone := testRoutine(t, func() {
+		for {
+			_, _, _, err := client.ReadSlices()
+			if errors.Is(err, mqtt.ErrClosed) {
+				return
+			}
+		}
+	})
+
+	// each connection is lost right after CONNACK
+	for i, conn := range brokerConns {
+		wantPacketHex(t, conn, pipeCONNECTHex)
+		sendPacketHex(t, conn, "20020000") // CONNACK
+		if i < len(brokerConns)-1 {
+			if err := conn.Close(); err != nil {
+				t.Fatal("broker got error on connection close:", err)
+			}
+		}
+	}
+	client.Close()
+	<-readRoutineDone
+	if got := fmt.Sprint(backoffArgs); got != "[1 2]" {
+		t.Errorf("backoff invoked with failure counts %s, want [1 2]", got)
+	}
+}
@@ -11,7 +11,10 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pascaldekloe/mqtt/topics"
 )
 
 // ReadBufSize covers inbound packet reception. BigMessage still uses the buffer
@@ -27,6 +30,11 @@ var ErrDown = errors.New("mqtt: connection unavailable")
 // Further invocation will result again in an ErrClosed error.
 var ErrClosed = errors.New("mqtt: client closed")
 
+// ErrSessionLost signals a connect without the session present, while the
+// Client did expect the broker to resume with its state. Any subscriptions
+// from before are gone. The connection remains functional.
+var ErrSessionLost = errors.New("mqtt: broker did not resume the session")
+
 // ErrBrokerTerm signals connection loss for unknown reasons.
 var errBrokerTerm = fmt.Errorf("mqtt: broker closed the connection (%w)", io.EOF)
 
@@ -97,6 +105,18 @@ type Config struct {
 	// values are truncated silently.
 	AtLeastOnceMax, ExactlyOnceMax int
 
+	// AtLeastOnceExpiry drops pending PublishAtLeastOnce transfers which
+	// are older than the duration on reconnect, instead of a resend. The
+	// respective exchange channels receive ErrExpired. Transfers from an
+	// AdoptSession count from the moment of adoption. Zero disables the
+	// mechanism.
+	//
+	// Expiry applies to the head of the queue only, i.e., it stops at the
+	// first transfer which did not expire. Nothing expires in between
+	// connects. Expired transfers remain pending until the next connect
+	// attempt, and they do count towards AtLeastOnceMax in the mean time.
+	AtLeastOnceExpiry time.Duration
+
 	// The user name may be used by the broker for authentication and/or
 	// authorization purposes. An empty string omits the option, except
 	// for when password is not nil.
@@ -114,19 +134,77 @@ type Config struct {
 		ExactlyOnce bool // overrides AtLeastOnce
 	}
 
-	KeepAlive uint16 // timeout in seconds (disabled with zero)
+	// KeepAlive is the maximum number of seconds between two consecutive
+	// packet submissions. The Client sends a PINGREQ by itself when idle
+	// for the interval. Connections without a PINGRESP within yet another
+	// interval are treated as broken. Zero disables the mechanism. MQTT 5.0
+	// brokers may override the interval on connect.
+	KeepAlive uint16
+
+	// ProtocolLevel selects the version of MQTT. Zero defaults to level 4,
+	// which is MQTT version 3.1.1. Level 5 enables MQTT version 5.0, with
+	// its properties and reason codes. Level 3 is the original MQTT version
+	// 3.1 from IBM (“MQIsdp”), with client identifiers limited to 23 bytes.
+	// Persistence remains compatible, yet sessions can not switch protocol
+	// level with pending transfers.
+	ProtocolLevel byte
+
+	// TopicAliasMax permits the broker to replace topic names on inbound
+	// messages with an alias, up to the number (MQTT 5.0 only). Zero
+	// disables the option.
+	TopicAliasMax uint16
 
 	// Brokers must resume communications with the client (identified by
 	// ClientID) when CleanSession is false. Otherwise, brokers must create
 	// a new session when either CleanSession is true or when no session is
 	// associated to the client identifier.
 	CleanSession bool
+
+	// Backoff delays connect retries from ReadSlices, starting after the
+	// first failed attempt. The Client remains in the ErrDown state during
+	// the delay. Nil disables the mechanism, which leaves any backoff to the
+	// read routine. See NewBackoff for a reasonable policy.
+	Backoff Backoff
+
+	// CoalesceMax enables write coalescing for PUBLISH packets without
+	// packet identifier, i.e., the “at most once” variants. Concurrent
+	// submissions are combined in a single write, in order of appearance,
+	// up to the number of bytes per write. Zero disables the mechanism.
+	CoalesceMax int
+	// CoalesceDelay is the maximum amount of time a submission may wait
+	// for others to join its write, unless CoalesceMax is reached sooner.
+	// Zero combines only what is pending behind the write semaphore.
+	CoalesceDelay time.Duration
+
+	// OfflineBufferMax enables an in-memory buffer for PUBLISH packets
+	// without packet identifier, i.e., the “at most once” variants, while
+	// the Client is down [ErrDown]. The buffered requests return with
+	// ErrBuffered instead, up to the number of bytes in packets. The next
+	// connect submits the buffer in order of appearance, before any other
+	// request. Zero disables the mechanism.
+	OfflineBufferMax int
+	// OfflineBufferLen limits the number of packets in the buffer. Zero
+	// imposes no limit other than OfflineBufferMax.
+	OfflineBufferLen int
+	// OfflineDropOldest evicts the oldest packets from a full buffer to
+	// make room. Otherwise, new requests are dropped with ErrDown.
+	OfflineDropOldest bool
 }
 
 func (c *Config) valid() error {
 	if c.Dialer == nil {
 		return errors.New("mqtt: no Dialer in Config")
 	}
+	switch c.ProtocolLevel {
+	case 0, 3, 4:
+		if c.TopicAliasMax != 0 {
+			return fmt.Errorf("mqtt: topic alias maximum in Config: %w", errProperties)
+		}
+	case 5:
+		break
+	default:
+		return fmt.Errorf("mqtt: protocol level %d in Config not supported", c.ProtocolLevel)
+	}
 	if err := stringCheck(c.UserName); err != nil {
 		return fmt.Errorf("mqtt: illegal user name: %w", err)
 	}
@@ -139,7 +217,7 @@ func (c *Config) valid() error {
 
 	var err error
 	if c.Will.Message != nil {
-		err = topicCheck(c.Will.Topic)
+		err = topics.CheckName(c.Will.Topic)
 	} else {
 		err = stringCheck(c.Will.Topic)
 	}
@@ -155,6 +233,21 @@ func (c *Config) newCONNREQ(clientID []byte) []byte {
 	size := 12 + len(clientID)
 	var flags uint
 
+	var props []byte // MQTT 5.0 only
+	if c.ProtocolLevel == 5 {
+		// “If the Session Expiry Interval is absent the value 0 is used.
+		// If it is set to 0, or is absent, the Session ends when the
+		// Network Connection is closed.”
+		// — MQTT Version 5.0, subsection 3.1.2.11.2
+		if !c.CleanSession {
+			props = append(props, propSessionExpiry, 0xff, 0xff, 0xff, 0xff)
+		}
+		if c.TopicAliasMax != 0 {
+			props = append(props, propTopicAliasMax, byte(c.TopicAliasMax>>8), byte(c.TopicAliasMax))
+		}
+		size += 1 + len(props) // property length < 128
+	}
+
 	// Supply an empty user name when the password is set to comply with “If
 	// the User Name Flag is set to 0, the Password Flag MUST be set to 0.”
 	// — MQTT Version 3.1.1, conformance statement MQTT-3.1.2-22
@@ -169,6 +262,9 @@ func (c *Config) newCONNREQ(clientID []byte) []byte {
 
 	if c.Will.Message != nil {
 		size += 4 + len(c.Will.Topic) + len(c.Will.Message)
+		if c.ProtocolLevel == 5 {
+			size++ // empty will properties
+		}
 		if c.Will.Retain {
 			flags |= 1 << 5
 		}
@@ -185,20 +281,38 @@ func (c *Config) newCONNREQ(clientID []byte) []byte {
 		flags |= 1 << 1
 	}
 
+	level := c.ProtocolLevel
+	if level == 0 {
+		level = 4
+	}
+	protocolName := "MQTT"
+	if level == 3 {
+		protocolName = "MQIsdp"
+		size += len(protocolName) - 4
+	}
+
 	// encode packet
-	packet := make([]byte, 0, size+2)
+	packet := make([]byte, 0, size+5)
 	packet = append(packet, typeCONNECT<<4)
 	l := uint(size)
 	for ; l > 0x7f; l >>= 7 {
 		packet = append(packet, byte(l|0x80))
 	}
-	packet = append(packet, byte(l),
-		0, 4, 'M', 'Q', 'T', 'T', 4, byte(flags),
+	packet = append(packet, byte(l))
+	packet = appendString(packet, protocolName)
+	packet = append(packet, level, byte(flags),
 		byte(c.KeepAlive>>8), byte(c.KeepAlive),
-		byte(len(clientID)>>8), byte(len(clientID)),
 	)
+	if level == 5 {
+		packet = append(packet, byte(len(props)))
+		packet = append(packet, props...)
+	}
+	packet = append(packet, byte(len(clientID)>>8), byte(len(clientID)))
 	packet = append(packet, clientID...)
 	if c.Will.Message != nil {
+		if level == 5 {
+			packet = append(packet, 0) // no will properties
+		}
 		packet = append(packet, byte(len(c.Will.Topic)>>8), byte(len(c.Will.Topic)))
 		packet = append(packet, c.Will.Topic...)
 		packet = append(packet, byte(len(c.Will.Message)>>8), byte(len(c.Will.Message)))
@@ -222,11 +336,16 @@ func (c *Config) newCONNREQ(clientID []byte) []byte {
 // goes for the automatic reconnects on connection loss.
 //
 // A single goroutine must invoke ReadSlices consecutively until ErrClosed. Some
-// backoff on error reception comes recommended though.
+// backoff on error reception comes recommended though, e.g., with Config.Backoff.
 //
 // Multiple goroutines may invoke methods on a Client simultaneously, except for
 // ReadSlices.
 type Client struct {
+	// Keep-alive tracks the latest submission in Unix nanoseconds, and the
+	// number of PINGRESP receptions. Both are accessed atomically, and they
+	// go first for 64-bit alignment.
+	lastWrite, pongN int64
+
 	Config // read-only
 
 	persistence Persistence // tracks the session
@@ -268,11 +387,49 @@ type Client struct {
 	orderedTxs
 	unorderedTxs
 
+	subscriptions subscriptions
+
+	// Publish combines writes when enabled with Config.CoalesceMax.
+	coalesce coalesce
+
+	// Pending transfers are tracked for introspection.
+	outbound outbound
+
+	// Publish holds packets while down when enabled with
+	// Config.OfflineBufferMax.
+	offlineBuffer offlineBuffer
+
 	// The read routine sends its content on the next ReadSlices.
 	pendingAck []byte
 
 	// The read routine parks reception beyond readBufSize.
 	bigMessage *BigMessage
+
+	// The read routine tracks the properties of the latest message, and
+	// the topic names per alias, which reset on each connect (MQTT 5.0).
+	messageProps []byte
+	topicAliases [][]byte
+
+	// The read routine tracks the session present flag from CONNACK, and
+	// whether the next CONNACK should have the flag set.
+	sessionPresent uint32 // atomic boolean
+	sessionExpect  bool
+
+	// The read routine tracks the limits from CONNACK (MQTT 5.0), with
+	// zero for none. ReceiveMaxLock covers the sum of both publish queues.
+	receiveMax     uint32 // atomic
+	packetSizeMax  uint32 // atomic
+	receiveMaxLock sync.Mutex
+
+	// DisconnectDrain denies publish requests [atomic boolean], and it
+	// awaits signals from queue removals.
+	draining uint32
+	drainSig chan struct{}
+
+	// The read routine tracks consecutive connect failures for Backoff.
+	connectFailN   int
+	connectFailErr error
+	connectTime    time.Time // zero when no connection since last attempt
 }
 
 // Transfer holds state of an outbound exchange-type.
@@ -289,6 +446,16 @@ type transfer struct {
 	block chan holdup
 }
 
+// Unlock releases the submission lock, with a holdup for any entries in q. The
+// sequence number is the one of the next submission.
+func (t *transfer) unlock(seqNo uint) {
+	if n := uint(len(t.q)); n != 0 {
+		t.block <- holdup{seqNo - n, seqNo - 1}
+	} else {
+		t.seqNoSem <- seqNo
+	}
+}
+
 func newClient(p Persistence, config *Config) *Client {
 	// need 1 packet identifier free to determine the first and last entry
 	if config.AtLeastOnceMax < 0 || config.AtLeastOnceMax > publishIDMask {
@@ -320,6 +487,16 @@ func newClient(p Persistence, config *Config) *Client {
 		unorderedTxs: unorderedTxs{
 			perPacketID: make(map[uint16]unorderedCallback),
 		},
+		subscriptions: subscriptions{
+			perFilter: make(map[string]subscription),
+		},
+		coalesce: coalesce{
+			full: make(chan struct{}, 1),
+		},
+		drainSig: make(chan struct{}, 1),
+	}
+	if config.TopicAliasMax != 0 {
+		c.topicAliases = make([][]byte, int(config.TopicAliasMax)+1)
 	}
 
 	// start in offline state
@@ -417,6 +594,68 @@ func (c *Client) Disconnect(quit <-chan struct{}) error {
 	return closeErr
 }
 
+// DisconnectDrain is like Disconnect, but it awaits confirmation of all pending
+// PublishAtLeastOnce and PublishExactlyOnce first. New publish requests are
+// denied with ErrClosed from the start. The read routine must keep running for
+// the confirmations to arrive.
+//
+// Quit is optional, as nil just blocks. Appliance of quit during the wait will
+// strictly result in ErrCanceled, with the number of transfers left pending.
+// The DISCONNECT is sent regardless, which discards the Will.
+func (c *Client) DisconnectDrain(quit <-chan struct{}) (pendingN int, err error) {
+	atomic.StoreUint32(&c.draining, 1)
+	// Submissions which passed the draining check hold a lock.
+	if !c.atLeastOnce.awaitSubmit() || !c.exactlyOnce.awaitSubmit() {
+		return 0, ErrClosed
+	}
+
+	for {
+		pendingN = len(c.atLeastOnce.q) + len(c.exactlyOnce.q)
+		if pendingN == 0 {
+			break
+		}
+		select {
+		case <-c.drainSig:
+			continue
+		case <-quit:
+			err := c.Disconnect(nil)
+			if err != nil {
+				return pendingN, fmt.Errorf("%w with %d transfers pending; %s", ErrCanceled, pendingN, err)
+			}
+			return pendingN, fmt.Errorf("%w with %d transfers pending", ErrCanceled, pendingN)
+		}
+	}
+	return 0, c.Disconnect(quit)
+}
+
+// AwaitSubmit returns once the sequence number lock is available. False means
+// that the Client is closed.
+func (t *transfer) awaitSubmit() bool {
+	select {
+	case seqNo, ok := <-t.seqNoSem:
+		if !ok {
+			return false
+		}
+		t.seqNoSem <- seqNo
+	case holdup := <-t.block:
+		t.block <- holdup
+	}
+	return true
+}
+
+// DrainProgress signals DisconnectDrain on queue removals.
+func (c *Client) drainProgress() {
+	select {
+	case c.drainSig <- struct{}{}:
+	default: // pending signal
+	}
+}
+
+// IsDraining returns whether DisconnectDrain denies new publish requests.
+func (c *Client) isDraining() bool {
+	return atomic.LoadUint32(&c.draining) != 0
+}
+
 func (c *Client) termCallbacks() {
 	var wg sync.WaitGroup
 
@@ -477,6 +716,7 @@ func (c *Client) termCallbacks() {
 		break
 	}
 	wg.Wait()
+	c.drainProgress()
 
 	c.unorderedTxs.breakAll()
 }
@@ -570,6 +810,38 @@ func (c *Client) lockWrite(quit <-chan struct{}) (net.Conn, error) {
 	}
 }
 
+// WriteFrom submits the head with n bytes from r as the payload. Errors after
+// the head are fatal to the connection, as the packet can not complete, nor can
+// the consumed bytes from r be retried.
+func (c *Client) writeFrom(quit <-chan struct{}, head net.Buffers, r io.Reader, n int) error {
+	for {
+		conn, err := c.lockWrite(quit)
+		if err != nil {
+			return err
+		}
+
+		err = writeBuffers(conn, head, c.PauseTimeout)
+		switch {
+		case err == nil:
+			err = writeFrom(conn, r, n, c.PauseTimeout)
+			if err == nil {
+				atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+				c.writeSem <- conn // unlocks writes
+				return nil
+			}
+
+		case errors.Is(err, net.ErrClosed), errors.Is(err, io.ErrClosedPipe):
+			// got interrupted; read routine will determine next course
+			c.writeBlock <- struct{}{} // parks writes
+			continue
+		}
+
+		conn.Close()               // interrupts read routine
+		c.writeBlock <- struct{}{} // parks writes
+		return err
+	}
+}
+
 // Write submits the packet. Keep synchronised with writeBuffers!
 func (c *Client) write(quit <-chan struct{}, p []byte) error {
 	for {
@@ -580,6 +852,7 @@ func (c *Client) write(quit <-chan struct{}, p []byte) error {
 
 		switch err := write(conn, p, c.PauseTimeout); {
 		case err == nil:
+			atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
 			c.writeSem <- conn // unlocks writes
 			return nil
 
@@ -605,6 +878,7 @@ func (c *Client) writeBuffers(quit <-chan struct{}, p net.Buffers) error {
 
 		switch err := writeBuffers(conn, p, c.PauseTimeout); {
 		case err == nil:
+			atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
 			c.writeSem <- conn // unlocks writes
 			return nil
 
@@ -651,6 +925,13 @@ func write(conn net.Conn, p []byte, idleTimeout time.Duration) error {
 
 // WriteBuffers submits the packet. Keep synchronised with write!
 func writeBuffers(conn net.Conn, p net.Buffers, idleTimeout time.Duration) error {
+	_, err := writeBuffersCount(conn, p, idleTimeout)
+	return err
+}
+
+// WriteBuffersCount is like writeBuffers, but it also returns the number of
+// bytes written.
+func writeBuffersCount(conn net.Conn, p net.Buffers, idleTimeout time.Duration) (written int64, err error) {
 	if idleTimeout != 0 {
 		// Abandon timer to prevent waking up the system for no good reason.
 		// https://developer.apple.com/library/archive/documentation/Performance/Conceptual/EnergyGuide-iOS/MinimizeTimerUse.html
@@ -661,17 +942,18 @@ func writeBuffers(conn net.Conn, p net.Buffers, idleTimeout time.Duration) error
 		if idleTimeout != 0 {
 			err := conn.SetWriteDeadline(time.Now().Add(idleTimeout))
 			if err != nil {
-				return err // deemed critical
+				return written, err // deemed critical
 			}
 		}
 		n, err := p.WriteTo(conn)
+		written += n
 		if err == nil { // OK
-			return nil
+			return written, nil
 		}
 		// Allow deadline expiry if at least one byte was transferred.
 		var ne net.Error
 		if n == 0 || !errors.As(err, &ne) || !ne.Timeout() {
-			return err
+			return written, err
 		}
 
 		// Don't modify the original buffers.
@@ -689,6 +971,34 @@ func writeBuffers(conn net.Conn, p net.Buffers, idleTimeout time.Duration) error
 	}
 }
 
+// WriteFrom submits n bytes from r. The idle timeout does not apply to r.
+func writeFrom(conn net.Conn, r io.Reader, n int, idleTimeout time.Duration) error {
+	bufSize := 32 * 1024
+	if n < bufSize {
+		bufSize = n
+	}
+	buf := make([]byte, bufSize)
+	for n != 0 {
+		chunk := buf
+		if len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		_, err := io.ReadFull(r, chunk)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("mqtt: message read with %d bytes left: %w", n, err)
+		}
+		err = write(conn, chunk, idleTimeout)
+		if err != nil {
+			return err
+		}
+		n -= len(chunk)
+	}
+	return nil
+}
+
 // PeekPacket slices a packet payload from the read buffer into c.peek.
 func (c *Client) peekPacket() (head byte, err error) {
 	head, err = c.r.ReadByte()
@@ -761,14 +1071,13 @@ func (c *Client) peekPacket() (head byte, err error) {
 	}
 }
 
-// Connect installs the transport layer. The current
-// connection must be closed in case of a reconnect.
+// Connect installs the transport layer. The current connection must be closed
+// in case of a reconnect. ErrSessionLost leaves the connection installed.
 func (c *Client) connect() error {
 	clientID, err := c.persistence.Load(clientIDKey)
 	if err != nil {
 		return err
 	}
-	packet := c.newCONNREQ(clientID)
 
 	<-c.Offline() // extra verification
 
@@ -797,29 +1106,21 @@ func (c *Client) connect() error {
 	case holdup := <-c.exactlyOnce.block:
 		exactlyOnceSeqNo = holdup.UntilSeqNo + 1
 	}
+	c.expireAtLeastOnce()
 
 	// Reconnects shouldn't reset the session.
 	if oldConn != nil && c.CleanSession {
 		c.CleanSession = false
 	}
+	packet := c.newCONNREQ(clientID)
 	ctx, cancel := context.WithTimeout(c.dialCtx, c.PauseTimeout)
 	defer cancel()
 	conn, err := c.Dialer(ctx)
 	if err != nil {
 		c.connSem <- oldConn // unlock for next attempt
 		c.writeSem <- nil    // causes ErrDown
-		n := uint(len(c.atLeastOnce.q))
-		if n == 0 {
-			c.atLeastOnce.seqNoSem <- atLeastOnceSeqNo
-		} else {
-			c.atLeastOnce.block <- holdup{atLeastOnceSeqNo - n, atLeastOnceSeqNo - 1}
-		}
-		n = uint(len(c.exactlyOnce.q))
-		if n == 0 {
-			c.exactlyOnce.seqNoSem <- exactlyOnceSeqNo
-		} else {
-			c.exactlyOnce.block <- holdup{exactlyOnceSeqNo - n, exactlyOnceSeqNo - 1}
-		}
+		c.atLeastOnce.unlock(atLeastOnceSeqNo)
+		c.exactlyOnce.unlock(exactlyOnceSeqNo)
 
 		// FIXME(pascaldekloe): Error string matching is supported
 		// according to <https://github.com/golang/go/issues/36208>.
@@ -835,7 +1136,20 @@ func (c *Client) connect() error {
 
 	c.connSem <- conn // release early for interruption by Close
 
-	r, err := c.handshake(conn, packet)
+	r, ack, err := c.handshake(conn, packet)
+	if o, ok := conn.(handshakeObserver); ok {
+		o.handshakeDone(err)
+	}
+	sessionPresent := ack.sessionPresent
+	if err == nil && !sessionPresent {
+		err = c.discardReceptionState()
+	}
+	if err == nil && !sessionPresent {
+		err = c.unconfirmSubscriptions()
+	}
+	if err == nil && ack.assignedClientID != nil {
+		err = c.persistence.Save(clientIDKey, net.Buffers{ack.assignedClientID})
+	}
 	if err != nil {
 		conn.Close()      // abandon
 		c.writeSem <- nil // causes ErrDown
@@ -843,27 +1157,42 @@ func (c *Client) connect() error {
 			// connSem entry closed
 			err = ErrClosed
 		}
-		n := uint(len(c.atLeastOnce.q))
-		if n == 0 {
-			c.atLeastOnce.seqNoSem <- atLeastOnceSeqNo
-		} else {
-			c.atLeastOnce.block <- holdup{atLeastOnceSeqNo - n, atLeastOnceSeqNo - 1}
-		}
-		n = uint(len(c.exactlyOnce.q))
-		if n == 0 {
-			c.exactlyOnce.seqNoSem <- exactlyOnceSeqNo
-		} else {
-			c.exactlyOnce.block <- holdup{exactlyOnceSeqNo - n, exactlyOnceSeqNo - 1}
-		}
+		c.atLeastOnce.unlock(atLeastOnceSeqNo)
+		c.exactlyOnce.unlock(exactlyOnceSeqNo)
 		return err
 	}
 
+	var present uint32
+	if sessionPresent {
+		present = 1
+	}
+	atomic.StoreUint32(&c.sessionPresent, present)
+	atomic.StoreUint32(&c.receiveMax, uint32(ack.receiveMax))
+	atomic.StoreUint32(&c.packetSizeMax, ack.packetSizeMax)
+	sessionLost := c.sessionExpect && !sessionPresent
+	c.sessionExpect = true
+
 	c.toOnline()
 	// install connection
+	atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano()) // CONNECT
+	// The offline buffer goes first, while the write lock is still held.
+	flushErr := c.flushOffline(conn)
 	c.writeSem <- conn
 	c.readConn = conn
 	c.r = r
 	c.peek = nil // applied to prevous r if any
+	for i := range c.topicAliases {
+		c.topicAliases[i] = nil // connection scoped
+	}
+	if flushErr != nil {
+		c.toOffline()
+		c.atLeastOnce.unlock(atLeastOnceSeqNo)
+		c.exactlyOnce.unlock(exactlyOnceSeqNo)
+		return flushErr
+	}
+	if ack.keepAlive != 0 {
+		go c.keepAlive(conn, c.Offline(), time.Duration(ack.keepAlive)*time.Second)
+	}
 
 	// Resend any pending PUBLISH and/or PUBREL entries from Persistence.
 	// The queues are locked because this runs within the read-routine and new
@@ -872,29 +1201,119 @@ func (c *Client) connect() error {
 		err := c.resendPublishPackets(atLeastOnceSeqNo-n, atLeastOnceSeqNo-1, atLeastOnceIDSpace)
 		if err != nil {
 			c.toOffline()
-			c.atLeastOnce.block <- holdup{atLeastOnceSeqNo - n, atLeastOnceSeqNo - 1}
-			n = uint(len(c.exactlyOnce.q))
-			c.exactlyOnce.block <- holdup{exactlyOnceSeqNo - n, exactlyOnceSeqNo - 1}
+			c.atLeastOnce.unlock(atLeastOnceSeqNo)
+			c.exactlyOnce.unlock(exactlyOnceSeqNo)
 			return err
 		}
 	}
 	c.atLeastOnce.seqNoSem <- atLeastOnceSeqNo
+	// PUBREC failures remain on Delete errors.
+	if err := c.endFailed(); err != nil {
+		c.toOffline()
+		c.exactlyOnce.unlock(exactlyOnceSeqNo)
+		return err
+	}
 	if n := uint(len(c.exactlyOnce.q)); n != 0 {
 		err := c.resendPublishPackets(exactlyOnceSeqNo-n, exactlyOnceSeqNo-1, exactlyOnceIDSpace)
 		if err != nil {
 			c.toOffline()
-			c.exactlyOnce.block <- holdup{exactlyOnceSeqNo - n, exactlyOnceSeqNo - 1}
+			c.exactlyOnce.unlock(exactlyOnceSeqNo)
 			return err
 		}
 	}
 	c.exactlyOnce.seqNoSem <- exactlyOnceSeqNo
 
+	if err := c.resubscribe(); err != nil {
+		c.toOffline()
+		return err
+	}
+
+	if sessionLost {
+		return ErrSessionLost
+	}
 	return nil
 }
 
+// DiscardReceptionState clears the inbound state, as the broker has no session
+// to match.
+func (c *Client) discardReceptionState() error {
+	// acknowledgements may not be send on packet identifiers from before
+	if len(c.pendingAck) != 0 && c.pendingAck[0]>>4 != typePUBREL {
+		c.pendingAck = c.pendingAck[:0]
+	}
+
+	keys, err := c.persistence.List()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key&remoteIDKeyFlag != 0 {
+			err := c.persistence.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SessionPresent returns whether the broker resumed a session on the current,
+// or the latest connection.
+func (c *Client) SessionPresent() bool {
+	return atomic.LoadUint32(&c.sessionPresent) != 0
+}
+
+// KeepAlive submits a PINGREQ when no other packets were send for the duration
+// of the interval. The connection is closed when no PINGRESP arrives within the
+// interval that follows, which causes the read routine to reconnect.
+func (c *Client) keepAlive(conn net.Conn, offline <-chan struct{}, interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	pingPending := false
+	var pongN int64 // count at PINGREQ submission
+	for {
+		select {
+		case <-offline:
+			return
+		case <-timer.C:
+			break
+		}
+
+		if pingPending {
+			if atomic.LoadInt64(&c.pongN) == pongN {
+				// “If a Client does not receive a PINGRESP Packet
+				// within a reasonable amount of time after it has
+				// sent a PINGREQ, it SHOULD close the Network
+				// Connection to the Server.”
+				// — MQTT Version 3.1.1, subsection 3.1.2.10
+				conn.Close() // interrupts read routine
+				return
+			}
+			pingPending = false
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastWrite)))
+		if idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+
+		pongN = atomic.LoadInt64(&c.pongN)
+		if err := c.write(offline, packetPINGREQ); err != nil {
+			return // read routine will determine next course
+		}
+		pingPending = true
+		timer.Reset(interval)
+	}
+}
+
 func (c *Client) resendPublishPackets(firstSeqNo, lastSeqNo uint, space uint) error {
 	for seqNo := firstSeqNo; seqNo <= lastSeqNo; seqNo++ {
 		key := seqNo&publishIDMask | space
+		if _, ok := c.orderedTxs.Failed[key]; ok {
+			continue // ended with PUBREC [MQTT 5.0]
+		}
 		packet, err := c.persistence.Load(key)
 		if err != nil {
 			return err
@@ -913,23 +1332,41 @@ func (c *Client) resendPublishPackets(firstSeqNo, lastSeqNo uint, space uint) er
 	return nil
 }
 
-func (c *Client) handshake(conn net.Conn, requestPacket []byte) (*bufio.Reader, error) {
-	err := write(conn, requestPacket, c.PauseTimeout)
+// ConnAck has the applicable content from a CONNACK.
+type connAck struct {
+	sessionPresent   bool
+	keepAlive        uint16 // interval in seconds
+	assignedClientID []byte // MQTT 5.0 only
+	receiveMax       uint16 // MQTT 5.0 only; zero for none
+	packetSizeMax    uint32 // MQTT 5.0 only; zero for none
+}
+
+func (c *Client) handshake(conn net.Conn, requestPacket []byte) (r *bufio.Reader, ack connAck, err error) {
+	ack.keepAlive = c.KeepAlive
+	err = write(conn, requestPacket, c.PauseTimeout)
 	if err != nil {
-		return nil, err
+		return nil, ack, err
 	}
 
-	r := bufio.NewReaderSize(conn, readBufSize)
+	r = bufio.NewReaderSize(conn, readBufSize)
 
 	// Apply the deadline to the "entire" 4-byte response.
 	if c.PauseTimeout != 0 {
 		err := conn.SetReadDeadline(time.Now().Add(c.PauseTimeout))
 		if err != nil {
-			return nil, err // deemed critical
+			return nil, ack, err // deemed critical
 		}
 		defer conn.SetReadDeadline(time.Time{})
 	}
 
+	if c.ProtocolLevel == 5 {
+		err = c.readCONNACK5(r, &ack)
+		if err != nil {
+			return nil, ack, err
+		}
+		return r, ack, nil
+	}
+
 	// “The first packet sent from the Server to the Client MUST be a
 	// CONNACK Packet.”
 	// — MQTT Version 3.1.1, conformance statement MQTT-3.2.0-1
@@ -938,19 +1375,138 @@ func (c *Client) handshake(conn net.Conn, requestPacket []byte) (*bufio.Reader,
 	case c.dialCtx.Err() != nil:
 		err = ErrClosed
 	case len(packet) > 1 && (packet[0] != typeCONNACK<<4 || packet[1] != 2):
-		return nil, fmt.Errorf("%w: want fixed CONNACK header 0x2002, got %#x", errProtoReset, packet)
+		return nil, ack, fmt.Errorf("%w: want fixed CONNACK header 0x2002, got %#x", errProtoReset, packet)
 	case len(packet) > 3 && connectReturn(packet[3]) != accepted:
-		return nil, connectReturn(packet[3])
+		return nil, ack, connectReturn(packet[3])
+	case c.ProtocolLevel == 3 && err == nil:
+		// MQTT 3.1 has no session present flag. The byte is reserved.
+		r.Discard(len(packet)) // no errors guaranteed
+		ack.sessionPresent = !c.CleanSession
+		return r, ack, nil
+	case len(packet) > 2 && packet[2]&^1 != 0:
+		return nil, ack, fmt.Errorf("%w: CONNACK with reserved acknowledge flags %#b", errProtoReset, packet[2])
+	case len(packet) > 2 && packet[2] != 0 && c.CleanSession:
+		// “If the Server accepts a connection with CleanSession set
+		// to 1, the Server MUST set Session Present to 0 in the
+		// CONNACK packet in addition to setting a zero return code in
+		// the CONNACK packet.”
+		// — MQTT Version 3.1.1, conformance statement MQTT-3.2.2-1
+		return nil, ack, fmt.Errorf("%w: CONNACK with session present on clean session", errProtoReset)
 	case err == nil:
 		r.Discard(len(packet)) // no errors guaranteed
-		return r, nil
+		ack.sessionPresent = packet[2] != 0
+		return r, ack, nil
 	case errors.Is(err, io.EOF): // doesn't match io.ErrUnexpectedEOF
 		err = errBrokerTerm
 	}
 	if len(packet) != 4 {
 		err = fmt.Errorf("%w; CONNECT not confirmed", err)
 	}
-	return nil, err
+	return nil, ack, err
+}
+
+// ReadCONNACK5 applies the MQTT 5.0 response, which has a variable size.
+func (c *Client) readCONNACK5(r *bufio.Reader, ack *connAck) error {
+	// fixed header, acknowledge flags, reason code and property length
+	const sizeMin = 5
+
+	var headerSize int
+	packet, err := r.Peek(sizeMin)
+	if err == nil {
+		if packet[0] != typeCONNACK<<4 {
+			return fmt.Errorf("%w: want CONNACK header, got %#x", errProtoReset, packet)
+		}
+		size, n, varintErr := decodeVarint(packet[1:])
+		if varintErr != nil {
+			return fmt.Errorf("%w: CONNACK remaining length %s", errProtoReset, varintErr)
+		}
+		headerSize = 1 + n
+		packet, err = r.Peek(headerSize + size)
+		if err == nil {
+			packet = packet[headerSize:]
+		}
+	}
+	switch {
+	case c.dialCtx.Err() != nil:
+		return ErrClosed
+	case errors.Is(err, io.EOF): // doesn't match io.ErrUnexpectedEOF
+		return fmt.Errorf("%w; CONNECT not confirmed", errBrokerTerm)
+	case err != nil:
+		return fmt.Errorf("%w; CONNECT not confirmed", err)
+	case len(packet) < 3:
+		return fmt.Errorf("%w: CONNACK with %d byte remaining length", errProtoReset, len(packet))
+	}
+
+	switch code := ReasonCode(packet[1]); {
+	case code == 0:
+		break
+	case code < 0x80:
+		return fmt.Errorf("%w: CONNACK with reason code %#02x", errProtoReset, byte(code))
+	// map to the MQTT 3.1.1 equivalents, if any
+	case code == 0x84:
+		return ErrProtocolLevel
+	case code == 0x85:
+		return ErrClientID
+	case code == 0x86:
+		return ErrAuthBad
+	case code == 0x87:
+		return ErrAuth
+	case code == 0x88:
+		return ErrUnavailable
+	default:
+		return connectReturn(code)
+	}
+	switch {
+	case packet[0]&^1 != 0:
+		return fmt.Errorf("%w: CONNACK with reserved acknowledge flags %#b", errProtoReset, packet[0])
+	case packet[0] != 0 && c.CleanSession:
+		// “If the Server accepts a connection with Clean Start set to
+		// 1, the Server MUST set Session Present to 0 in the CONNACK
+		// packet in addition to setting a 0x00 (Success) Reason Code
+		// in the CONNACK packet.”
+		// — MQTT Version 5.0, conformance statement MQTT-3.2.2-2
+		return fmt.Errorf("%w: CONNACK with session present on clean session", errProtoReset)
+	}
+	ack.sessionPresent = packet[0] != 0
+
+	props, remaining, err := sliceProperties(packet[2:])
+	if err != nil {
+		return err
+	}
+	if len(remaining) != 0 {
+		return fmt.Errorf("%w: CONNACK with %d bytes after the properties", errProtoReset, len(remaining))
+	}
+	err = walkProperties(props, func(id byte, value []byte) error {
+		switch id {
+		case propServerKeepAlive:
+			// “If the Server sends a Server Keep Alive on the
+			// CONNACK packet, the Client MUST use this value
+			// instead of the Keep Alive value the Client sent
+			// on CONNECT.”
+			// — MQTT Version 5.0, conformance statement MQTT-3.1.2-21
+			ack.keepAlive = binary.BigEndian.Uint16(value)
+		case propAssignedClientID:
+			ack.assignedClientID = append([]byte{}, value...)
+		case propReceiveMax:
+			// “The Client uses this value to limit the number
+			// of QoS 1 and QoS 2 publications that it is willing
+			// to process concurrently.”
+			// — MQTT Version 5.0, section 3.2.2.3.3
+			ack.receiveMax = binary.BigEndian.Uint16(value)
+		case propMaxPacketSize:
+			// “The Client MUST NOT send packets exceeding Maximum
+			// Packet Size to the Server.”
+			// — MQTT Version 5.0, conformance statement MQTT-3.2.2-15
+			ack.packetSizeMax = binary.BigEndian.Uint32(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.Discard(headerSize + len(packet)) // no errors guaranteed
+	return nil
 }
 
 // ReadSlices should be invoked consecutively from a single goroutine until
@@ -959,14 +1515,17 @@ func (c *Client) handshake(conn net.Conn, requestPacket []byte) (*bufio.Reader,
 // Both message and topic are slices from a read buffer. The bytes stop being
 // valid at the next read.
 //
-// Each invocation acknowledges ownership of the previously returned if any.
-// Alternatively, use either Disconnect or Close to prevent a confirmation from
+// The ack function enqueues the confirmation of reception, which is send on the
+// next ReadSlices. Use either Disconnect or Close to prevent a confirmation from
 // being send.
 //
-// BigMessage leaves the memory allocation choice to the consumer. Any other
-// error puts the Client in an ErrDown state. Invocation should apply a backoff
-// once down. Retries on IsConnectionRefused, if any, should probably apply a
-// rather large backoff. See the Client example for a complete setup.
+// MQTT 5.0 properties of the message are available with ReadProperties.
+//
+// BigMessage leaves the memory allocation choice to the consumer. ErrSessionLost
+// is informational only. Any other error puts the Client in an ErrDown state.
+// Invocation should apply a backoff once down, unless Config has a Backoff in
+// place. Retries on IsConnectionRefused, if any, should probably apply a rather
+// large backoff. See the Client example for a complete setup.
 func (c *Client) ReadSlices() (message, topic []byte, ack func(), err error) {
 	message, topic, ack, err = c.readSlices()
 	switch {
@@ -979,20 +1538,22 @@ func (c *Client) ReadSlices() (message, topic []byte, ack func(), err error) {
 }
 
 func (c *Client) readSlices() (message, topic []byte, ack func(), err error) {
+	c.messageProps = nil
+
 	// A pending BigMessage implies that the connection was functional on
 	// the last return.
-	ack = nil
 	switch {
 	case c.bigMessage != nil:
 		<-c.Online() // extra verification
-		_, err = c.r.Discard(c.bigMessage.Size)
+		_, err = c.r.Discard(c.bigMessage.Size - c.bigMessage.readN)
+		c.bigMessage = nil // skipped
 		if err != nil {
 			c.toOffline()
 			return nil, nil, nil, err
 		}
 
 	case c.readConn == nil:
-		if err := c.connect(); err != nil {
+		if err := c.connectWithBackoff(); err != nil {
 			return nil, nil, nil, err
 		}
 		<-c.Online() // extra verification
@@ -1034,8 +1595,10 @@ func (c *Client) readSlices() (message, topic []byte, ack func(), err error) {
 		case errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe):
 			// got interrupted
 			c.toOffline()
-			if err := c.connect(); err != nil {
-				c.readConn = nil
+			if err := c.connectWithBackoff(); err != nil {
+				if err != ErrSessionLost {
+					c.readConn = nil
+				}
 				return nil, nil, nil, err
 			}
 
@@ -1054,6 +1617,9 @@ func (c *Client) readSlices() (message, topic []byte, ack func(), err error) {
 					return nil, nil, nil, err
 				}
 				c.bigMessage.Topic = string(topic) // copy
+				if len(c.messageProps) != 0 {
+					c.messageProps = append([]byte{}, c.messageProps...)
+				}
 				done := readBufSize - len(message)
 				c.bigMessage.Size -= done
 				c.r.Discard(done) // no errors guaranteed
@@ -1102,7 +1668,7 @@ func (c *Client) readSlices() (message, topic []byte, ack func(), err error) {
 		case typePINGRESP:
 			err = c.onPINGRESP()
 		case typeDISCONNECT:
-			err = errGotDISCONNECT
+			err = c.onDISCONNECT()
 		case typeRESERVED15:
 			err = errRESERVED15
 		}
@@ -1116,13 +1682,16 @@ func (c *Client) readSlices() (message, topic []byte, ack func(), err error) {
 	}
 }
 
-// BigMessage signals reception beyond the read buffer capacity.
-// Receivers may or may not allocate the memory with ReadAll.
-// The next ReadSlices will acknowledge reception either way.
+// BigMessage signals reception beyond the read buffer capacity. Receivers may
+// or may not allocate the memory with ReadAll. Read streams the payload as an
+// alternative. The next ReadSlices will acknowledge reception either way, and
+// it discards anything left unread.
 type BigMessage struct {
 	*Client        // source
 	Topic   string // destinition
 	Size    int    // byte count
+
+	readN int // number of bytes consumed
 }
 
 // Error implements the standard error interface.
@@ -1130,24 +1699,75 @@ func (e *BigMessage) Error() string {
 	return fmt.Sprintf("mqtt: %d B message exceeds read buffer capacity", e.Size)
 }
 
+var errBigMessageExpired = errors.New("mqtt: read window expired for a big message")
+
 // ReadAll returns the message in a new/dedicated buffer. Messages can be read
 // only once, after reception (from ReadSlices), and before the next ReadSlices.
-// The invocation must occur from within the same routine.
+// The invocation must occur from within the same routine. Any bytes consumed
+// with Read before are not included.
 func (e *BigMessage) ReadAll() ([]byte, error) {
 	if e.bigMessage != e {
-		return nil, errors.New("mqtt: read window expired for a big message")
+		return nil, errBigMessageExpired
 	}
-	e.bigMessage = nil
 
-	message := make([]byte, e.Size)
-	_, err := io.ReadFull(e.Client.r, message)
+	message := make([]byte, e.Size-e.readN)
+	_, err := io.ReadFull(e, message)
 	if err != nil {
-		e.Client.toOffline()
 		return nil, err
 	}
+	e.bigMessage = nil // read once
 	return message, nil
 }
 
+// Read implements the io.Reader interface. Messages can be read only after
+// reception (from ReadSlices), and before the next ReadSlices. The invocation
+// must occur from within the same routine. Each Read is subject to PauseTimeout.
+// Errors other than io.EOF are fatal to the connection.
+func (e *BigMessage) Read(p []byte) (n int, err error) {
+	if e.bigMessage != e {
+		return 0, errBigMessageExpired
+	}
+	remaining := e.Size - e.readN
+	if remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > remaining {
+		p = p[:remaining]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if conn := e.readConn; e.r.Buffered() == 0 && e.PauseTimeout != 0 {
+		err := conn.SetReadDeadline(time.Now().Add(e.PauseTimeout))
+		if err != nil {
+			e.bigMessage = nil
+			e.toOffline()
+			return 0, err // deemed critical
+		}
+		// Abandon timer to prevent waking up the system for no good reason.
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	n, err = e.r.Read(p)
+	e.readN += n
+	if err != nil {
+		// Allow deadline expiry if at least one byte was transferred.
+		var ne net.Error
+		if n != 0 && errors.As(err, &ne) && ne.Timeout() {
+			return n, nil
+		}
+
+		e.bigMessage = nil
+		e.toOffline()
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, fmt.Errorf("mqtt: got %d out of %d bytes from big message: %w", e.readN, e.Size, err)
+	}
+	return n, nil
+}
+
 var errDupe = errors.New("mqtt: duplicate reception")
 
 // OnPUBLISH slices an inbound message from Client.peek.
@@ -1161,35 +1781,47 @@ func (c *Client) onPUBLISH(head byte) (message, topic []byte, ack func(), err er
 	}
 	topic = c.peek[2:i]
 
+	var packetID uint
 	switch head & 0b0110 {
 	case atMostOnceLevel << 1:
 		break
-
-	case atLeastOnceLevel << 1:
+	case atLeastOnceLevel << 1, exactlyOnceLevel << 1:
 		if len(c.peek) < i+2 {
 			return nil, nil, nil, fmt.Errorf("%w: PUBLISH packet identifier exceeds remaining length", errProtoReset)
 		}
-		packetID := binary.BigEndian.Uint16(c.peek[i:])
+		packetID = uint(binary.BigEndian.Uint16(c.peek[i:]))
 		if packetID == 0 {
 			return nil, nil, nil, errPacketIDZero
 		}
 		i += 2
+	default:
+		return nil, nil, nil, fmt.Errorf("%w: PUBLISH with reserved quality-of-service level 3", errProtoReset)
+	}
+
+	if c.ProtocolLevel == 5 {
+		props, remaining, err := sliceProperties(c.peek[i:])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		i = len(c.peek) - len(remaining)
+		topic, err = c.applyTopicAlias(topic, props)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		c.messageProps = props
+	}
+
+	switch head & 0b0110 {
+	case atMostOnceLevel << 1:
+		ack = func() {} // no confirmation
 
+	case atLeastOnceLevel << 1:
 		// enqueue for next call
 		ack = func() {
 			c.pendingAck = append(c.pendingAck, typePUBACK<<4, 2, byte(packetID>>8), byte(packetID))
 		}
 
 	case exactlyOnceLevel << 1:
-		if len(c.peek) < i+2 {
-			return nil, nil, nil, fmt.Errorf("%w: PUBLISH packet identifier exceeds remaining length", errProtoReset)
-		}
-		packetID := uint(binary.BigEndian.Uint16(c.peek[i:]))
-		if packetID == 0 {
-			return nil, nil, nil, errPacketIDZero
-		}
-		i += 2
-
 		bytes, err := c.persistence.Load(packetID | remoteIDKeyFlag)
 		if err != nil {
 			return nil, nil, nil, err
@@ -1202,25 +1834,57 @@ func (c *Client) onPUBLISH(head byte) (message, topic []byte, ack func(), err er
 		ack = func() {
 			c.pendingAck = append(c.pendingAck, typePUBREC<<4, 2, byte(packetID>>8), byte(packetID))
 		}
-
-	default:
-		return nil, nil, nil, fmt.Errorf("%w: PUBLISH with reserved quality-of-service level 3", errProtoReset)
 	}
 
 	return c.peek[i:], topic, ack, nil
 }
 
+// ApplyTopicAlias resolves the topic name with the properties of a PUBLISH.
+func (c *Client) applyTopicAlias(topic, props []byte) ([]byte, error) {
+	alias := -1 // absent
+	err := walkProperties(props, func(id byte, value []byte) error {
+		if id == propTopicAlias {
+			alias = int(binary.BigEndian.Uint16(value))
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case alias < 0:
+		if len(topic) == 0 {
+			return nil, fmt.Errorf("%w: PUBLISH without topic name nor topic alias", errProtoReset)
+		}
+		return topic, nil
+	case alias == 0:
+		// “A sender MUST NOT send a PUBLISH packet containing a Topic
+		// Alias which has the value 0.”
+		// — MQTT Version 5.0, conformance statement MQTT-3.3.2-8
+		return nil, fmt.Errorf("%w: PUBLISH with topic alias 0", errProtoReset)
+	case alias >= len(c.topicAliases):
+		return nil, fmt.Errorf("%w: PUBLISH topic alias %d exceeds maximum %d", errProtoReset, alias, c.TopicAliasMax)
+	case len(topic) != 0:
+		c.topicAliases[alias] = append(c.topicAliases[alias][:0], topic...)
+		return topic, nil
+	case c.topicAliases[alias] == nil:
+		return nil, fmt.Errorf("%w: PUBLISH topic alias %d not established", errProtoReset, alias)
+	default:
+		return c.topicAliases[alias], nil
+	}
+}
+
 // OnPUBREL applies the second round-trip for “exactly-once” reception.
 func (c *Client) onPUBREL() error {
-	if len(c.peek) != 2 {
-		return fmt.Errorf("%w: PUBREL with %d byte remaining length", errProtoReset, len(c.peek))
+	// Reason codes are irrelevant, as the PUBCOMP response is mandatory.
+	packetID, _, err := c.peekAck("PUBREL")
+	if err != nil {
+		return err
 	}
-	packetID := uint(binary.BigEndian.Uint16(c.peek))
 	if packetID == 0 {
 		return errPacketIDZero
 	}
 
-	err := c.persistence.Delete(packetID | remoteIDKeyFlag)
+	err = c.persistence.Delete(packetID | remoteIDKeyFlag)
 	if err != nil {
 		return err // causes resubmission of PUBREL
 	}
@@ -1233,3 +1897,15 @@ func (c *Client) onPUBREL() error {
 	c.pendingAck = c.pendingAck[:0]
 	return nil
 }
+
+// OnDISCONNECT applies a termination by the broker, which MQTT 5.0 permits.
+func (c *Client) onDISCONNECT() error {
+	if c.ProtocolLevel != 5 {
+		return errGotDISCONNECT
+	}
+	var code ReasonCode // absent means normal disconnection
+	if len(c.peek) != 0 {
+		code = ReasonCode(c.peek[0])
+	}
+	return fmt.Errorf("mqtt: broker disconnected the client: %w", code)
+}
@@ -38,7 +38,7 @@ func testClient(t *testing.T, client *mqtt.Client, want ...mqtttest.Transfer) {
 
 		const readSlicesMax = 10
 		for n := 0; n < readSlicesMax; n++ {
-			message, topic, err := client.ReadSlices()
+			message, topic, ack, err := client.ReadSlices()
 			if big := (*mqtt.BigMessage)(nil); errors.As(err, &big) {
 				t.Log("ReadSlices got BigMessage")
 				topic = []byte(big.Topic)
@@ -68,6 +68,9 @@ func testClient(t *testing.T, client *mqtt.Client, want ...mqtttest.Transfer) {
 			case !bytes.Equal(message, want[0].Message), string(topic) != want[0].Topic:
 				t.Errorf("got message %#x @ %q, want %#x @ %q", message, topic, want[0].Message, want[0].Topic)
 			}
+			if ack != nil {
+				ack()
+			}
 
 			if len(want) != 0 {
 				want = want[1:] // move to next in line
@@ -208,7 +211,7 @@ func TestClose(t *testing.T) {
 	}
 	wg.Wait()
 
-	_, _, err = client.ReadSlices()
+	_, _, _, err = client.ReadSlices()
 	if !errors.Is(err, mqtt.ErrClosed) {
 		t.Fatalf("ReadSlices got error %q, want an ErrClosed", err)
 	}
@@ -255,7 +258,7 @@ func TestClose(t *testing.T) {
 		if !errors.Is(err, mqtt.ErrClosed) {
 			t.Errorf("Disconnect round %d got error %q, want an ErrClosed", roundN, err)
 		}
-		_, _, err = client.ReadSlices()
+		_, _, _, err = client.ReadSlices()
 		if !errors.Is(err, mqtt.ErrClosed) {
 			t.Fatalf("ReadSlices round %d got error %q, want an ErrClosed", roundN, err)
 		}
@@ -275,6 +278,70 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestDisconnectDrain(t *testing.T) {
+	client, conn := newClientPipe(t)
+	draining := make(chan struct{})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x32, 6,
+			0, 1, 'x',
+			0x80, 0x00, // packet identifier
+			'1'}))
+		<-draining
+		sendPacketHex(t, conn, "40028000") // PUBACK
+		wantPacketHex(t, conn, "e000")     // DISCONNECT
+	})
+
+	ack, err := client.PublishAtLeastOnce([]byte{'1'}, "x")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	disconnectDone := testRoutine(t, func() {
+		n, err := client.DisconnectDrain(nil)
+		if n != 0 || err != nil {
+			t.Errorf("DisconnectDrain got (%d, %v), want (0, nil)", n, err)
+		}
+	})
+	time.Sleep(time.Second / 32)
+	if err := client.Publish(nil, []byte{'2'}, "x"); !errors.Is(err, mqtt.ErrClosed) {
+		t.Errorf("publish while draining got error %v, want mqtt.ErrClosed", err)
+	}
+	if err := client.PublishFrom(nil, strings.NewReader("2"), 1, "x"); !errors.Is(err, mqtt.ErrClosed) {
+		t.Errorf("publish from reader while draining got error %v, want mqtt.ErrClosed", err)
+	}
+	if _, err := client.PublishAtLeastOnce([]byte{'2'}, "x"); !errors.Is(err, mqtt.ErrClosed) {
+		t.Errorf("publish at least once while draining got error %v, want mqtt.ErrClosed", err)
+	}
+	close(draining)
+	testAck(t, ack)
+	<-disconnectDone
+	<-brokerMockDone
+}
+
+func TestDisconnectDrainQuit(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x32, 6,
+			0, 1, 'x',
+			0x80, 0x00, // packet identifier
+			'1'}))
+		// leave without PUBACK
+		wantPacketHex(t, conn, "e000") // DISCONNECT
+	})
+
+	if _, err := client.PublishAtLeastOnce([]byte{'1'}, "x"); err != nil {
+		t.Fatal("publish error:", err)
+	}
+	defer func() { <-brokerMockDone }()
+	quit := make(chan struct{})
+	time.AfterFunc(time.Second/16, func() { close(quit) })
+	n, err := client.DisconnectDrain(quit)
+	if n != 1 || !errors.Is(err, mqtt.ErrCanceled) {
+		t.Errorf("DisconnectDrain got (%d, %v), want (1, mqtt.ErrCanceled)", n, err)
+	}
+}
+
 func TestDown(t *testing.T) {
 	brokerEnd, clientEnd := net.Pipe()
 
@@ -300,7 +367,7 @@ func TestDown(t *testing.T) {
 		sendPacketHex(t, brokerEnd, "20020003")
 	})
 
-	message, topic, err := client.ReadSlices()
+	message, topic, _, err := client.ReadSlices()
 	if !errors.Is(err, mqtt.ErrUnavailable) {
 		t.Fatalf("ReadSlices got (%q, %q, %q), want an ErrUnavailable", message, topic, err)
 	}
@@ -494,3 +561,407 @@ func typeLabelFromHex(char byte) string {
 		panic("not a hex character")
 	}
 }
+
+func TestKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		KeepAlive:    1,
+		Dialer:       newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+
+	wantPacketHex(t, brokerConn, "100c00044d515454040000010000") // CONNECT
+	sendPacketHex(t, brokerConn, "20020000")                     // CONNACK
+	wantPacketHex(t, brokerConn, "c000")                         // PINGREQ
+	sendPacketHex(t, brokerConn, "d000")                         // PINGRESP
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	t.Parallel()
+
+	clientConn1, brokerConn1 := net.Pipe()
+	clientConn2, brokerConn2 := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		KeepAlive:    1,
+		Dialer:       newTestDialer(t, clientConn1, clientConn2),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	readRoutineDone := testRoutine(t, func() {
+		for {
+			_, _, _, err := client.ReadSlices()
+			if errors.Is(err, mqtt.ErrClosed) {
+				return
+			}
+		}
+	})
+	defer func() {
+		if err := client.Close(); err != nil {
+			t.Error("close error:", err)
+		}
+		<-readRoutineDone
+	}()
+
+	wantPacketHex(t, brokerConn1, "100c00044d515454040000010000") // CONNECT
+	sendPacketHex(t, brokerConn1, "20020000")                     // CONNACK
+	wantPacketHex(t, brokerConn1, "c000")                         // PINGREQ
+	// no PINGRESP causes a connection close within the interval
+	brokerConn1.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf [1]byte
+	if n, err := brokerConn1.Read(buf[:]); err != io.EOF {
+		t.Fatalf("broker read got (%d, %q), want io.EOF", n, err)
+	}
+
+	wantPacketHex(t, brokerConn2, "100c00044d515454040000010000") // CONNECT
+	sendPacketHex(t, brokerConn2, "20020100")                     // CONNACK
+}
+
+func TestSessionLost(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF}, mqtttest.Transfer{Err: mqtt.ErrSessionLost})
+	if client.SessionPresent() {
+		t.Error("session present on initial connect")
+	}
+
+	if err := conns[0].Close(); err != nil {
+		t.Fatal("broker got error on first connection close:", err)
+	}
+	wantPacketHex(t, conns[1], pipeCONNECTHex)
+	sendPacketHex(t, conns[1], "20020000") // CONNACK without session present
+
+	// connection remains functional
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conns[1], "c000") // PINGREQ
+		sendPacketHex(t, conns[1], "d000") // PINGRESP
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Errorf("ping got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	if client.SessionPresent() {
+		t.Error("session present after CONNACK without")
+	}
+}
+
+func TestSessionPresent(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF})
+
+	if err := conns[0].Close(); err != nil {
+		t.Fatal("broker got error on first connection close:", err)
+	}
+	wantPacketHex(t, conns[1], pipeCONNECTHex)
+	sendPacketHex(t, conns[1], "20020100") // CONNACK with session present
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conns[1], "c000") // PINGREQ
+		sendPacketHex(t, conns[1], "d000") // PINGRESP
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Errorf("ping got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	if !client.SessionPresent() {
+		t.Error("no session present after CONNACK with")
+	}
+}
+
+func TestBigMessageRead(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	message := make([]byte, 200_000)
+	for i := range message {
+		message[i] = byte(i % 251)
+	}
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, pipeCONNECTHex)
+		sendPacketHex(t, brokerConn, "20020000") // CONNACK
+		for _, topic := range []string{"partial", "full"} {
+			if _, err := brokerConn.Write(bigPublishPacket(topic, message)); err != nil {
+				t.Error("broker write error:", err)
+				return
+			}
+		}
+		sendPacketHex(t, brokerConn, "300400017a34") // "z": "4"
+		// stall half way
+		packet := bigPublishPacket("stall", message)
+		if _, err := brokerConn.Write(packet[:len(packet)/2]); err != nil {
+			t.Error("broker write error:", err)
+		}
+	})
+
+	var big *mqtt.BigMessage
+	_, _, _, err = client.ReadSlices()
+	if !errors.As(err, &big) || big.Topic != "partial" || big.Size != len(message) {
+		t.Fatalf("ReadSlices got error %v, want BigMessage with topic partial and size %d", err, len(message))
+	}
+	buf := make([]byte, 1000)
+	if _, err := io.ReadFull(big, buf); err != nil {
+		t.Fatal("read error:", err)
+	}
+	if !bytes.Equal(buf, message[:len(buf)]) {
+		t.Error("read got wrong message start")
+	}
+
+	// remainder of partial read discarded
+	_, _, _, err = client.ReadSlices()
+	if !errors.As(err, &big) || big.Topic != "full" {
+		t.Fatalf("ReadSlices got error %v, want BigMessage with topic full", err)
+	}
+	var got bytes.Buffer
+	if _, err := io.Copy(&got, big); err != nil {
+		t.Fatal("copy error:", err)
+	}
+	if !bytes.Equal(got.Bytes(), message) {
+		t.Errorf("copy got %d bytes, want %d bytes of message", got.Len(), len(message))
+	}
+
+	m, topic, _, err := client.ReadSlices()
+	if err != nil || string(m) != "4" || string(topic) != "z" {
+		t.Fatalf("ReadSlices got %q @ %q with error %v, want message 4 @ z", m, topic, err)
+	}
+	if _, err := big.Read(buf); err == nil {
+		t.Error("read after ReadSlices got no error")
+	}
+
+	_, _, _, err = client.ReadSlices()
+	if !errors.As(err, &big) || big.Topic != "stall" {
+		t.Fatalf("ReadSlices got error %v, want BigMessage with topic stall", err)
+	}
+	_, err = io.Copy(io.Discard, big)
+	var e net.Error
+	if !errors.As(err, &e) || !e.Timeout() {
+		t.Errorf("copy got error %v, want a Timeout net.Error", err)
+	}
+	<-brokerMockDone
+}
+
+// PipeCONNECT5Hex is the initial packet from a Client with ProtocolLevel 5 and
+// TopicAliasMax 2.
+const pipeCONNECT5Hex = "101500044d515454050000000811ffffffff2200020000"
+
+// NewClientPipe5 is like newClientPipe, yet with ProtocolLevel 5.
+func newClientPipe5(t *testing.T, want ...mqtttest.Transfer) (*mqtt.Client, net.Conn) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		AtLeastOnceMax: 2,
+		ExactlyOnceMax: 2,
+		ProtocolLevel:  5,
+		TopicAliasMax:  2,
+		Dialer:         newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+
+	testClient(t, client, want...)
+
+	wantPacketHex(t, brokerConn, pipeCONNECT5Hex)
+	sendPacketHex(t, brokerConn, "2003000000") // CONNACK
+	return client, brokerConn
+}
+
+func TestReceiveProperties(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:  time.Second / 4,
+		ProtocolLevel: 5,
+		TopicAliasMax: 2,
+		Dialer:        newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, pipeCONNECT5Hex)
+		// CONNACK with a Server Keep Alive of 0 seconds
+		sendPacketHex(t, brokerConn, "2006000003130000")
+		// PUBLISH with topic alias 1 and user property "k": "v"
+		sendPacketHex(t, brokerConn, "30120003612f620a2300012600016b0001766869")
+		// PUBLISH on topic alias 1
+		sendPacketHex(t, brokerConn, "3008000003230001796f")
+		// DISCONNECT with Server shutting down
+		sendPacketHex(t, brokerConn, "e0018b")
+	})
+
+	message, topic, _, err := client.ReadSlices()
+	if err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	if string(message) != "hi" || string(topic) != "a/b" {
+		t.Errorf("got message %q @ %q, want \"hi\" @ \"a/b\"", message, topic)
+	}
+	p := client.ReadProperties()
+	if p == nil || len(p.UserProperties) != 1 || p.UserProperties[0] != (mqtt.UserProperty{Key: "k", Value: "v"}) {
+		t.Errorf("got properties %+v, want user property k=v only", p)
+	}
+
+	message, topic, _, err = client.ReadSlices()
+	if err != nil {
+		t.Fatal("ReadSlices error:", err)
+	}
+	if string(message) != "yo" || string(topic) != "a/b" {
+		t.Errorf("got message %q @ %q, want \"yo\" @ \"a/b\"", message, topic)
+	}
+	if p := client.ReadProperties(); p == nil || len(p.UserProperties) != 0 {
+		t.Errorf("got properties %+v, want topic alias only", p)
+	}
+
+	_, _, _, err = client.ReadSlices()
+	if code := mqtt.ReasonCode(0); !errors.As(err, &code) || code != 0x8b {
+		t.Errorf("got error %q after DISCONNECT, want reason code 0x8b", err)
+	}
+	<-brokerMockDone
+}
+
+func TestBrokerLimits5(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		AtLeastOnceMax: 2,
+		ExactlyOnceMax: 2,
+		ProtocolLevel:  5,
+		TopicAliasMax:  2,
+		Dialer:         newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+
+	wantPacketHex(t, brokerConn, pipeCONNECT5Hex)
+	// CONNACK with a Receive Maximum of 1 and a Maximum Packet Size of 16
+	sendPacketHex(t, brokerConn, "200b0000082100012700000010")
+	<-client.Online()
+
+	err = client.Publish(nil, []byte("0123456789ab"), "x")
+	if !mqtt.IsDeny(err) {
+		t.Errorf("got error %q [%T] for PUBLISH beyond Maximum Packet Size, want a deny", err, err)
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "32070001788000006d")
+		sendPacketHex(t, brokerConn, "40028000") // PUBACK
+	})
+	exchange, err := client.PublishAtLeastOnce([]byte("m"), "x")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	_, err = client.PublishExactlyOnce([]byte("m"), "x")
+	if !errors.Is(err, mqtt.ErrMax) {
+		t.Errorf("got error %q [%T] for PUBLISH beyond Receive Maximum, want a mqtt.ErrMax", err, err)
+	}
+	testAck(t, exchange)
+	<-brokerMockDone
+}
+
+func TestConnectRefused5(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:  time.Second / 4,
+		ProtocolLevel: 5,
+		TopicAliasMax: 2,
+		Dialer:        newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, pipeCONNECT5Hex)
+		sendPacketHex(t, brokerConn, "2003008a00") // CONNACK with Banned
+	})
+	_, _, _, err = client.ReadSlices()
+	if !mqtt.IsConnectionRefused(err) {
+		t.Errorf("got error %q, want an mqtt.IsConnectionRefused", err)
+	}
+	<-brokerMockDone
+}
+
+func TestProtocolLevel3(t *testing.T) {
+	t.Parallel()
+
+	_, err := mqtt.VolatileSession("123456789012345678901234", &mqtt.Config{
+		ProtocolLevel: 3,
+		Dialer:        newTestDialer(t),
+	})
+	if err == nil {
+		t.Error("client identifier of 24 bytes got no error")
+	}
+
+	dir := t.TempDir()
+	initClient, err := mqtt.InitSession("123456789012345678901234", mqtt.FileSystem(dir), &mqtt.Config{
+		Dialer: newTestDialer(t),
+	})
+	if err != nil {
+		t.Fatal("InitSession error:", err)
+	}
+	if err := initClient.Close(); err != nil {
+		t.Fatal("Close error:", err)
+	}
+	_, _, err = mqtt.AdoptSession(mqtt.FileSystem(dir), &mqtt.Config{
+		ProtocolLevel: 3,
+		Dialer:        newTestDialer(t),
+	})
+	if err == nil {
+		t.Error("adopted client identifier of 24 bytes got no error")
+	}
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("x", &mqtt.Config{
+		PauseTimeout:  time.Second / 4,
+		ProtocolLevel: 3,
+		Dialer:        newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	readRoutineDone := testRoutine(t, func() {
+		_, _, _, err := client.ReadSlices()
+		if err == nil || !strings.Contains(err.Error(), "SUBACK with illegal return code 0x80") {
+			t.Errorf("ReadSlices got error %v, want SUBACK return code 0x80 illegal", err)
+		}
+	})
+	wantPacketHex(t, brokerConn, "100f00064d514973647003000000000178") // CONNECT
+	sendPacketHex(t, brokerConn, "20020000")                           // CONNACK
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "8206600000016102") // SUBSCRIBE
+		sendPacketHex(t, brokerConn, "9003600080")       // SUBACK with 0x80
+	})
+	err = client.Subscribe(nil, "a")
+	if !errors.Is(err, mqtt.ErrBreak) {
+		t.Errorf("subscribe got error %v, want mqtt.ErrBreak", err)
+	}
+	<-brokerMockDone
+	<-readRoutineDone
+}
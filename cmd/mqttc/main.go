@@ -71,18 +71,10 @@ var (
 
 // Config collects the command arguments.
 func Config() (clientID string, config *mqtt.Config) {
-	var addr string
-	switch args := flag.Args(); {
-	case len(args) == 0:
+	addrs := flag.Args()
+	if len(addrs) == 0 {
 		printManual()
 		os.Exit(2)
-
-	case len(args) == 1:
-		addr = args[0]
-
-	default:
-		log.Printf("%s: multiple address arguments %q", name, args)
-		os.Exit(2)
 	}
 
 	var TLS *tls.Config
@@ -158,12 +150,14 @@ func Config() (clientID string, config *mqtt.Config) {
 		}
 	}
 
-	if _, _, err := net.SplitHostPort(addr); err != nil {
-		port := "1883"
-		if TLS != nil {
-			port = "8883"
+	for i, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			port := "1883"
+			if TLS != nil {
+				port = "8883"
+			}
+			addrs[i] = net.JoinHostPort(addr, port)
 		}
-		addr = net.JoinHostPort(addr, port)
 	}
 
 	clientID = *clientFlag
@@ -183,14 +177,27 @@ func Config() (clientID string, config *mqtt.Config) {
 		config.Password = bytes
 	}
 
-	if TLS != nil {
-		config.Dialer = mqtt.NewTLSDialer(*netFlag, addr, TLS)
+	endpoints := make([]mqtt.Endpoint, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i].Name = addr
+		if TLS != nil {
+			endpoints[i].Dialer = mqtt.NewTLSDialer(*netFlag, addr, TLS)
+		} else {
+			endpoints[i].Dialer = mqtt.NewDialer(*netFlag, addr)
+		}
+	}
+	if len(endpoints) == 1 {
+		config.Dialer = endpoints[0].Dialer
 	} else {
-		config.Dialer = mqtt.NewDialer(*netFlag, addr)
+		failover = mqtt.NewFailover(false, endpoints...)
+		config.Dialer = failover.Dial
 	}
 	return
 }
 
+// Failover is set with multiple address arguments only.
+var failover *mqtt.Failover
+
 var exitStatus = make(chan int, 1)
 
 func failMQTT(client *mqtt.Client, err error) {
@@ -227,16 +234,34 @@ func main() {
 
 	// Read routine runs until mqtt.Client Close or Disconnect.
 	var big *mqtt.BigMessage
+	// Each address gets one connect attempt before failure.
+	var errCount int
 	for {
-		message, topic, err := client.ReadSlices()
+		message, topic, ack, err := client.ReadSlices()
 		switch {
 		case err == nil:
+			errCount = 0
 			printMessage(message, topic)
+			ack()
 
 		case errors.Is(err, mqtt.ErrClosed):
 			os.Exit(<-exitStatus)
 
 		case errors.As(err, &big):
+			if !*quoteFlag {
+				// stream without allocation
+				if *topicFlag {
+					fmt.Print(big.Topic)
+				}
+				fmt.Print(*prefixFlag)
+				_, err := io.Copy(os.Stdout, big)
+				fmt.Print(*suffixFlag)
+				if err != nil {
+					failMQTT(client, err)
+				}
+				break
+			}
+
 			message, err := big.ReadAll()
 			if err != nil {
 				failMQTT(client, err)
@@ -245,6 +270,12 @@ func main() {
 			}
 
 		default:
+			if errCount++; failover != nil && errCount < len(flag.Args()) {
+				if *verboseFlag {
+					log.Print(name, ": ", err)
+				}
+				continue
+			}
 			failMQTT(client, err)
 
 			switch {
@@ -277,6 +308,14 @@ func printMessage(message, topic interface{}) {
 }
 
 func execPubSub(client *mqtt.Client) {
+	if failover != nil {
+		// await the rotation for an endpoint
+		<-client.Online()
+		if addr, ok := failover.Active(); ok && *verboseFlag {
+			log.Printf("%s: connected to %s", name, addr)
+		}
+	}
+
 	if *publishFlag != "" {
 		// publish standard input
 		message, err := io.ReadAll(io.LimitReader(os.Stdin, messageMax))
@@ -397,12 +436,15 @@ func printManual() {
 	log.Print(bold + "NAME\n\t" + name + clear + " \u2014 MQTT broker access\n" +
 		"\n" +
 		bold + "SYNOPSIS\n" +
-		"\t" + bold + name + clear + " [options] address\n" +
+		"\t" + bold + name + clear + " [options] address ...\n" +
 		"\n" +
 		bold + "DESCRIPTION" + clear + "\n" +
 		"\tThe command connects to the address argument, with an option to\n" +
 		"\tpublish a message and/or subscribe with topic filters.\n" +
 		"\n" +
+		"\tMultiple address arguments provide failover in order of appearance.\n" +
+		"\tEach address gets one connect attempt before the command fails.\n" +
+		"\n" +
 		"\tWhen the address does not specify a port, then the defaults are\n" +
 		"\tapplied, which is 1883 for plain connections and 8883 for TLS.\n" +
 		"\n" +
@@ -0,0 +1,276 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Coalesce holds PUBLISH packets (without packet identifier) which are pending
+// for a combined write. The entries await their delay without the write lock,
+// such that other writes pass in the mean time. Whoever acquires the write
+// semaphore then submits the queue, in order of appearance.
+type coalesce struct {
+	sync.Mutex
+	queue []*coalesceEntry
+	size  int // byte count of queue
+
+	// The full channel signals when size reached the byte budget.
+	full chan struct{}
+}
+
+type coalesceEntry struct {
+	packet net.Buffers
+	size   int        // byte count of packet
+	since  time.Time  // enqueue moment
+	done   chan error // receives the write result
+
+	// Withdraw sets the error when the entry was claimed already.
+	abandoned error
+}
+
+// WritePublish submits a PUBLISH without packet identifier, with coalescing
+// when enabled by Config.CoalesceMax, and with an offline buffer when enabled
+// by Config.OfflineBufferMax.
+func (c *Client) writePublish(quit <-chan struct{}, packet net.Buffers) error {
+	return c.writePublishFrom(quit, packet, nil, 0)
+}
+
+// WritePublishFrom is like writePublish, yet with size bytes from body as the
+// message. Nil body implies that the packet includes the message. Body is read
+// into memory for coalescing, and for the offline buffer, as both need packets
+// whole.
+func (c *Client) writePublishFrom(quit <-chan struct{}, packet net.Buffers, body io.Reader, size int) error {
+	if c.isDraining() {
+		return fmt.Errorf("%w; PUBLISH unavailable", ErrClosed)
+	}
+	var err error
+	switch {
+	case body != nil && c.CoalesceMax <= 0:
+		err = c.writeFrom(quit, packet, body, size)
+		if err != ErrDown || c.OfflineBufferMax <= 0 {
+			return err
+		}
+		// body not consumed yet
+		packet, err = readMessage(packet, body, size)
+		if err != nil {
+			return err
+		}
+		return c.bufferDown(quit, packet)
+
+	case body != nil:
+		packet, err = readMessage(packet, body, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.CoalesceMax <= 0 {
+		err = c.writeBuffers(quit, packet)
+	} else {
+		err = c.writeCoalesce(quit, packet)
+	}
+	if err == ErrDown && c.OfflineBufferMax > 0 {
+		return c.bufferDown(quit, packet)
+	}
+	return err
+}
+
+// ReadMessage appends size bytes from body to packet.
+func readMessage(packet net.Buffers, body io.Reader, size int) (net.Buffers, error) {
+	message := make([]byte, size)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, fmt.Errorf("mqtt: PUBLISH message unavailable: %w", err)
+	}
+	// The packet may have spare capacity, which is shared with the caller.
+	return append(packet[:len(packet):len(packet)], message), nil
+}
+
+// WriteCoalesce submits a PUBLISH without packet identifier in a combined
+// write.
+func (c *Client) writeCoalesce(quit <-chan struct{}, packet net.Buffers) error {
+	e := &coalesceEntry{
+		packet: packet,
+		since:  time.Now(),
+		done:   make(chan error, 1),
+	}
+	for _, buf := range packet {
+		e.size += len(buf)
+	}
+	c.coalesce.Lock()
+	c.coalesce.queue = append(c.coalesce.queue, e)
+	c.coalesce.size += e.size
+	if c.coalesce.size >= c.CoalesceMax {
+		select {
+		case c.coalesce.full <- struct{}{}:
+		default: // pending signal
+		}
+	}
+	c.coalesce.Unlock()
+
+	for {
+		// The delay passes without the write lock.
+		var delay <-chan time.Time
+		var full <-chan struct{}
+		writeSem := c.writeSem
+		timer := c.coalesce.delayTimer(c.CoalesceMax, c.CoalesceDelay)
+		if timer != nil {
+			delay, full, writeSem = timer.C, c.coalesce.full, nil
+		}
+
+		var err error
+		select {
+		case err = <-e.done:
+			stopTimer(timer)
+			return err
+
+		case <-quit:
+			stopTimer(timer)
+			err = ErrCanceled
+
+		case <-delay:
+			continue
+		case <-full:
+			stopTimer(timer)
+			continue
+
+		case conn, ok := <-writeSem: // locks writes
+			switch {
+			case !ok:
+				err = ErrClosed
+			case conn == nil:
+				c.writeSem <- nil // unlocks writes
+				err = ErrDown
+			default:
+				c.writeCoalesced(conn)
+				continue // entry may or may not be included
+			}
+		}
+
+		if c.coalesce.withdraw(e, err) {
+			return err
+		}
+		// write in progress
+		return <-e.done
+	}
+}
+
+// DelayTimer returns a timer for the remainder of the delay on the queue, if
+// any. The delay ends early when the queue reaches the byte budget.
+func (q *coalesce) delayTimer(budget int, delay time.Duration) *time.Timer {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.queue) == 0 || q.size >= budget {
+		return nil
+	}
+	wait := delay - time.Since(q.queue[0].since)
+	if wait <= 0 {
+		return nil
+	}
+	return time.NewTimer(wait)
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// WriteCoalesced submits the queue, or a part thereof in case of the byte
+// budget. The write semaphore must be held by the conn.
+func (c *Client) writeCoalesced(conn net.Conn) {
+	batch := c.coalesce.claim(c.CoalesceMax)
+	if len(batch) == 0 {
+		c.writeSem <- conn // unlocks writes
+		return
+	}
+	var packets net.Buffers
+	for _, e := range batch {
+		packets = append(packets, e.packet...)
+	}
+
+	err := writeBuffers(conn, packets, c.PauseTimeout)
+	switch {
+	case err == nil:
+		atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+		c.writeSem <- conn // unlocks writes
+
+	case errors.Is(err, net.ErrClosed), errors.Is(err, io.ErrClosedPipe):
+		// got interrupted; read routine will determine next course
+		c.writeBlock <- struct{}{} // parks writes
+		c.coalesce.unclaim(batch)
+		return
+
+	default:
+		conn.Close()               // interrupts read routine
+		c.writeBlock <- struct{}{} // parks writes
+	}
+	for _, e := range batch {
+		e.done <- err
+	}
+}
+
+// Claim takes entries from the queue, up to the byte budget, yet at least one.
+func (q *coalesce) claim(budget int) []*coalesceEntry {
+	q.Lock()
+	defer q.Unlock()
+
+	var n, size int
+	for n < len(q.queue) {
+		if n != 0 && size+q.queue[n].size > budget {
+			break
+		}
+		size += q.queue[n].size
+		n++
+	}
+	batch := make([]*coalesceEntry, n)
+	copy(batch, q.queue)
+	q.queue = append(q.queue[:0], q.queue[n:]...)
+	q.size -= size
+
+	if q.size < budget {
+		select {
+		case <-q.full: // stale signal
+		default:
+		}
+	}
+	return batch
+}
+
+// Unclaim puts entries back in front of the queue, in order of appearance.
+// Entries which got abandoned in the mean time receive their error instead.
+func (q *coalesce) unclaim(batch []*coalesceEntry) {
+	q.Lock()
+	defer q.Unlock()
+	var requeue []*coalesceEntry
+	for _, e := range batch {
+		if e.abandoned != nil {
+			e.done <- e.abandoned
+			continue
+		}
+		requeue = append(requeue, e)
+		q.size += e.size
+	}
+	q.queue = append(requeue, q.queue...)
+}
+
+// Withdraw removes an entry from the queue with an error. The return is false
+// when the entry was claimed already, in which case the error is retained for
+// when the write gets interrupted.
+func (q *coalesce) withdraw(e *coalesceEntry, err error) bool {
+	q.Lock()
+	defer q.Unlock()
+	for i := range q.queue {
+		if q.queue[i] == e {
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			q.size -= e.size
+			return true
+		}
+	}
+	e.abandoned = err
+	return false
+}
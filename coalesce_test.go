@@ -0,0 +1,99 @@
+package mqtt_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+func TestPublishCoalesce(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:  time.Second / 4,
+		Dialer:        newTestDialer(t, clientConn),
+		CoalesceMax:   64,
+		CoalesceDelay: time.Second / 8,
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, pipeCONNECTHex)
+	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "3004000178"+"31") // PUBLISH #1
+		wantPacketHex(t, brokerConn, "3004000178"+"33") // PUBLISH #3
+	})
+
+	done1 := testRoutine(t, func() {
+		if err := client.Publish(nil, []byte{'1'}, "x"); err != nil {
+			t.Error("publish #1 error:", err)
+		}
+	})
+	time.Sleep(time.Second / 64)
+	quit := make(chan struct{})
+	done2 := testRoutine(t, func() {
+		err := client.Publish(quit, []byte{'2'}, "x")
+		if !errors.Is(err, mqtt.ErrCanceled) {
+			t.Errorf("publish #2 got error %v, want mqtt.ErrCanceled", err)
+		}
+	})
+	time.Sleep(time.Second / 64)
+	close(quit)
+	<-done2
+	if err := client.Publish(nil, []byte{'3'}, "x"); err != nil {
+		t.Error("publish #3 error:", err)
+	}
+	<-done1
+	<-brokerMockDone
+}
+
+func TestPublishCoalesceDelay(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		Dialer:         newTestDialer(t, clientConn),
+		AtLeastOnceMax: 1,
+		CoalesceMax:    64,
+		CoalesceDelay:  time.Second,
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, pipeCONNECTHex)
+	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "3206000178800032") // PUBLISH QoS 1
+		sendPacketHex(t, brokerConn, "40028000")         // PUBACK
+		wantPacketHex(t, brokerConn, "3004000178"+"31")  // PUBLISH coalesced
+	})
+
+	coalesceDone := testRoutine(t, func() {
+		if err := client.Publish(nil, []byte{'1'}, "x"); err != nil {
+			t.Error("publish coalesced error:", err)
+		}
+	})
+	time.Sleep(time.Second / 64)
+	// write lock available during the delay
+	start := time.Now()
+	exchange, err := client.PublishAtLeastOnce([]byte{'2'}, "x")
+	if err != nil {
+		t.Fatal("publish error:", err)
+	}
+	if d := time.Since(start); d > time.Second/2 {
+		t.Errorf("publish took %s with a coalesce delay pending", d)
+	}
+	testAck(t, exchange)
+	<-coalesceDone
+	<-brokerMockDone
+}
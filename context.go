@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// ContextError is an ErrCanceled or an ErrAbandoned caused by a Context. Both
+// the request error and the cause match with errors.Is.
+type contextError struct {
+	err   error // ErrCanceled or ErrAbandoned, possibly wrapped
+	cause error // context.Cause
+}
+
+// Error implements the standard error interface.
+func (e *contextError) Error() string {
+	return e.err.Error() + ": " + e.cause.Error()
+}
+
+// Unwrap implements the errors.Unwrap interface.
+func (e *contextError) Unwrap() error { return e.err }
+
+// Is implements the errors.Is interface.
+func (e *contextError) Is(target error) bool {
+	return errors.Is(e.cause, target)
+}
+
+// ContextErr applies the Context cause, if any, to ErrCanceled and ErrAbandoned.
+// Go versions before 1.20 have ctx.Err() as the cause.
+func contextErr(ctx context.Context, err error) error {
+	if err == nil || !(errors.Is(err, ErrCanceled) || errors.Is(err, ErrAbandoned)) {
+		return err
+	}
+	cause := contextCause(ctx)
+	if cause == nil {
+		return err
+	}
+	return &contextError{err: err, cause: cause}
+}
+
+// PingContext is like Ping, but with a Context instead of a quit channel. Both
+// ErrCanceled and ErrAbandoned wrap the context.Cause.
+func (c *Client) PingContext(ctx context.Context) error {
+	return contextErr(ctx, c.Ping(ctx.Done()))
+}
+
+// SubscribeContext is like Subscribe, but with a Context instead of a quit
+// channel. Both ErrCanceled and ErrAbandoned wrap the context.Cause.
+func (c *Client) SubscribeContext(ctx context.Context, topicFilters ...string) error {
+	return contextErr(ctx, c.Subscribe(ctx.Done(), topicFilters...))
+}
+
+// SubscribeLimitAtMostOnceContext is like SubscribeLimitAtMostOnce, but with a
+// Context instead of a quit channel. Both ErrCanceled and ErrAbandoned wrap the
+// context.Cause.
+func (c *Client) SubscribeLimitAtMostOnceContext(ctx context.Context, topicFilters ...string) error {
+	return contextErr(ctx, c.SubscribeLimitAtMostOnce(ctx.Done(), topicFilters...))
+}
+
+// SubscribeLimitAtLeastOnceContext is like SubscribeLimitAtLeastOnce, but with
+// a Context instead of a quit channel. Both ErrCanceled and ErrAbandoned wrap
+// the context.Cause.
+func (c *Client) SubscribeLimitAtLeastOnceContext(ctx context.Context, topicFilters ...string) error {
+	return contextErr(ctx, c.SubscribeLimitAtLeastOnce(ctx.Done(), topicFilters...))
+}
+
+// UnsubscribeContext is like Unsubscribe, but with a Context instead of a quit
+// channel. Both ErrCanceled and ErrAbandoned wrap the context.Cause.
+func (c *Client) UnsubscribeContext(ctx context.Context, topicFilters ...string) error {
+	return contextErr(ctx, c.Unsubscribe(ctx.Done(), topicFilters...))
+}
+
+// PublishContext is like Publish, but with a Context instead of a quit channel.
+// ErrCanceled wraps the context.Cause.
+func (c *Client) PublishContext(ctx context.Context, message []byte, topic string) error {
+	return contextErr(ctx, c.Publish(ctx.Done(), message, topic))
+}
+
+// PublishRetainedContext is like PublishRetained, but with a Context instead of
+// a quit channel. ErrCanceled wraps the context.Cause.
+func (c *Client) PublishRetainedContext(ctx context.Context, message []byte, topic string) error {
+	return contextErr(ctx, c.PublishRetained(ctx.Done(), message, topic))
+}
+
+// PublishWithPropertiesContext is like PublishWithProperties, but with a
+// Context instead of a quit channel. ErrCanceled wraps the
+// context.Cause.
+func (c *Client) PublishWithPropertiesContext(ctx context.Context, message []byte, topic string, p *Properties) error {
+	return contextErr(ctx, c.PublishWithProperties(ctx.Done(), message, topic, p))
+}
+
+// PublishBuffersContext is like PublishBuffers, but with a Context instead of a
+// quit channel. ErrCanceled wraps the context.Cause.
+func (c *Client) PublishBuffersContext(ctx context.Context, message net.Buffers, topic string) error {
+	return contextErr(ctx, c.PublishBuffers(ctx.Done(), message, topic))
+}
+
+// PublishFromContext is like PublishFrom, but with a Context instead of a quit
+// channel. ErrCanceled wraps the context.Cause.
+func (c *Client) PublishFromContext(ctx context.Context, r io.Reader, size int, topic string) error {
+	return contextErr(ctx, c.PublishFrom(ctx.Done(), r, size, topic))
+}
+
+// DisconnectContext is like Disconnect, but with a Context instead of a quit
+// channel. ErrCanceled wraps the context.Cause.
+func (c *Client) DisconnectContext(ctx context.Context) error {
+	return contextErr(ctx, c.Disconnect(ctx.Done()))
+}
@@ -0,0 +1,12 @@
+//go:build !go1.20
+// +build !go1.20
+
+package mqtt
+
+import "context"
+
+// ContextCause returns the error of a Context cancelation, if any. The cause
+// is not available before Go 1.20.
+func contextCause(ctx context.Context) error {
+	return ctx.Err()
+}
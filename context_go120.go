@@ -0,0 +1,11 @@
+//go:build go1.20
+// +build go1.20
+
+package mqtt
+
+import "context"
+
+// ContextCause returns the cause of a Context cancelation, if any.
+func contextCause(ctx context.Context) error {
+	return context.Cause(ctx)
+}
@@ -0,0 +1,31 @@
+//go:build go1.20
+// +build go1.20
+
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+func TestPingContextCause(t *testing.T) {
+	client, conn := newClientPipe(t)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	errCause := errors.New("test cause")
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "c000") // PINGREQ
+		cancel(errCause)               // without PINGRESP
+	})
+
+	err := client.PingContext(ctx)
+	if !errors.Is(err, mqtt.ErrAbandoned) {
+		t.Errorf("got error %v, want an mqtt.ErrAbandoned", err)
+	}
+	if !errors.Is(err, errCause) {
+		t.Errorf("got error %v, want the cancel cause", err)
+	}
+	<-brokerMockDone
+}
@@ -0,0 +1,80 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+func TestPingContextAbandon(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "c000") // PINGREQ
+		// leave without PINGRESP
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/16)
+	defer cancel()
+	err := client.PingContext(ctx)
+	if !errors.Is(err, mqtt.ErrAbandoned) {
+		t.Errorf("got error %v, want an mqtt.ErrAbandoned", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want a context.DeadlineExceeded", err)
+	}
+	<-brokerMockDone
+}
+
+func TestPublishContextCancel(t *testing.T) {
+	client, conn := newClientPipe(t)
+
+	// occupy the connection with a write nobody reads
+	writing := make(chan struct{})
+	brokerMockDone := testRoutine(t, func() {
+		var buf [1]byte
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			t.Error("broker read error:", err)
+		}
+		close(writing) // write lock held
+	})
+	blockDone := testRoutine(t, func() {
+		err := client.Publish(nil, []byte("block"), "x")
+		if err == nil {
+			t.Error("blocking publish got no error")
+		}
+	})
+	<-writing
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, publish := range map[string]func() error{
+		"PublishContext": func() error {
+			return client.PublishContext(ctx, []byte("hello"), "greet")
+		},
+		"PublishWithPropertiesContext": func() error {
+			return client.PublishWithPropertiesContext(ctx, []byte("hello"), "greet", nil)
+		},
+		"PublishBuffersContext": func() error {
+			return client.PublishBuffersContext(ctx, net.Buffers{[]byte("hello")}, "greet")
+		},
+		"PublishFromContext": func() error {
+			return client.PublishFromContext(ctx, strings.NewReader("hello"), 5, "greet")
+		},
+	} {
+		err := publish()
+		if !errors.Is(err, mqtt.ErrCanceled) {
+			t.Errorf("%s got error %v, want an mqtt.ErrCanceled", name, err)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s got error %v, want a context.Canceled", name, err)
+		}
+	}
+	<-blockDone
+	<-brokerMockDone
+}
@@ -0,0 +1,228 @@
+package mqtt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Encrypted values start with a key identifier, followed by the nonce.
+const (
+	cipherKeyIDSize = 4
+	cipherNonceSize = 12 // GCM standard
+)
+
+// EncryptedPersistence encrypts all values with AES-GCM. The keys must be 16,
+// 24 or 32 bytes in size, for AES-128, AES-192 and AES-256 respectively. Saves
+// use the first key only. Any other keys serve decryption of values from before
+// a rotation. Each ciphertext is bound to its key in the Persistence, such that
+// records can not be swapped.
+//
+// AdoptSession rotates, i.e., it encrypts all records in the Persistence with
+// the first key. The session could then continue without the other keys. Note
+// that wrappers of the Persistence hide the rotation from AdoptSession, except
+// for GroupCommit. The Spooler extension is not supported, as authentication
+// needs values whole.
+//
+// Authentication failures are a *CorruptionError, which AdoptSession deletes
+// with a warning. Values encrypted with an unknown key fail fatally instead, as
+// a missing key is more likely than corruption of the key identifier.
+//
+//	p, err := mqtt.EncryptedPersistence(mqtt.FileSystem(dir), newKey, oldKey)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	client, warn, err := mqtt.AdoptSession(p, config)
+func EncryptedPersistence(p Persistence, keys ...[]byte) (Persistence, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("mqtt: encrypted persistence without key")
+	}
+	e := &encryptedPersistence{
+		Persistence: p,
+		perKeyID:    make(map[uint32]cipher.AEAD, len(keys)),
+	}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt: encrypted persistence key %d: %w", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt: encrypted persistence key %d: %w", i, err)
+		}
+
+		// The identifier is a fingerprint of the key.
+		sum := sha256.Sum256(key)
+		keyID := binary.BigEndian.Uint32(sum[:])
+		if _, ok := e.perKeyID[keyID]; ok {
+			return nil, fmt.Errorf("mqtt: encrypted persistence key %d is a duplicate", i)
+		}
+		e.perKeyID[keyID] = aead
+		if i == 0 {
+			e.keyID = keyID
+			e.aead = aead
+		}
+	}
+	if _, ok := p.(batchSaver); ok {
+		return &encryptedBatchPersistence{e}, nil
+	}
+	return e, nil
+}
+
+// EncryptedPersistence applies AES-GCM to a delegate.
+type encryptedPersistence struct {
+	Persistence // delegate
+
+	keyID uint32      // for saves
+	aead  cipher.AEAD // for saves
+
+	perKeyID map[uint32]cipher.AEAD // for loads
+}
+
+// Load implements the Persistence interface.
+func (e *encryptedPersistence) Load(key uint) ([]byte, error) {
+	value, err := e.Persistence.Load(key)
+	if err != nil || value == nil {
+		return value, err
+	}
+	plain, _, err := e.open(key, value)
+	return plain, err
+}
+
+// Save implements the Persistence interface.
+func (e *encryptedPersistence) Save(key uint, value net.Buffers) error {
+	var size int
+	for _, buf := range value {
+		size += len(buf)
+	}
+	plain := make([]byte, 0, size)
+	for _, buf := range value {
+		plain = append(plain, buf...)
+	}
+	sealed, err := e.seal(key, plain)
+	if err != nil {
+		return err
+	}
+	return e.Persistence.Save(key, net.Buffers{sealed})
+}
+
+// EncryptedBatchPersistence is an encryptedPersistence with batchSaver support,
+// for GroupCommit.
+type encryptedBatchPersistence struct {
+	*encryptedPersistence
+}
+
+// SaveBatch implements the batchSaver interface.
+func (e *encryptedBatchPersistence) saveBatch(keys []uint, values []net.Buffers) []error {
+	errs := make([]error, len(keys))
+	sealedKeys := make([]uint, 0, len(keys))
+	sealedValues := make([]net.Buffers, 0, len(keys))
+	var indices []int // per sealed entry
+	for i, key := range keys {
+		var plain []byte
+		for _, buf := range values[i] {
+			plain = append(plain, buf...)
+		}
+		sealed, err := e.seal(key, plain)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		sealedKeys = append(sealedKeys, key)
+		sealedValues = append(sealedValues, net.Buffers{sealed})
+		indices = append(indices, i)
+	}
+	for j, err := range e.Persistence.(batchSaver).saveBatch(sealedKeys, sealedValues) {
+		errs[indices[j]] = err
+	}
+	return errs
+}
+
+// Seal encrypts a value with the key for saves.
+func (e *encryptedPersistence) seal(key uint, plain []byte) ([]byte, error) {
+	sealed := make([]byte, cipherKeyIDSize+cipherNonceSize, cipherKeyIDSize+cipherNonceSize+len(plain)+e.aead.Overhead())
+	binary.BigEndian.PutUint32(sealed, e.keyID)
+	nonce := sealed[cipherKeyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("mqtt: encrypted persistence nonce unavailable: %w", err)
+	}
+	return e.aead.Seal(sealed, nonce, plain, cipherAdditionalData(key, e.keyID)), nil
+}
+
+// Open decrypts a value, including the identifier of the key used.
+func (e *encryptedPersistence) open(key uint, sealed []byte) (plain []byte, keyID uint32, err error) {
+	if len(sealed) < cipherKeyIDSize+cipherNonceSize {
+		return nil, 0, &CorruptionError{Key: key, Reason: "ciphertext truncated"}
+	}
+	keyID = binary.BigEndian.Uint32(sealed)
+	aead, ok := e.perKeyID[keyID]
+	if !ok {
+		return nil, keyID, fmt.Errorf("mqtt: persistence value from key %#x encrypted with unknown key %#08x", key, keyID)
+	}
+	nonce := sealed[cipherKeyIDSize : cipherKeyIDSize+cipherNonceSize]
+	plain, err = aead.Open(nil, nonce, sealed[cipherKeyIDSize+cipherNonceSize:], cipherAdditionalData(key, keyID))
+	if err != nil {
+		return nil, keyID, &CorruptionError{Key: key, Reason: "ciphertext not authentic"}
+	}
+	return plain, keyID, nil
+}
+
+// CipherAdditionalData binds a ciphertext to its Persistence key, and to the
+// key identifier.
+func cipherAdditionalData(key uint, keyID uint32) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(key))
+	binary.BigEndian.PutUint32(buf[4:], keyID)
+	return buf[:]
+}
+
+// KeyRotator is an optional extension of Persistence, which AdoptSession
+// applies before anything else. Warnings are for records not rotated.
+type keyRotator interface {
+	rotateKeys() (warn []error, err error)
+}
+
+// RotateKeys implements the keyRotator interface. Values encrypted with any
+// other than the first key get encrypted with the first key. Corrupt values
+// are left as is, with a warning for each.
+func (e *encryptedPersistence) rotateKeys() (warn []error, err error) {
+	keys, err := e.Persistence.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		value, err := e.Persistence.Load(key)
+		if err != nil {
+			return warn, err
+		}
+		if value == nil {
+			continue // deleted in the mean time
+		}
+		plain, keyID, err := e.open(key, value)
+		if err != nil {
+			var corrupt *CorruptionError
+			if errors.As(err, &corrupt) {
+				warn = append(warn, fmt.Errorf("%w; not rotated", err))
+				continue
+			}
+			return warn, err
+		}
+		if keyID == e.keyID {
+			continue // current
+		}
+		sealed, err := e.seal(key, plain)
+		if err != nil {
+			return warn, err
+		}
+		err = e.Persistence.Save(key, net.Buffers{sealed})
+		if err != nil {
+			return warn, fmt.Errorf("mqtt: persistence key rotation: %w", err)
+		}
+	}
+	return warn, nil
+}
@@ -0,0 +1,154 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, 16)
+	testKey2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func newTestEncrypted(t *testing.T, p Persistence, keys ...[]byte) Persistence {
+	e, err := EncryptedPersistence(p, keys...)
+	if err != nil {
+		t.Fatal("EncryptedPersistence error:", err)
+	}
+	return e
+}
+
+func TestEncryptedPersistenceSwap(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestEncrypted(t, FileSystem(dir), testKey1)
+	if err := p.Save(0x8001, net.Buffers{[]byte("secret one")}); err != nil {
+		t.Fatal("Save error:", err)
+	}
+	if err := p.Save(0x8002, net.Buffers{[]byte("secret two")}); err != nil {
+		t.Fatal("Save error:", err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, "08001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("plaintext in file: %q", raw)
+	}
+
+	// swap records
+	err = os.Rename(filepath.Join(dir, "08001"), filepath.Join(dir, "swap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(filepath.Join(dir, "08002"), filepath.Join(dir, "08001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.Load(0x8001); err == nil {
+		t.Errorf("Load of swapped record got %q, want error", got)
+	}
+}
+
+func TestEncryptedPersistenceRotation(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		Dialer: func(context.Context) (net.Conn, error) {
+			return nil, errors.New("dialer call not allowed for test")
+		},
+	}
+
+	client, err := InitSession("test-client", newTestEncrypted(t, FileSystem(dir), testKey1), config)
+	if err != nil {
+		t.Fatal("InitSession error:", err)
+	}
+	client.Close()
+
+	if _, _, err := AdoptSession(newTestEncrypted(t, FileSystem(dir), testKey2), config); err == nil {
+		t.Fatal("AdoptSession without the original key got no error")
+	}
+
+	client, warn, err := AdoptSession(newTestEncrypted(t, FileSystem(dir), testKey2, testKey1), config)
+	if err != nil {
+		t.Fatal("AdoptSession with key rotation error:", err)
+	}
+	client.Close()
+	for _, err := range warn {
+		t.Error("AdoptSession with key rotation warning:", err)
+	}
+
+	// previous key no longer needed
+	p := &ruggedPersistence{Persistence: newTestEncrypted(t, FileSystem(dir), testKey2)}
+	if got, err := p.Load(clientIDKey); err != nil {
+		t.Error("Load client identifier got error:", err)
+	} else if string(got) != "test-client" {
+		t.Errorf("Load client identifier got %q, want %q", got, "test-client")
+	}
+}
+
+func TestEncryptedPersistenceCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		Dialer: func(context.Context) (net.Conn, error) {
+			return nil, errors.New("dialer call not allowed for test")
+		},
+		AtLeastOnceMax: 2,
+	}
+
+	p := &ruggedPersistence{Persistence: newTestEncrypted(t, FileSystem(dir), testKey1)}
+	for _, key := range []uint{0x8000, 0x8001} {
+		err := p.Save(key, net.Buffers{[]byte{0x32, 6, 0, 1, 'x', byte(key >> 8), byte(key), 'm'}})
+		if err != nil {
+			t.Fatal("Save error:", err)
+		}
+	}
+
+	// flip a bit in the ciphertext
+	file := filepath.Join(dir, "08001")
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	if err := os.WriteFile(file, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotation through a wrapper
+	e := newTestEncrypted(t, FileSystem(dir), testKey2, testKey1)
+	g := GroupCommit(e, 0)
+	if g == e {
+		t.Fatal("GroupCommit returned the encrypted persistence as is")
+	}
+	client, warn, err := AdoptSession(g, config)
+	if err != nil {
+		t.Fatal("AdoptSession error:", err)
+	}
+	client.Close()
+
+	if len(warn) == 0 {
+		t.Fatal("AdoptSession got no warnings, want corruption of key 0x8001")
+	}
+	for _, err := range warn {
+		var corrupt *CorruptionError
+		if !errors.As(err, &corrupt) || corrupt.Key != 0x8001 {
+			t.Errorf("got warning %q, want a CorruptionError for key 0x8001", err)
+		}
+	}
+	if value, err := FileSystem(dir).Load(0x8001); err != nil || value != nil {
+		t.Errorf("corrupt record got value %q and error %v, want deleted", value, err)
+	}
+
+	// previous key no longer needed
+	p = &ruggedPersistence{Persistence: newTestEncrypted(t, FileSystem(dir), testKey2)}
+	if got, err := p.Load(0x8000); err != nil {
+		t.Error("Load after rotation got error:", err)
+	} else if len(got) != 8 || got[7] != 'm' {
+		t.Errorf("Load after rotation got %#x", got)
+	}
+}
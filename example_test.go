@@ -64,6 +64,9 @@ func ExampleClient_setup() {
 	client, err := mqtt.VolatileSession("demo-client", &mqtt.Config{
 		Dialer:       mqtt.NewDialer("tcp", "localhost:1883"),
 		PauseTimeout: 4 * time.Second,
+		// retry after 1 s, 2 s, 4 s, … up to 2 min, or
+		// 15 min when the broker refused the connect
+		Backoff: mqtt.NewBackoff(0, 0, 0),
 	})
 	if err != nil {
 		log.Fatal("exit on broken setup: ", err)
@@ -73,11 +76,12 @@ func ExampleClient_setup() {
 	go func() {
 		var big *mqtt.BigMessage
 		for {
-			message, topic, err := client.ReadSlices()
+			message, topic, ack, err := client.ReadSlices()
 			switch {
 			case err == nil:
 				// do something with inbound message
 				log.Printf("📥 %q: %q", topic, message)
+				ack()
 
 			case errors.As(err, &big):
 				log.Printf("📥 %q: %d byte message omitted", big.Topic, big.Size)
@@ -86,15 +90,16 @@ func ExampleClient_setup() {
 				log.Print(err)
 				return // terminated
 
+			case errors.Is(err, mqtt.ErrSessionLost):
+				log.Print(err) // connection is fine
+
 			case mqtt.IsConnectionRefused(err):
 				log.Print(err) // explains rejection
-				// mqtt.ErrDown for a while
-				time.Sleep(15 * time.Minute)
+				// mqtt.ErrDown during backoff
 
 			default:
 				log.Print("broker unavailable: ", err)
 				// mqtt.ErrDown during backoff
-				time.Sleep(2 * time.Second)
 			}
 		}
 	}()
@@ -147,66 +152,39 @@ func ExampleClient_PublishAtLeastOnce_critical() {
 	// alert acknowledged ✓
 }
 
-// Demonstrates all error scenario and the respective recovery options.
+// Demonstrates all error scenario and the respective recovery options. No retry
+// is needed once the request went out. The Client resubmits subscribe requests
+// without response on reconnect, and it restores confirmed subscriptions when
+// the broker lost the session.
 func ExampleClient_Subscribe_sticky() {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	for {
-		err := Subscribe(ctx.Done(), "demo/+")
-		switch {
-		case err == nil:
-			fmt.Println("subscribe confirmed by broker")
-			return
+	err := Subscribe(ctx.Done(), "demo/+")
+	switch {
+	case err == nil:
+		fmt.Println("subscribe confirmed by broker")
 
-		case errors.As(err, new(mqtt.SubscribeError)):
-			fmt.Println("subscribe failed by broker")
-			return
+	case errors.As(err, new(mqtt.SubscribeError)):
+		fmt.Println("subscribe failed by broker")
 
-		case mqtt.IsDeny(err): // illegal topic filter
-			fmt.Println(err)
-			return
+	case mqtt.IsDeny(err): // illegal topic filter
+		fmt.Println(err)
 
-		case errors.Is(err, mqtt.ErrClosed):
-			fmt.Println("no subscribe due client close")
-			return
+	case errors.Is(err, mqtt.ErrClosed):
+		fmt.Println("no subscribe due client close")
 
-		case errors.Is(err, mqtt.ErrCanceled):
-			fmt.Println("no subscribe due timeout")
-			return
+	case errors.Is(err, mqtt.ErrCanceled):
+		fmt.Println("no subscribe due timeout")
 
-		case errors.Is(err, mqtt.ErrAbandoned):
-			fmt.Println("subscribe state unknown due timeout")
-			return
-
-		case errors.Is(err, mqtt.ErrBreak):
-			fmt.Println("subscribe state unknown due connection loss")
-			select {
-			case <-Online():
-				fmt.Println("subscribe retry with new connection")
-			case <-ctx.Done():
-				fmt.Println("subscribe timeout")
-				return
-			}
-
-		case errors.Is(err, mqtt.ErrDown):
-			fmt.Println("subscribe delay while service is down")
-			select {
-			case <-Online():
-				fmt.Println("subscribe retry with new connection")
-			case <-ctx.Done():
-				fmt.Println("subscribe timeout")
-				return
-			}
+	case errors.Is(err, mqtt.ErrAbandoned), errors.Is(err, mqtt.ErrBreak):
+		fmt.Println("subscribe continues in the background")
 
-		case errors.Is(err, mqtt.ErrMax):
-			fmt.Println("subscribe hold-up due excessive number of pending requests")
-			time.Sleep(2 * time.Second) // backoff
+	case errors.Is(err, mqtt.ErrDown), errors.Is(err, mqtt.ErrMax):
+		fmt.Println("no subscribe; try again later")
 
-		default:
-			fmt.Println("subscribe request transfer interrupted:", err)
-			time.Sleep(time.Second / 2) // backoff
-		}
+	default:
+		fmt.Println("subscribe request transfer interrupted:", err)
 	}
 	// Output:
 	// subscribe confirmed by broker
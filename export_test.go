@@ -0,0 +1,7 @@
+package mqtt
+
+// Persistence implementations for the conformance tests in package mqtt_test.
+var (
+	NewVolatile = newVolatile
+	NewRugged   = func(p Persistence) Persistence { return &ruggedPersistence{Persistence: p} }
+)
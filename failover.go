@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// Endpoint is a Dialer with a name for reporting purposes.
+type Endpoint struct {
+	Name   string // e.g., the network address
+	Dialer        // establishes the transport
+}
+
+// Failover rotates between endpoints on connect failures. The endpoint with the
+// latest successful connect stays first in line.
+//
+// Multiple goroutines may invoke methods on a Failover simultaneously.
+type Failover struct {
+	endpoints []Endpoint // read-only
+
+	mutex  sync.Mutex
+	next   int           // index in endpoints
+	active *failoverConn // latest successful connect, if any
+}
+
+// NewFailover returns a rotation over the endpoints in order of appearance, or
+// in random order when shuffle is true. Apply Dial as the Dialer in Config.
+func NewFailover(shuffle bool, endpoints ...Endpoint) *Failover {
+	if len(endpoints) == 0 {
+		panic("mqtt: failover without endpoints")
+	}
+	endpoints = append([]Endpoint(nil), endpoints...) // copy
+	if shuffle {
+		rand.Shuffle(len(endpoints), func(i, j int) {
+			endpoints[i], endpoints[j] = endpoints[j], endpoints[i]
+		})
+	}
+	return &Failover{endpoints: endpoints}
+}
+
+// Dial implements the Dialer signature. Failure on either the dial or the MQTT
+// handshake [CONNACK] moves the rotation to the next endpoint in line.
+func (f *Failover) Dial(ctx context.Context) (net.Conn, error) {
+	f.mutex.Lock()
+	i := f.next
+	f.mutex.Unlock()
+
+	conn, err := f.endpoints[i].Dialer(ctx)
+	if err != nil {
+		f.rotate(i)
+		return nil, fmt.Errorf("mqtt: endpoint %q: %w", f.endpoints[i].Name, err)
+	}
+	return &failoverConn{Conn: conn, f: f, index: i}, nil
+}
+
+// Active returns the name of the endpoint in use, with false for none.
+func (f *Failover) Active() (name string, ok bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.active == nil {
+		return "", false
+	}
+	return f.endpoints[f.active.index].Name, true
+}
+
+// Rotate moves to the endpoint after i, unless another routine did already.
+func (f *Failover) rotate(i int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.next == i {
+		f.next = (i + 1) % len(f.endpoints)
+	}
+}
+
+// HandshakeObserver gets the result of the CONNECT exchange from the Client.
+type handshakeObserver interface {
+	handshakeDone(err error)
+}
+
+// FailoverConn tracks the active state of a Failover.
+type failoverConn struct {
+	net.Conn
+	f     *Failover
+	index int // in Failover endpoints
+}
+
+func (c *failoverConn) handshakeDone(err error) {
+	if err != nil {
+		c.f.rotate(c.index)
+		return
+	}
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+	c.f.next = c.index
+	c.f.active = c
+}
+
+// Close implements the net.Conn interface.
+func (c *failoverConn) Close() error {
+	c.f.mutex.Lock()
+	if c.f.active == c {
+		c.f.active = nil
+	}
+	c.f.mutex.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,90 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+func TestFailover(t *testing.T) {
+	t.Parallel()
+
+	clientConnB, brokerConnB := net.Pipe()
+	clientConnC1, brokerConnC1 := net.Pipe()
+	clientConnC2, brokerConnC2 := net.Pipe()
+	errDial := errors.New("dial test error")
+	failover := mqtt.NewFailover(false,
+		mqtt.Endpoint{Name: "A", Dialer: func(context.Context) (net.Conn, error) {
+			return nil, errDial
+		}},
+		mqtt.Endpoint{Name: "B", Dialer: newTestDialer(t, clientConnB)},
+		mqtt.Endpoint{Name: "C", Dialer: newTestDialer(t, clientConnC1, clientConnC2)},
+	)
+	if name, ok := failover.Active(); ok {
+		t.Errorf("got active endpoint %q before dial", name)
+	}
+
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       failover.Dial,
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	if _, _, _, err := client.ReadSlices(); !errors.Is(err, errDial) {
+		t.Errorf("ReadSlices got error %v, want dial error from endpoint A", err)
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConnB, pipeCONNECTHex)
+		sendPacketHex(t, brokerConnB, "20020003") // CONNACK with server unavailable
+	})
+	if _, _, _, err := client.ReadSlices(); !errors.Is(err, mqtt.ErrUnavailable) {
+		t.Errorf("ReadSlices got error %v, want mqtt.ErrUnavailable from endpoint B", err)
+	}
+	<-brokerMockDone
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerConnC1, pipeCONNECTHex)
+		sendPacketHex(t, brokerConnC1, "20020000") // CONNACK
+		brokerConnC1.Close()
+	})
+	if _, _, _, err := client.ReadSlices(); err == nil {
+		t.Error("ReadSlices got no error on connection loss")
+	}
+	<-brokerMockDone
+
+	// The reconnect should stick to endpoint C.
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerConnC2, pipeCONNECTHex)
+		sendPacketHex(t, brokerConnC2, "20020000") // CONNACK
+		wantPacketHex(t, brokerConnC2, "c000")     // PINGREQ
+		sendPacketHex(t, brokerConnC2, "d000")     // PINGRESP
+	})
+	readRoutineDone := testRoutine(t, func() {
+		for {
+			_, _, _, err := client.ReadSlices()
+			if errors.Is(err, mqtt.ErrClosed) {
+				return
+			}
+		}
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Error("ping error:", err)
+	}
+	<-brokerMockDone
+	if name, ok := failover.Active(); !ok || name != "C" {
+		t.Errorf("got active endpoint %q, %t; want C", name, ok)
+	}
+	client.Close()
+	<-readRoutineDone
+	if name, ok := failover.Active(); ok {
+		t.Errorf("got active endpoint %q after close", name)
+	}
+}
@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// BatchSaver is an optional extension of Persistence, for group commit. The
+// keys are unique. The return has an error per key, with nil for success.
+type batchSaver interface {
+	saveBatch(keys []uint, values []net.Buffers) []error
+}
+
+// GroupCommit collects concurrent saves into batches, with one durable flush
+// per batch. Save returns only after the flush which covers its value, so the
+// persistence guarantees of PublishAtLeastOnce and PublishExactlyOnce remain
+// intact. A batch is open for the window duration, plus any time spent on the
+// flush of the previous batch. Zero window groups only saves which queue up
+// during a flush.
+//
+// Both FileSystem and AppendLog combine the flushes of a batch. Any other
+// Persistence is returned as is, because sequential saves per batch would only
+// add delay. The Spooler extension, if any, is passed as is, and so is the key
+// rotation of EncryptedPersistence.
+//
+// Note that the read routine of Client saves on each PUBREC (QoS 2). Reception
+// stalls for the window plus the flush on each of such.
+func GroupCommit(p Persistence, window time.Duration) Persistence {
+	if _, ok := p.(batchSaver); !ok {
+		return p
+	}
+	g := &groupCommit{Persistence: p, window: window}
+	if _, ok := p.(Spooler); ok {
+		return &groupCommitSpooler{g}
+	}
+	return g
+}
+
+type groupCommit struct {
+	Persistence
+	window time.Duration
+
+	flushLock sync.Mutex // one batch at a time
+
+	mutex sync.Mutex
+	batch *saveBatch // open for additions, if any
+}
+
+// SaveBatch is a group of pending saves.
+type saveBatch struct {
+	keys   []uint
+	values []net.Buffers
+	errs   []error       // per key, available once done is closed
+	done   chan struct{} // flush completion
+}
+
+// Save implements the Persistence interface.
+func (g *groupCommit) Save(key uint, value net.Buffers) error {
+	g.mutex.Lock()
+	b := g.batch
+	leader := b == nil
+	if leader {
+		b = &saveBatch{done: make(chan struct{})}
+		g.batch = b
+	}
+	i := b.indexOf(key)
+	if i >= 0 {
+		b.values[i] = value // overwrite
+	} else {
+		i = len(b.keys)
+		b.keys = append(b.keys, key)
+		b.values = append(b.values, value)
+	}
+	g.mutex.Unlock()
+
+	if leader {
+		g.flush(b)
+	} else {
+		<-b.done
+	}
+	return b.errs[i]
+}
+
+// IndexOf returns the position of key, or -1 when absent.
+func (b *saveBatch) indexOf(key uint) int {
+	for i, k := range b.keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Delete implements the Persistence interface. Any pending save of the key goes
+// first, as does any flush in progress.
+func (g *groupCommit) Delete(key uint) error {
+	g.mutex.Lock()
+	b := g.batch
+	pending := b != nil && b.indexOf(key) >= 0
+	g.mutex.Unlock()
+	if pending {
+		<-b.done
+	}
+
+	g.flushLock.Lock()
+	defer g.flushLock.Unlock()
+	return g.Persistence.Delete(key)
+}
+
+// Flush closes the batch for additions, and it saves the content.
+func (g *groupCommit) flush(b *saveBatch) {
+	if g.window > 0 {
+		time.Sleep(g.window)
+	}
+	g.flushLock.Lock()
+	defer g.flushLock.Unlock()
+
+	g.mutex.Lock()
+	g.batch = nil
+	g.mutex.Unlock()
+
+	b.errs = g.Persistence.(batchSaver).saveBatch(b.keys, b.values)
+	close(b.done)
+}
+
+// RotateKeys forwards the keyRotator extension, if any.
+func (g *groupCommit) rotateKeys() (warn []error, err error) {
+	if r, ok := g.Persistence.(keyRotator); ok {
+		return r.rotateKeys()
+	}
+	return nil, nil
+}
+
+// GroupCommitSpooler is a groupCommit with Spooler support.
+type groupCommitSpooler struct {
+	*groupCommit
+}
+
+// SaveFrom implements the Spooler interface.
+func (g *groupCommitSpooler) SaveFrom(key uint, r io.Reader, size int) error {
+	return g.Persistence.(Spooler).SaveFrom(key, r, size)
+}
+
+// Open implements the Spooler interface.
+func (g *groupCommitSpooler) Open(key uint) (value io.ReadCloser, size int, err error) {
+	return g.Persistence.(Spooler).Open(key)
+}
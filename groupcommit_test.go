@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BatchCounter is a Persistence with group commit.
+type batchCounter struct {
+	Persistence
+	batchN int
+}
+
+func (c *batchCounter) saveBatch(keys []uint, values []net.Buffers) []error {
+	c.batchN++
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = c.Persistence.Save(key, values[i])
+	}
+	return errs
+}
+
+func TestGroupCommit(t *testing.T) {
+	c := &batchCounter{Persistence: newVolatile()}
+	p := GroupCommit(c, 100*time.Millisecond)
+
+	const saveN = 10
+	var wg sync.WaitGroup
+	for i := 0; i < saveN; i++ {
+		wg.Add(1)
+		go func(key uint) {
+			defer wg.Done()
+			err := p.Save(key, net.Buffers{[]byte{byte(key)}})
+			if err != nil {
+				t.Errorf("Save %d got error: %s", key, err)
+			}
+		}(uint(i))
+	}
+	wg.Wait()
+
+	if c.batchN == 0 || c.batchN >= saveN {
+		t.Errorf("got %d batches for %d concurrent saves", c.batchN, saveN)
+	}
+	for key := uint(0); key < saveN; key++ {
+		if got, err := p.Load(key); err != nil {
+			t.Errorf("Load %d got error: %s", key, err)
+		} else if len(got) != 1 || got[0] != byte(key) {
+			t.Errorf("Load %d got %#x", key, got)
+		}
+	}
+}
+
+func TestGroupCommitDelete(t *testing.T) {
+	g := &groupCommit{Persistence: &batchCounter{Persistence: newVolatile()}, window: 50 * time.Millisecond}
+
+	saveDone := make(chan error)
+	go func() {
+		saveDone <- g.Save(1, net.Buffers{[]byte{1}})
+	}()
+	// await the open batch
+	for {
+		g.mutex.Lock()
+		open := g.batch != nil
+		g.mutex.Unlock()
+		if open {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := g.Delete(1); err != nil {
+		t.Fatal("Delete error:", err)
+	}
+	if err := <-saveDone; err != nil {
+		t.Fatal("Save error:", err)
+	}
+	if got, err := g.Load(1); err != nil {
+		t.Fatal("Load error:", err)
+	} else if got != nil {
+		t.Errorf("Load after Delete got %#x, want nil", got)
+	}
+}
+
+func TestGroupCommitFileSystem(t *testing.T) {
+	dir := t.TempDir()
+	p := GroupCommit(FileSystem(dir), 10*time.Millisecond)
+	if _, ok := p.(*groupCommitSpooler); !ok {
+		t.Fatalf("got %T, want a group commit with Spooler", p)
+	}
+
+	const saveN = batchFileMax + 10
+	var wg sync.WaitGroup
+	for i := 0; i < saveN; i++ {
+		wg.Add(1)
+		go func(key uint) {
+			defer wg.Done()
+			err := p.Save(key, net.Buffers{[]byte{byte(key)}})
+			if err != nil {
+				t.Errorf("Save %d got error: %s", key, err)
+			}
+		}(uint(i))
+	}
+	wg.Wait()
+
+	for key := uint(0); key < saveN; key++ {
+		if got, err := p.Load(key); err != nil {
+			t.Errorf("Load %d got error: %s", key, err)
+		} else if len(got) != 1 || got[0] != byte(key) {
+			t.Errorf("Load %d got %#x", key, got)
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("got spool files %q after batches", names)
+	}
+}
+
+func TestGroupCommitPassThrough(t *testing.T) {
+	p := newVolatile()
+	if got := GroupCommit(p, time.Millisecond); got != p {
+		t.Errorf("got %T for a Persistence without batches, want the argument as is", got)
+	}
+}
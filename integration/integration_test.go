@@ -54,7 +54,7 @@ func newTestClient(t *testing.T, host string, config *mqtt.Config) (client *mqtt
 	go func() {
 		defer close(ch)
 		for {
-			message, topic, err := client.ReadSlices()
+			message, topic, ack, err := client.ReadSlices()
 			switch {
 			case err == nil:
 				if len(message) != 8 {
@@ -62,6 +62,7 @@ func newTestClient(t *testing.T, host string, config *mqtt.Config) (client *mqtt
 				} else {
 					ch <- binary.LittleEndian.Uint64(message)
 				}
+				ack()
 
 			case errors.Is(err, mqtt.ErrClosed):
 				return
@@ -19,18 +19,27 @@
 // Errors [either ErrClosed, ErrMax, Save failure or an IsDeny] imply that the
 // message was dropped. Once persisted, the client will execute the transfer
 // with endless retries, and report to the respective exchange channel.
+//
+// MQTT 5.0 is an opt-in with Config.ProtocolLevel. Brokers may reject a message
+// with a ReasonCode error on the exchange channel, right before it closes.
 package mqtt
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"hash/fnv"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"sync"
 	"sync/atomic"
+
+	"github.com/pascaldekloe/mqtt/topics"
 )
 
 // Control packets have a 4-bit type code in the first byte.
@@ -92,8 +101,6 @@ var (
 
 	errUTF8 = errors.New("invalid UTF-8 byte sequence")
 	errNull = errors.New("string contains null character")
-
-	errStringZero = errors.New("string is empty")
 )
 
 // Validation errors are expected to be prefixed according to the context.
@@ -120,15 +127,6 @@ func stringCheck(s string) error {
 	return nil
 }
 
-// “All Topic Names and Topic Filters MUST be at least one character long.”
-// — MQTT Version 3.1.1, conformance statement MQTT-4.7.3-1
-func topicCheck(s string) error {
-	if s == "" {
-		return errStringZero
-	}
-	return stringCheck(s)
-}
-
 // IsDeny returns whether execution was rejected by the Client based on some
 // validation constraint, like size limitation or an illegal UTF-8 encoding.
 // The rejection is permanent in such case. Another invocation with the same
@@ -136,7 +134,9 @@ func topicCheck(s string) error {
 func IsDeny(err error) bool {
 	for err != nil {
 		switch err {
-		case errPacketMax, errStringMax, errUTF8, errNull, errStringZero, errSubscribeNone, errUnsubscribeNone:
+		case errPacketMax, errStringMax, errUTF8, errNull, errSubscribeNone, errUnsubscribeNone, errProperties, errNoSpooler:
+			return true
+		case topics.ErrEmpty, topics.ErrMax, topics.ErrUTF8, topics.ErrNull, topics.ErrWildcard, topics.ErrMultiLevel, topics.ErrLevelMix:
 			return true
 		}
 		err = errors.Unwrap(err)
@@ -189,9 +189,12 @@ func (code connectReturn) Error() string {
 		return refuse + "bad user name or password"
 	case ErrAuth:
 		return refuse + "not authorized"
-	default:
-		return fmt.Sprintf(refuse+"connect return code %d reserved for future use", code)
 	}
+	if code >= 0x80 {
+		// MQTT 5.0 reason code without an equivalent
+		return fmt.Sprintf(refuse+"reason code %#02x “%s”", byte(code), ReasonCode(code).text())
+	}
+	return fmt.Sprintf(refuse+"connect return code %d reserved for future use", code)
 }
 
 // IsConnectionRefused returns whether the broker denied a connect request from
@@ -213,6 +216,10 @@ const (
 
 	// Packet identifier zero is not in use by the protocol.
 	clientIDKey = 0
+
+	// Outbound packet identifiers start at 0x4000. The lower range may
+	// be used for other records.
+	subscriptionsKey = 1
 )
 
 // Persistence tracks the session state as a key–value store. An instance may
@@ -237,6 +244,33 @@ type Persistence interface {
 	List() (keys []uint, err error)
 }
 
+// Spooler is an optional extension of Persistence, for values which should not
+// be held in memory as a whole. Publish from an io.Reader with an “at least
+// once” or an “exactly once” guarantee requires a Persistence with Spooler.
+//
+// Multiple goroutines may invoke methods on a Spooler simultaneously.
+type Spooler interface {
+	// SaveFrom defines the value of a key with size bytes from r.
+	SaveFrom(key uint, r io.Reader, size int) error
+
+	// Open resolves the value of a key as a stream, including its size in
+	// bytes. A nil ReadCloser means “not found”.
+	Open(key uint) (value io.ReadCloser, size int, err error)
+}
+
+var errNoSpooler = errors.New("mqtt: persistence has no Spooler support")
+
+// SpoolerOf returns the Spooler support, if any.
+func spoolerOf(p Persistence) (Spooler, bool) {
+	if r, ok := p.(*ruggedPersistence); ok {
+		if _, ok := r.Persistence.(Spooler); !ok {
+			return nil, false
+		}
+	}
+	s, ok := p.(Spooler)
+	return s, ok
+}
+
 // Volatile is an in-memory Persistence.
 type volatile struct {
 	sync.Mutex
@@ -291,6 +325,30 @@ func (m *volatile) List() (keys []uint, err error) {
 	return keys, nil
 }
 
+// SaveFrom implements the Spooler interface.
+func (m *volatile) SaveFrom(key uint, r io.Reader, size int) error {
+	bytes := make([]byte, size)
+	if _, err := io.ReadFull(r, bytes); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.perKey[key] = bytes
+	return nil
+}
+
+// Open implements the Spooler interface.
+func (m *volatile) Open(key uint) (value io.ReadCloser, size int, err error) {
+	m.Lock()
+	defer m.Unlock()
+	v, ok := m.perKey[key]
+	if !ok {
+		return nil, 0, nil
+	}
+	return io.NopCloser(bytes.NewReader(v)), len(v), nil
+}
+
 type fileSystem string
 
 // FileSystem stores values per file in a directory. Callers must ensure the
@@ -321,15 +379,41 @@ func (dir fileSystem) Load(key uint) ([]byte, error) {
 
 // Save implements the Persistence interface.
 func (dir fileSystem) Save(key uint, value net.Buffers) error {
+	return dir.save(key, func(f *os.File) error {
+		_, err := value.WriteTo(f)
+		return err
+	})
+}
+
+// SaveFrom implements the Spooler interface.
+func (dir fileSystem) SaveFrom(key uint, r io.Reader, size int) error {
+	return dir.save(key, func(f *os.File) error {
+		_, err := io.CopyN(f, r, int64(size))
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+}
+
+// Save writes the value with a spool file, which replaces the previous value,
+// if any, on success only.
+func (dir fileSystem) save(key uint, writeValue func(*os.File) error) error {
 	f, err := os.Create(dir.spoolFile(key))
 	if err != nil {
 		return err
 	}
 	// ⚠️ inverse error checks
-	_, err = value.WriteTo(f)
+	err = writeValue(f)
 	if err == nil {
 		err = f.Sync()
 	}
+	return dir.commit(key, f, err)
+}
+
+// Commit closes a spool file, and it replaces the previous value, if any, on
+// success only. Any error from the write is passed with err.
+func (dir fileSystem) commit(key uint, f *os.File, err error) error {
 	closeErr := f.Close()
 	if closeErr != nil {
 		if err == nil {
@@ -351,6 +435,73 @@ func (dir fileSystem) Save(key uint, value net.Buffers) error {
 	return err
 }
 
+// BatchFileMax limits the number of spool files open in a saveBatch.
+const batchFileMax = 64
+
+// SaveBatch implements the batchSaver interface. Spool files are written in
+// chunks of batchFileMax before their sync, such that storage can combine the
+// flushes. The renames get one sync on the directory.
+func (dir fileSystem) saveBatch(keys []uint, values []net.Buffers) []error {
+	errs := make([]error, len(keys))
+	var renamed []int // indices
+	files := make([]*os.File, 0, batchFileMax)
+	for offset := 0; offset < len(keys); offset += batchFileMax {
+		end := offset + batchFileMax
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		files = files[:0]
+		for i := offset; i < end; i++ {
+			f, err := os.Create(dir.spoolFile(keys[i]))
+			if err == nil {
+				_, err = values[i].WriteTo(f)
+			}
+			errs[i] = err
+			files = append(files, f)
+		}
+		for j, f := range files {
+			i := offset + j
+			if f == nil {
+				continue // create error
+			}
+			if errs[i] == nil {
+				errs[i] = f.Sync()
+			}
+			errs[i] = dir.commit(keys[i], f, errs[i])
+			if errs[i] == nil {
+				renamed = append(renamed, i)
+			}
+		}
+	}
+
+	if len(renamed) != 0 {
+		if err := syncDir(string(dir)); err != nil {
+			for _, i := range renamed {
+				errs[i] = fmt.Errorf("mqtt: directory sync: %w", err)
+			}
+		}
+	}
+	return errs
+}
+
+// Open implements the Spooler interface.
+func (dir fileSystem) Open(key uint) (value io.ReadCloser, size int, err error) {
+	f, err := os.Open(dir.file(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, int(info.Size()), nil
+}
+
 // Delete implements the Persistence interface.
 func (dir fileSystem) Delete(key uint) error {
 	err := os.Remove(dir.file(key))
@@ -405,11 +556,8 @@ func (r *ruggedPersistence) Load(key uint) ([]byte, error) {
 	if value == nil {
 		return nil, nil
 	}
-	value, _, ok := decodeValue(value)
-	if !ok {
-		return nil, fmt.Errorf("mqtt: persistence value from key %#x corrupt", key)
-	}
-	return value, nil
+	value, _, _, err = decodeValue(key, value)
+	return value, err
 }
 
 // Save implements the Persistence interface.
@@ -417,26 +565,217 @@ func (r *ruggedPersistence) Save(key uint, value net.Buffers) error {
 	return r.Persistence.Save(key, encodeValue(value, atomic.AddUint64(&r.seqNo, 1)))
 }
 
-func encodeValue(packet net.Buffers, seqNo uint64) net.Buffers {
-	digest := fnv.New32a()
-	for _, buf := range packet {
-		digest.Write(buf)
+// SaveFrom implements the Spooler interface. The delegate must support Spooler.
+func (r *ruggedPersistence) SaveFrom(key uint, value io.Reader, size int) error {
+	s, ok := r.Persistence.(Spooler)
+	if !ok {
+		return errNoSpooler
+	}
+	e := &valueEncoder{
+		r:      io.LimitReader(value, int64(size)),
+		digest: crc32.New(castagnoli),
+		seqNo:  atomic.AddUint64(&r.seqNo, 1),
+	}
+	return s.SaveFrom(key, e, size+12)
+}
+
+// Open implements the Spooler interface. The delegate must support Spooler.
+// Integrity errors appear on the last read.
+func (r *ruggedPersistence) Open(key uint) (value io.ReadCloser, size int, err error) {
+	s, ok := r.Persistence.(Spooler)
+	if !ok {
+		return nil, 0, errNoSpooler
+	}
+	value, size, err = s.Open(key)
+	if err != nil || value == nil {
+		return value, size, err
+	}
+	if size < 12 {
+		value.Close()
+		return nil, 0, truncatedValue(key)
+	}
+	return &valueDecoder{
+		ReadCloser:   value,
+		key:          key,
+		remaining:    size - 12,
+		digest:       crc32.New(castagnoli),
+		legacyDigest: fnv.New32a(),
+	}, size - 12, nil
+}
+
+// ValueEncoder is the streaming equivalent of encodeValue.
+type valueEncoder struct {
+	r       io.Reader
+	digest  hash.Hash32
+	seqNo   uint64
+	trailer []byte // pending after EOF from r
+}
+
+// Read implements the io.Reader interface.
+func (e *valueEncoder) Read(p []byte) (n int, err error) {
+	if e.trailer == nil {
+		n, err = e.r.Read(p)
+		e.digest.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+
+		var buf [12]byte
+		binary.LittleEndian.PutUint64(buf[:8], e.seqNo)
+		buf[7] = envelopeCRC32C
+		e.digest.Write(buf[:8])
+		binary.BigEndian.PutUint32(buf[8:], e.digest.Sum32())
+		e.trailer = buf[:]
+		if n != 0 {
+			return n, nil
+		}
+	}
+
+	if len(e.trailer) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(p, e.trailer)
+	e.trailer = e.trailer[n:]
+	return n, nil
+}
+
+// ValueDecoder is the streaming equivalent of decodeValue.
+type valueDecoder struct {
+	io.ReadCloser
+	key       uint // for error reporting
+	remaining int  // number of bytes before the trailer
+
+	digest       hash.Hash32 // envelopeCRC32C
+	legacyDigest hash.Hash32 // envelopeFNV
+}
+
+// Read implements the io.Reader interface. The last read with content fails
+// on integrity violation, in which case the content is withheld.
+func (d *valueDecoder) Read(p []byte) (n int, err error) {
+	if d.remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err = d.ReadCloser.Read(p)
+	d.digest.Write(p[:n])
+	d.legacyDigest.Write(p[:n])
+	d.remaining -= n
+	if err == io.EOF && d.remaining != 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil || d.remaining != 0 {
+		return n, err
+	}
+
+	var trailer [12]byte
+	switch _, err := io.ReadFull(d.ReadCloser, trailer[:]); err {
+	case nil:
+		break
+	case io.EOF, io.ErrUnexpectedEOF:
+		return 0, truncatedValue(d.key)
+	default:
+		return 0, fmt.Errorf("mqtt: persistence value from key %#x trailer: %w", d.key, err)
+	}
+	digest := d.digest
+	switch trailer[7] {
+	case envelopeCRC32C:
+		break
+	case envelopeFNV:
+		digest = d.legacyDigest
+	default:
+		return 0, unknownEnvelope(d.key, trailer[7])
 	}
+	digest.Write(trailer[:8])
+	if got, want := digest.Sum32(), binary.BigEndian.Uint32(trailer[8:]); got != want {
+		return 0, &CorruptionError{Key: d.key, Want: want, Got: got}
+	}
+	return n, nil
+}
+
+// Record envelope versions reside in the most significant byte of the sequence
+// number, which is never reached by any count.
+const (
+	envelopeFNV    = 0 // legacy FNV-1a digest
+	envelopeCRC32C = 1 // CRC-32C (Castagnoli) digest
+)
+
+// CorruptionError is an integrity violation of a Persistence record. Records
+// without a digest mismatch have a Reason instead.
+type CorruptionError struct {
+	Key    uint   // Persistence key
+	Want   uint32 // digest from the record
+	Got    uint32 // digest of the content
+	Reason string // description other than a digest mismatch, if any
+}
+
+// Error implements the standard error interface.
+func (e *CorruptionError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("mqtt: persistence value from key %#x corrupt; %s", e.Key, e.Reason)
+	}
+	return fmt.Sprintf("mqtt: persistence value from key %#x corrupt; got digest %#08x, want %#08x", e.Key, e.Got, e.Want)
+}
+
+func unknownEnvelope(key uint, version byte) error {
+	return &CorruptionError{Key: key, Reason: fmt.Sprintf("unknown envelope version %d", version)}
+}
+
+func truncatedValue(key uint) error {
+	return &CorruptionError{Key: key, Reason: "record truncated"}
+}
+
+// EncodeValue appends a trailer with the sequence number and a digest, in the
+// envelopeCRC32C format.
+func encodeValue(packet net.Buffers, seqNo uint64) net.Buffers {
 	var buf [12]byte
 	binary.LittleEndian.PutUint64(buf[:8], seqNo)
-	digest.Write(buf[:8])
-	binary.BigEndian.PutUint32(buf[8:], digest.Sum32())
-	return append(packet, buf[:])
+	buf[7] = envelopeCRC32C
+	var digest uint32
+	for _, p := range packet {
+		digest = crc32.Update(digest, castagnoli, p)
+	}
+	digest = crc32.Update(digest, castagnoli, buf[:8])
+	binary.BigEndian.PutUint32(buf[8:], digest)
+	// The packet may have spare capacity, which is shared with the caller.
+	// Save implementations may consume the buffers, as in net.Buffers WriteTo.
+	return append(packet[:len(packet):len(packet)], buf[:])
 }
 
-func decodeValue(buf []byte) (packet []byte, seqNo uint64, ok bool) {
+// DecodeValue verifies the trailer of a record in any of the envelope formats.
+// Any error is a *CorruptionError.
+func decodeValue(key uint, buf []byte) (packet []byte, seqNo uint64, version byte, err error) {
 	if len(buf) < 12 {
-		return nil, 0, false
+		return nil, 0, 0, truncatedValue(key)
 	}
-	digest := fnv.New32a()
-	digest.Write(buf[:len(buf)-4])
-	if digest.Sum32() != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
-		return nil, 0, false
+	trailer := buf[len(buf)-12:]
+	version = trailer[7]
+
+	var got uint32
+	switch version {
+	case envelopeCRC32C:
+		got = crc32.Checksum(buf[:len(buf)-4], castagnoli)
+	case envelopeFNV:
+		digest := fnv.New32a()
+		digest.Write(buf[:len(buf)-4])
+		got = digest.Sum32()
+	default:
+		return nil, 0, version, unknownEnvelope(key, version)
 	}
-	return buf[:len(buf)-12], binary.LittleEndian.Uint64(buf[len(buf)-12:]), true
+	if want := binary.BigEndian.Uint32(trailer[8:]); got != want {
+		return nil, 0, version, &CorruptionError{Key: key, Want: want, Got: got}
+	}
+
+	seqNo = binary.LittleEndian.Uint64(trailer) &^ (0xff << 56)
+	return buf[:len(buf)-12], seqNo, version, nil
+}
+
+// MigrateValue rewrites a record from a legacy envelope in the current format.
+func migrateValue(p Persistence, key uint, packet []byte, seqNo uint64) error {
+	err := p.Save(key, encodeValue(net.Buffers{packet}, seqNo))
+	if err != nil {
+		return fmt.Errorf("mqtt: persistence value from key %#x not migrated: %w", key, err)
+	}
+	return nil
 }
@@ -3,9 +3,10 @@ package mqtt
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
+	"hash/fnv"
 	"net"
-	"sort"
 	"testing"
 )
 
@@ -46,164 +47,124 @@ func TestNewCONNREQ(t *testing.T) {
 	}
 }
 
-func TestPesistenceEmpty(t *testing.T) {
-	t.Run("volatile", func(t *testing.T) {
-		testPersistenceEmpty(t, newVolatile())
-	})
-	t.Run("fileSystem", func(t *testing.T) {
-		testPersistenceEmpty(t, FileSystem(t.TempDir()))
-	})
-}
-
-func testPersistenceEmpty(t *testing.T, p Persistence) {
-	if data, err := p.Load(42); err != nil {
-		t.Error("Load got error:", err)
-	} else if data != nil {
-		t.Errorf("Load got %#x, want nil", data)
-	}
-
-	if err := p.Delete(42); err != nil {
-		t.Error("Delete got error:", err)
+func TestNewCONNREQ3(t *testing.T) {
+	c := &Config{
+		Dialer: func(context.Context) (net.Conn, error) {
+			return nil, errors.New("dialer call not allowed for test")
+		},
+		ProtocolLevel: 3,
+		CleanSession:  true,
+		KeepAlive:     60,
 	}
 
-	if keys, err := p.List(); err != nil {
-		t.Error("List got error:", err)
-	} else if len(keys) != 0 {
-		t.Errorf("List got keys %d", keys)
+	got := c.newCONNREQ([]byte("x"))
+	want := []byte{0x10, 15, 0, 6, 'M', 'Q', 'I', 's', 'd', 'p', 3, 0b0000_0010, 0, 60,
+		0, 1, 'x'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %#x, want %#x", got, want)
 	}
 }
 
-func TestPersistence(t *testing.T) {
-	t.Run("volatile", func(t *testing.T) {
-		testPersistence(t, newVolatile())
-	})
-	t.Run("fileSystem", func(t *testing.T) {
-		testPersistence(t, FileSystem(t.TempDir()))
-	})
-}
-
-func testPersistence(t *testing.T, p Persistence) {
-	for i := 0; i < 3; i++ {
-		bufs := make(net.Buffers, i+1)
-		for j := range bufs {
-			bufs[j] = make([]byte, j+1)
-			for k := range bufs[j] {
-				bufs[j][k] = byte('a' + k)
-			}
-		}
-
-		err := p.Save(uint(i), bufs)
-		if err != nil {
-			t.Errorf("Save %d got error: %s", i, err)
-		}
+func TestNewCONNREQ5(t *testing.T) {
+	c := &Config{
+		Dialer: func(context.Context) (net.Conn, error) {
+			return nil, errors.New("dialer call not allowed for test")
+		},
+		ProtocolLevel: 5,
+	}
+	c.Will.Topic = "t"
+	c.Will.Message = []byte("m")
+
+	got := c.newCONNREQ([]byte("x"))
+	want := []byte{0x10, 26, 0, 4, 'M', 'Q', 'T', 'T', 5, 0b0000_0100, 0, 0,
+		5, 0x11, 0xff, 0xff, 0xff, 0xff, // session expiry
+		0, 1, 'x',
+		0, // will properties
+		0, 1, 't',
+		0, 1, 'm'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %#x, want %#x", got, want)
 	}
+}
 
-	if keys, err := p.List(); err != nil {
-		t.Error("List got error:", err)
-	} else {
-		// order undefined
-		ints := make([]int, len(keys))
-		for i := range keys {
-			ints[i] = int(keys[i])
-		}
-		sort.Ints(ints)
-		if len(ints) != 3 || ints[0] != 0 || ints[1] != 1 || ints[2] != 2 {
-			t.Errorf("List got %d, want %d", ints, []int{0, 1, 2})
+func TestAdoptSessionEnvelopes(t *testing.T) {
+	// legacy format
+	encodeFNV := func(packet []byte, seqNo uint64) []byte {
+		value := append(packet, make([]byte, 12)...)
+		binary.LittleEndian.PutUint64(value[len(packet):], seqNo)
+		digest := fnv.New32a()
+		digest.Write(value[:len(value)-4])
+		binary.BigEndian.PutUint32(value[len(value)-4:], digest.Sum32())
+		return value
+	}
+
+	p := FileSystem(t.TempDir())
+	records := map[uint][]byte{
+		clientIDKey: encodeFNV([]byte("test-client"), 1),
+		0x8000:      encodeFNV([]byte{0x32, 6, 0, 1, 'x', 0x80, 0x00, '1'}, 2),
+		0x8001:      encodeFNV([]byte{0x32, 6, 0, 1, 'x', 0x80, 0x01, '2'}, 3),
+	}
+	records[0x8001][7] ^= 0xff // corrupt payload
+	for key, value := range records {
+		if err := p.Save(key, net.Buffers{value}); err != nil {
+			t.Fatal("Save error:", err)
 		}
 	}
 
-	if data, err := p.Load(0); err != nil {
-		t.Error("Load 0 got error:", err)
-	} else if want := "a"; string(data) != want {
-		t.Errorf("Load 0 got %q, want %q", data, want)
-	}
-	if data, err := p.Load(1); err != nil {
-		t.Error("Load 1 got error:", err)
-	} else if want := "aab"; string(data) != want {
-		t.Errorf("Load 1 got %q, want %q", data, want)
-	}
-	if data, err := p.Load(2); err != nil {
-		t.Error("Load 2 got error:", err)
-	} else if want := "aababc"; string(data) != want {
-		t.Errorf("Load 2 got %q, want %q", data, want)
-	}
-}
-
-func TestPersistenceUpdate(t *testing.T) {
-	t.Run("volatile", func(t *testing.T) {
-		testPersistenceUpdate(t, newVolatile())
-	})
-	t.Run("fileSystem", func(t *testing.T) {
-		testPersistenceUpdate(t, FileSystem(t.TempDir()))
+	client, warn, err := AdoptSession(p, &Config{
+		Dialer: func(context.Context) (net.Conn, error) {
+			return nil, errors.New("dialer call not allowed for test")
+		},
+		AtLeastOnceMax: 2,
 	})
-}
-
-func testPersistenceUpdate(t *testing.T, p Persistence) {
-	err := p.Save(0, net.Buffers{[]byte("ab"), []byte("cd")})
 	if err != nil {
-		t.Fatal("Save new 0 got error:", err)
+		t.Fatal("AdoptSession error:", err)
 	}
-	err = p.Save(42, net.Buffers{[]byte("ef")})
-	if err != nil {
-		t.Fatal("Save new 42 got error:", err)
+	defer client.Close()
+
+	if len(warn) != 1 {
+		t.Fatalf("got warnings %q, want 1 on corruption", warn)
 	}
-	err = p.Save(0, net.Buffers{[]byte("12")})
-	if err != nil {
-		t.Fatal("Save update 0 got error:", err)
+	var e *CorruptionError
+	if !errors.As(warn[0], &e) {
+		t.Fatalf("got warning %q, want a CorruptionError", warn[0])
 	}
-	err = p.Save(42, net.Buffers{[]byte("34"), []byte("56")})
-	if err != nil {
-		t.Fatal("Save update 42 got error:", err)
+	if e.Key != 0x8001 || e.Want == e.Got {
+		t.Errorf("got CorruptionError %+v, want key 0x8001 with digest mismatch", e)
 	}
 
-	if data, err := p.Load(0); err != nil {
-		t.Error("Load 0 got error:", err)
-	} else if want := "12"; string(data) != want {
-		t.Errorf("Load 0 got %#v, want %#v", data, want)
-	}
-	if data, err := p.Load(42); err != nil {
-		t.Error("Load 42 got error:", err)
-	} else if want := "3456"; string(data) != want {
-		t.Errorf("Load 42 got %#v, want %#v", data, want)
+	for _, key := range []uint{clientIDKey, 0x8000} {
+		value, err := p.Load(key)
+		if err != nil {
+			t.Fatal("Load error:", err)
+		}
+		_, seqNo, version, err := decodeValue(key, value)
+		if err != nil {
+			t.Errorf("record %#x after migration: %s", key, err)
+		} else if version != envelopeCRC32C {
+			t.Errorf("record %#x got envelope version %d after migration, want %d", key, version, envelopeCRC32C)
+		} else if want := records[key][len(records[key])-12]; seqNo != uint64(want) {
+			t.Errorf("record %#x got sequence number %d after migration, want %d", key, seqNo, want)
+		}
 	}
 }
 
-func TestPersistenceDelete(t *testing.T) {
-	t.Run("volatile", func(t *testing.T) {
-		testPersistenceDelete(t, newVolatile())
-	})
-	t.Run("fileSystem", func(t *testing.T) {
-		testPersistenceDelete(t, FileSystem(t.TempDir()))
-	})
-}
-
-func testPersistenceDelete(t *testing.T, p Persistence) {
-	err := p.Save(0, net.Buffers{[]byte("ab"), []byte("cd")})
-	if err != nil {
-		t.Fatal("Save new 0 got error:", err)
-	}
-	err = p.Save(42, net.Buffers{[]byte("ef")})
-	if err != nil {
-		t.Fatal("Save new 42 got error:", err)
-	}
-	err = p.Save(42, net.Buffers{[]byte("gh")})
-	if err != nil {
-		t.Fatal("Save update 42 got error:", err)
-	}
-	err = p.Save(99, net.Buffers{[]byte("ij")})
-	if err != nil {
-		t.Fatal("Save new 99 got error:", err)
-	}
-
-	if err := p.Delete(42); err != nil {
-		t.Error("Delete 42 got error:", err)
-	}
-	if err := p.Delete(0); err != nil {
-		t.Error("Delete 0 got error:", err)
-	}
-	if keys, err := p.List(); err != nil {
-		t.Error("List got error:", err)
-	} else if len(keys) != 1 || keys[0] != 99 {
-		t.Errorf("List got %d, want %d", keys, []uint{99})
+func TestDecodeValueCorruption(t *testing.T) {
+	unknownVersion := encodeValue(net.Buffers{[]byte{0x32, 6, 0, 1, 'x', 0x80, 0x00, '1'}}, 2)
+	unknownVersion[1][7] = 0x7f
+
+	golden := map[string][]byte{
+		"empty":          {},
+		"short":          make([]byte, 11),
+		"unknownVersion": append(unknownVersion[0], unknownVersion[1]...),
+	}
+	for name, value := range golden {
+		_, _, _, err := decodeValue(0x8000, value)
+		var e *CorruptionError
+		if !errors.As(err, &e) {
+			t.Errorf("%s: got error %v, want a CorruptionError", name, err)
+		} else if e.Key != 0x8000 || e.Reason == "" {
+			t.Errorf("%s: got CorruptionError %+v, want key 0x8000 with a reason", name, e)
+		}
 	}
 }
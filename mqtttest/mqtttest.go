@@ -20,19 +20,22 @@ type Transfer struct {
 
 // NewReadSlicesStub returns a new stub for mqtt.Client ReadSlices with a fixed
 // return value.
-func NewReadSlicesStub(fix Transfer) func() (message, topic []byte, err error) {
-	return func() (message, topic []byte, err error) {
+func NewReadSlicesStub(fix Transfer) func() (message, topic []byte, ack func(), err error) {
+	return func() (message, topic []byte, ack func(), err error) {
+		if fix.Err != nil {
+			return nil, nil, nil, fix.Err
+		}
 		// use copies to prevent some hard to trace issues
 		message = make([]byte, len(fix.Message))
 		copy(message, fix.Message)
 		topic = []byte(fix.Topic)
-		return message, topic, fix.Err
+		return message, topic, func() {}, nil
 	}
 }
 
 // NewReadSlicesMock returns a new mock for mqtt.Client ReadSlices, which
 // returns the Transfers in order of appearance.
-func NewReadSlicesMock(t testing.TB, want ...Transfer) func() (message, topic []byte, err error) {
+func NewReadSlicesMock(t testing.TB, want ...Transfer) func() (message, topic []byte, ack func(), err error) {
 	t.Helper()
 
 	var wantIndex uint64
@@ -45,7 +48,7 @@ func NewReadSlicesMock(t testing.TB, want ...Transfer) func() (message, topic []
 		}
 	})
 
-	return func() (message, topic []byte, err error) {
+	return func() (message, topic []byte, ack func(), err error) {
 		t.Helper()
 
 		i := atomic.AddUint64(&wantIndex, 1) - 1
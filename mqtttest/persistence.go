@@ -0,0 +1,435 @@
+package mqtttest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+// PersistenceFactory allocates new storage for use in a test, and it returns
+// the function to open an instance on that storage. Each open after the first
+// must continue with the content, as if the process restarted. The factory is
+// responsible for any cleanup, e.g., with t.Cleanup.
+type PersistenceFactory func(t *testing.T) (open func() mqtt.Persistence)
+
+// LargeValueSize exceeds the maximum packet size, plus some overhead.
+const largeValueSize = 256<<20 + 17
+
+// VerifyPersistence runs a Persistence implementation through the conformance
+// tests, each with a new instance from factory. The value of 256 MiB + 17 B is
+// omitted in short mode [testing.Short].
+//
+// The crash test injects faults with a FaultyPersistence, and it continues
+// with a new instance from the open function. Instances which implement
+// io.Closer are closed before the new instance opens.
+func VerifyPersistence(t *testing.T, factory PersistenceFactory) {
+	t.Run("empty", func(t *testing.T) {
+		verifyPersistenceEmpty(t, factory(t)())
+	})
+	t.Run("save", func(t *testing.T) {
+		verifyPersistenceSave(t, factory(t)())
+	})
+	t.Run("update", func(t *testing.T) {
+		verifyPersistenceUpdate(t, factory(t)())
+	})
+	t.Run("delete", func(t *testing.T) {
+		verifyPersistenceDelete(t, factory(t)())
+	})
+	t.Run("keyRange", func(t *testing.T) {
+		verifyPersistenceKeyRange(t, factory(t)())
+	})
+	t.Run("concurrency", func(t *testing.T) {
+		verifyPersistenceConcurrency(t, factory(t)())
+	})
+	t.Run("large", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("large value omitted in short mode")
+		}
+		verifyPersistenceLarge(t, factory(t)())
+	})
+	t.Run("spooler", func(t *testing.T) {
+		p := factory(t)()
+		s, ok := p.(mqtt.Spooler)
+		if !ok {
+			t.Skipf("%T has no Spooler", p)
+		}
+		verifyPersistenceSpooler(t, p, s)
+	})
+	t.Run("crash", func(t *testing.T) {
+		verifyPersistenceCrash(t, factory(t))
+	})
+}
+
+// WantValue checks the content of a key, with nil for absent.
+func wantValue(t *testing.T, p mqtt.Persistence, key uint, want []byte) {
+	t.Helper()
+	got, err := p.Load(key)
+	switch {
+	case err != nil:
+		t.Errorf("Load %#x got error: %s", key, err)
+	case want == nil && got != nil:
+		t.Errorf("Load %#x got %q, want nil", key, got)
+	case want != nil && !bytes.Equal(got, want):
+		t.Errorf("Load %#x got %q, want %q", key, got, want)
+	}
+}
+
+// WantKeys checks the List content, in any order.
+func wantKeys(t *testing.T, p mqtt.Persistence, want ...uint) {
+	t.Helper()
+	got, err := p.List()
+	if err != nil {
+		t.Error("List got error:", err)
+		return
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("List got %#x, want %#x", got, want)
+	}
+}
+
+func verifyPersistenceEmpty(t *testing.T, p mqtt.Persistence) {
+	wantValue(t, p, 42, nil)
+	if err := p.Delete(42); err != nil {
+		t.Error("Delete absent got error:", err)
+	}
+	wantKeys(t, p)
+}
+
+func verifyPersistenceSave(t *testing.T, p mqtt.Persistence) {
+	for i := 0; i < 3; i++ {
+		bufs := make(net.Buffers, i+1)
+		for j := range bufs {
+			bufs[j] = []byte("abc"[:j+1])
+		}
+		if err := p.Save(uint(i), bufs); err != nil {
+			t.Errorf("Save %d got error: %s", i, err)
+		}
+	}
+	// zero length buffers
+	if err := p.Save(3, net.Buffers{nil, []byte{}}); err != nil {
+		t.Error("Save empty got error:", err)
+	}
+
+	wantKeys(t, p, 0, 1, 2, 3)
+	wantValue(t, p, 0, []byte("a"))
+	wantValue(t, p, 1, []byte("aab"))
+	wantValue(t, p, 2, []byte("aababc"))
+	wantValue(t, p, 3, []byte{})
+}
+
+func verifyPersistenceUpdate(t *testing.T, p mqtt.Persistence) {
+	for _, save := range []struct {
+		key   uint
+		value net.Buffers
+	}{
+		{0, net.Buffers{[]byte("ab"), []byte("cd")}},
+		{42, net.Buffers{[]byte("ef")}},
+		{0, net.Buffers{[]byte("12")}},
+		{42, net.Buffers{[]byte("34"), []byte("56")}},
+	} {
+		if err := p.Save(save.key, save.value); err != nil {
+			t.Fatalf("Save %#x got error: %s", save.key, err)
+		}
+	}
+
+	wantKeys(t, p, 0, 42)
+	wantValue(t, p, 0, []byte("12"))
+	wantValue(t, p, 42, []byte("3456"))
+}
+
+func verifyPersistenceDelete(t *testing.T, p mqtt.Persistence) {
+	for _, key := range []uint{0, 42, 42, 99} {
+		if err := p.Save(key, net.Buffers{[]byte("v")}); err != nil {
+			t.Fatalf("Save %#x got error: %s", key, err)
+		}
+	}
+	for _, key := range []uint{42, 0, 42} {
+		if err := p.Delete(key); err != nil {
+			t.Errorf("Delete %#x got error: %s", key, err)
+		}
+	}
+
+	wantKeys(t, p, 99)
+	wantValue(t, p, 0, nil)
+	wantValue(t, p, 42, nil)
+	wantValue(t, p, 99, []byte("v"))
+}
+
+func verifyPersistenceKeyRange(t *testing.T, p mqtt.Persistence) {
+	// boundaries of the address spaces in use
+	keys := []uint{0, 1, 2, 0x3fff, 0x4000, 0x7fff, 0x8000, 0xbfff, 0xc000, 0xffff,
+		0x10000, 0x18000, 0x1c000, 0x1ffff}
+	for _, key := range keys {
+		if err := p.Save(key, net.Buffers{[]byte(fmt.Sprintf("%#x", key))}); err != nil {
+			t.Errorf("Save %#x got error: %s", key, err)
+		}
+	}
+
+	wantKeys(t, p, keys...)
+	for _, key := range keys {
+		wantValue(t, p, key, []byte(fmt.Sprintf("%#x", key)))
+	}
+}
+
+func verifyPersistenceConcurrency(t *testing.T, p mqtt.Persistence) {
+	const routineN, saveN = 8, 20
+
+	var wg sync.WaitGroup
+	for r := 0; r < routineN; r++ {
+		wg.Add(1)
+		go func(r uint) {
+			defer wg.Done()
+			// keys per routine
+			kept, dropped := 0x8000|r, 0xc000|r
+			for i := 0; i < saveN; i++ {
+				value := []byte(fmt.Sprintf("%d/%d", r, i))
+				if err := p.Save(kept, net.Buffers{value}); err != nil {
+					t.Errorf("Save %#x got error: %s", kept, err)
+					return
+				}
+				if err := p.Save(dropped, net.Buffers{value}); err != nil {
+					t.Errorf("Save %#x got error: %s", dropped, err)
+					return
+				}
+				if got, err := p.Load(kept); err != nil {
+					t.Errorf("Load %#x got error: %s", kept, err)
+				} else if !bytes.Equal(got, value) {
+					t.Errorf("Load %#x got %q, want %q", kept, got, value)
+				}
+				if err := p.Delete(dropped); err != nil {
+					t.Errorf("Delete %#x got error: %s", dropped, err)
+				}
+				if _, err := p.List(); err != nil {
+					t.Error("List got error:", err)
+				}
+			}
+		}(uint(r))
+	}
+	wg.Wait()
+
+	var want []uint
+	for r := uint(0); r < routineN; r++ {
+		want = append(want, 0x8000|r)
+		wantValue(t, p, 0x8000|r, []byte(fmt.Sprintf("%d/%d", r, saveN-1)))
+	}
+	wantKeys(t, p, want...)
+}
+
+func verifyPersistenceLarge(t *testing.T, p mqtt.Persistence) {
+	// chunks share memory
+	chunk := make([]byte, 1<<20)
+	for i := range chunk {
+		chunk[i] = byte(i % 251)
+	}
+	var value net.Buffers
+	for n := 0; n < largeValueSize; n += len(value[len(value)-1]) {
+		if largeValueSize-n < len(chunk) {
+			value = append(value, chunk[:largeValueSize-n])
+		} else {
+			value = append(value, chunk)
+		}
+	}
+
+	if err := p.Save(0x8000, value); err != nil {
+		t.Fatal("Save got error:", err)
+	}
+	got, err := p.Load(0x8000)
+	if err != nil {
+		t.Fatal("Load got error:", err)
+	}
+	if len(got) != largeValueSize {
+		t.Fatalf("Load got %d bytes, want %d", len(got), largeValueSize)
+	}
+	for i := 0; i < len(got); i += len(chunk) {
+		end := i + len(chunk)
+		if end > len(got) {
+			end = len(got)
+		}
+		if !bytes.Equal(got[i:end], chunk[:end-i]) {
+			t.Fatalf("Load got wrong content in bytes %d–%d", i, end)
+		}
+	}
+}
+
+func verifyPersistenceSpooler(t *testing.T, p mqtt.Persistence, s mqtt.Spooler) {
+	if err := s.SaveFrom(42, strings.NewReader("hello"), 5); err != nil {
+		t.Fatal("SaveFrom got error:", err)
+	}
+	if err := s.SaveFrom(99, strings.NewReader("abc"), 5); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("SaveFrom with short reader got error %v, want io.ErrUnexpectedEOF", err)
+	}
+	wantValue(t, p, 42, []byte("hello"))
+	wantValue(t, p, 99, nil)
+
+	value, size, err := s.Open(42)
+	if err != nil {
+		t.Fatal("Open got error:", err)
+	}
+	defer value.Close()
+	if size != 5 {
+		t.Errorf("Open got size %d, want 5", size)
+	}
+	if got, err := io.ReadAll(value); err != nil {
+		t.Error("read got error:", err)
+	} else if string(got) != "hello" {
+		t.Errorf("read got %q, want %q", got, "hello")
+	}
+
+	if value, _, err := s.Open(7); err != nil {
+		t.Error("Open absent key got error:", err)
+	} else if value != nil {
+		t.Error("Open absent key got a value")
+		value.Close()
+	}
+}
+
+func verifyPersistenceCrash(t *testing.T, open func() mqtt.Persistence) {
+	p := NewFaultyPersistence(open())
+	if err := p.Save(1, net.Buffers{[]byte("kept")}); err != nil {
+		t.Fatal("Save got error:", err)
+	}
+	if err := p.Save(2, net.Buffers{[]byte("deleted")}); err != nil {
+		t.Fatal("Save got error:", err)
+	}
+	if err := p.Save(3, net.Buffers{[]byte("old")}); err != nil {
+		t.Fatal("Save got error:", err)
+	}
+	if err := p.Delete(2); err != nil {
+		t.Fatal("Delete got error:", err)
+	}
+	if err := p.Save(1, net.Buffers{[]byte("updated")}); err != nil {
+		t.Fatal("Save got error:", err)
+	}
+
+	p.TearNext(len("new "))
+	if err := p.Save(3, net.Buffers{[]byte("new "), []byte("value")}); !errors.Is(err, ErrFault) {
+		t.Errorf("Save with tear got error %v, want ErrFault", err)
+	}
+	p.FailNext()
+	if err := p.Save(4, net.Buffers{[]byte("failed")}); !errors.Is(err, ErrFault) {
+		t.Errorf("Save with fault got error %v, want ErrFault", err)
+	}
+	p.FailNext()
+	if err := p.Delete(1); !errors.Is(err, ErrFault) {
+		t.Errorf("Delete with fault got error %v, want ErrFault", err)
+	}
+	// before restart
+	wantKeys(t, p, 1, 3)
+	wantValue(t, p, 3, []byte("old"))
+
+	if c, ok := p.Persistence.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			t.Error("Close got error:", err)
+		}
+	}
+
+	// restart
+	p = NewFaultyPersistence(open())
+	wantKeys(t, p, 1, 3)
+	wantValue(t, p, 1, []byte("updated"))
+	wantValue(t, p, 3, []byte("old"))
+
+	// operational after recovery
+	if err := p.Save(4, net.Buffers{[]byte("recovered")}); err != nil {
+		t.Error("Save after recovery got error:", err)
+	}
+	wantValue(t, p, 4, []byte("recovered"))
+}
+
+// ErrFault is the error of faults injected by a FaultyPersistence.
+var ErrFault = errors.New("mqtttest: fault injected")
+
+// FaultyPersistence passes all operations to Persistence, except for the faults
+// on demand. Each fault applies to the next Save or Delete only. The Spooler
+// extension of Persistence is not passed.
+type FaultyPersistence struct {
+	mqtt.Persistence // delegate
+
+	mutex sync.Mutex
+	fail  bool // pending fault
+	tear  int  // pending fault when not negative
+}
+
+// NewFaultyPersistence returns a delegate of p without faults pending.
+func NewFaultyPersistence(p mqtt.Persistence) *FaultyPersistence {
+	return &FaultyPersistence{Persistence: p, tear: -1}
+}
+
+// FailNext makes the next Save or Delete return ErrFault, without any effect
+// on Persistence.
+func (p *FaultyPersistence) FailNext() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.fail = true
+}
+
+// TearNext makes the next Save abort after n bytes of the value, with ErrFault.
+// Persistence receives the value through its Spooler extension, from a reader
+// which fails after n bytes. Persistence without Spooler receives nothing. The
+// next Delete is not affected.
+func (p *FaultyPersistence) TearNext(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.tear = n
+}
+
+// Save implements the mqtt.Persistence interface.
+func (p *FaultyPersistence) Save(key uint, value net.Buffers) error {
+	p.mutex.Lock()
+	fail, tear := p.fail, p.tear
+	p.fail, p.tear = false, -1
+	p.mutex.Unlock()
+
+	if fail {
+		return ErrFault
+	}
+	if tear < 0 {
+		return p.Persistence.Save(key, value)
+	}
+
+	s, ok := p.Persistence.(mqtt.Spooler)
+	if !ok {
+		return ErrFault
+	}
+	var size int
+	for _, buf := range value {
+		size += len(buf)
+	}
+	if tear >= size {
+		return ErrFault // nothing to tear
+	}
+	r := io.MultiReader(io.LimitReader(&value, int64(tear)), faultReader{})
+	if err := s.SaveFrom(key, r, size); err != nil {
+		return err
+	}
+	return errors.New("mqtttest: SaveFrom succeeded with a reader fault")
+}
+
+// Delete implements the mqtt.Persistence interface.
+func (p *FaultyPersistence) Delete(key uint) error {
+	p.mutex.Lock()
+	fail := p.fail
+	p.fail = false
+	p.mutex.Unlock()
+
+	if fail {
+		return ErrFault
+	}
+	return p.Persistence.Delete(key)
+}
+
+// FaultReader fails with ErrFault.
+type faultReader struct{}
+
+// Read implements the io.Reader interface.
+func (faultReader) Read([]byte) (int, error) { return 0, ErrFault }
@@ -0,0 +1,188 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pascaldekloe/mqtt/topics"
+)
+
+// Handler processes an inbound message. Both message and topic are slices from
+// a read buffer. The bytes stop being valid on return. Handlers run from the
+// read routine, which means that they must not wait on any Client requests,
+// e.g., Subscribe, as those need the read routine for their response.
+type Handler func(message, topic []byte)
+
+// ServeMux dispatches inbound messages to handlers by topic filter. Messages go
+// to each matching filter in order of registration. Reception is acknowledged
+// once all of the handlers returned. Messages without any match are dropped.
+// Register a "#" filter for a catch-all.
+//
+// Multiple goroutines may invoke methods on a ServeMux simultaneously.
+type ServeMux struct {
+	client *Client // read routine owner
+
+	mutex    sync.RWMutex
+	routes   topics.Trie // []route per topic filter
+	routeSeq uint64      // registration counter
+
+	// The read routine buffers trie matches.
+	matchBuf []interface{}
+}
+
+// Route is a registration entry.
+type route struct {
+	handler Handler
+	seqNo   uint64 // unique per ServeMux
+}
+
+// NewServeMux returns a new dispatcher for the Client. Invoke Serve to start.
+func NewServeMux(client *Client) *ServeMux {
+	return &ServeMux{client: client}
+}
+
+// Handle registers a handler for a topic filter, without any subscription.
+func (mux *ServeMux) Handle(topicFilter string, h Handler) error {
+	if err := topics.CheckFilter(topicFilter); err != nil {
+		return fmt.Errorf("mqtt: handle topic filter %q: %w", topicFilter, err)
+	}
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	mux.add(topicFilter, h)
+	return nil
+}
+
+// Subscribe registers a handler for each of the topic filters, and then it
+// subscribes with Client.Subscribe. The handler is registered before the
+// subscription such that no messages are missed. Any error from Subscribe
+// undoes the registration, except for the topic filters which the broker did
+// accept, i.e., those not in a SubscribeError, and except for requests which
+// continue in the background, i.e., ErrAbandoned and ErrBreak. The quit channel
+// is passed as is.
+func (mux *ServeMux) Subscribe(quit <-chan struct{}, h Handler, topicFilters ...string) error {
+	for _, filter := range topicFilters {
+		if err := topics.CheckFilter(filter); err != nil {
+			return fmt.Errorf("mqtt: SUBSCRIBE request denied on topic filter: %w", err)
+		}
+	}
+	mux.mutex.Lock()
+	firstSeqNo := mux.routeSeq + 1
+	for _, filter := range topicFilters {
+		mux.add(filter, h)
+	}
+	lastSeqNo := mux.routeSeq
+	mux.mutex.Unlock()
+
+	err := mux.client.Subscribe(quit, topicFilters...)
+	var failed SubscribeError
+	switch {
+	case err == nil, errors.As(err, new(subscriptionsSaveError)):
+		break // subscribed
+	case errors.Is(err, ErrAbandoned), errors.Is(err, ErrBreak):
+		break // resubmitted on reconnect
+	case errors.As(err, &failed):
+		mux.remove(failed, firstSeqNo, lastSeqNo)
+	default:
+		mux.remove(topicFilters, firstSeqNo, lastSeqNo)
+	}
+	return err
+}
+
+// Add registers a route for a valid topic filter. The mutex must be held.
+func (mux *ServeMux) add(topicFilter string, h Handler) {
+	mux.routeSeq++
+	v, _ := mux.routes.Get(topicFilter)
+	routes, _ := v.([]route)
+	// copy on write, as the read routine may hold the previous slice
+	routes = append(routes[:len(routes):len(routes)], route{h, mux.routeSeq})
+	mux.routes.Put(topicFilter, routes) // valid
+}
+
+// Remove drops the routes within a sequence number range, inclusive.
+func (mux *ServeMux) remove(topicFilters []string, firstSeqNo, lastSeqNo uint64) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	for _, filter := range topicFilters {
+		v, ok := mux.routes.Get(filter)
+		if !ok {
+			continue
+		}
+		var routes []route
+		for _, r := range v.([]route) {
+			if r.seqNo < firstSeqNo || r.seqNo > lastSeqNo {
+				routes = append(routes, r)
+			}
+		}
+		if len(routes) == 0 {
+			mux.routes.Delete(filter)
+		} else {
+			mux.routes.Put(filter, routes) // valid
+		}
+	}
+}
+
+// Serve runs the read routine of the Client until ErrClosed. Messages beyond
+// the read buffer capacity, i.e., BigMessage, are read in full when their size
+// does not exceed bigMessageMax. Zero reads any size. Errors other than ErrClosed
+// go to errHandler, including each BigMessage which exceeds bigMessageMax. The
+// errHandler is optional. Apply a Config.Backoff to pace reconnects.
+func (mux *ServeMux) Serve(bigMessageMax int, errHandler func(error)) {
+	var matches []route
+	var big *BigMessage
+	for {
+		message, topic, ack, err := mux.client.ReadSlices()
+		switch {
+		case err == nil:
+			matches = mux.match(matches[:0], string(topic))
+			for _, r := range matches {
+				r.handler(message, topic)
+			}
+			ack()
+
+		case errors.Is(err, ErrClosed):
+			return
+
+		case errors.As(err, &big):
+			if bigMessageMax != 0 && big.Size > bigMessageMax {
+				break // report
+			}
+			matches = mux.match(matches[:0], big.Topic)
+			if len(matches) == 0 {
+				continue // next ReadSlices discards
+			}
+			message, err = big.ReadAll()
+			if err != nil {
+				break // report
+			}
+			for _, r := range matches {
+				r.handler(message, []byte(big.Topic))
+			}
+			continue // next ReadSlices acknowledges
+		}
+
+		if err != nil && errHandler != nil {
+			errHandler(err)
+		}
+	}
+}
+
+// Match appends the routes with a filter match on topic, in order of
+// registration.
+func (mux *ServeMux) match(dst []route, topic string) []route {
+	mux.mutex.RLock()
+	mux.matchBuf = mux.routes.AppendMatches(mux.matchBuf[:0], topic)
+	mux.mutex.RUnlock()
+
+	for i, v := range mux.matchBuf {
+		dst = append(dst, v.([]route)...)
+		mux.matchBuf[i] = nil // release
+	}
+	// insertion sort on the (few) matches
+	for i := 1; i < len(dst); i++ {
+		for j := i; j > 0 && dst[j].seqNo < dst[j-1].seqNo; j-- {
+			dst[j], dst[j-1] = dst[j-1], dst[j]
+		}
+	}
+	return dst
+}
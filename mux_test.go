@@ -0,0 +1,174 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+func TestServeMux(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	var got []string
+	record := func(name string) mqtt.Handler {
+		return func(message, topic []byte) {
+			if len(message) > 8 {
+				message = []byte(fmt.Sprintf("%d bytes", len(message)))
+			}
+			got = append(got, fmt.Sprintf("%s %s: %s", name, topic, message))
+		}
+	}
+	mux := mqtt.NewServeMux(client)
+	if err := mux.Handle("a/+", record("A")); err != nil {
+		t.Fatal("handle error:", err)
+	}
+	if err := mux.Handle("#", record("all")); err != nil {
+		t.Fatal("handle error:", err)
+	}
+	lastDone := make(chan struct{})
+	if err := mux.Handle("z", func([]byte, []byte) { close(lastDone) }); err != nil {
+		t.Fatal("handle error:", err)
+	}
+	if err := mux.Handle("a/#/b", record("illegal")); err == nil {
+		t.Error("handle got no error for illegal topic filter")
+	}
+
+	serveDone := testRoutine(t, func() {
+		mux.Serve(180_000, func(err error) {
+			var big *mqtt.BigMessage
+			if errors.As(err, &big) {
+				got = append(got, fmt.Sprintf("skip %s: %d bytes", big.Topic, big.Size))
+			} else {
+				t.Error("serve error:", err)
+			}
+		})
+	})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, pipeCONNECTHex)
+		sendPacketHex(t, brokerConn, "20020000") // CONNACK
+		wantPacketHex(t, brokerConn, "820860000003622f2302")
+		sendPacketHex(t, brokerConn, "9003600002") // SUBACK
+	})
+	if err := mux.Subscribe(nil, record("B"), "b/#"); err != nil {
+		t.Fatal("subscribe error:", err)
+	}
+	<-brokerMockDone
+
+	sendPacketHex(t, brokerConn, "30060003612f7831")          // "a/x": "1"
+	sendPacketHex(t, brokerConn, "300400016232")              // "b": "2"
+	sendPacketHex(t, brokerConn, "3009000624535953"+"2f7833") // "$SYS/x": "3"
+	sendBigPublish(t, brokerConn, "a/big", 160_000)
+	sendBigPublish(t, brokerConn, "a/bigger", 200_000)
+	sendPacketHex(t, brokerConn, "300400017a34") // "z": "4"
+	<-lastDone
+	client.Close()
+	<-serveDone
+
+	want := []string{
+		"A a/x: 1",
+		"all a/x: 1",
+		"all b: 2",
+		"B b: 2",
+		"A a/big: 160000 bytes",
+		"all a/big: 160000 bytes",
+		"skip a/bigger: 200000 bytes",
+		"all z: 4",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got dispatches:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestServeMuxSubscribeError(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	var got []string
+	record := func(message, topic []byte) {
+		got = append(got, fmt.Sprintf("%s: %s", topic, message))
+	}
+	mux := mqtt.NewServeMux(client)
+	lastDone := make(chan struct{})
+	if err := mux.Handle("z", func([]byte, []byte) { close(lastDone) }); err != nil {
+		t.Fatal("handle error:", err)
+	}
+	serveDone := testRoutine(t, func() {
+		mux.Serve(0, func(err error) {
+			t.Error("serve error:", err)
+		})
+	})
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, pipeCONNECTHex)
+		sendPacketHex(t, brokerConn, "20020000") // CONNACK
+		wantPacketHex(t, brokerConn, "820a60000001630200016402")
+		sendPacketHex(t, brokerConn, "900460000180") // SUBACK with "d" failed
+	})
+	err = mux.Subscribe(nil, record, "c", "d")
+	var subscribeErr mqtt.SubscribeError
+	if !errors.As(err, &subscribeErr) || len(subscribeErr) != 1 || subscribeErr[0] != "d" {
+		t.Errorf("subscribe got error %v, want a SubscribeError for \"d\" only", err)
+	}
+	<-brokerMockDone
+
+	sendPacketHex(t, brokerConn, "300400016331") // "c": "1"
+	sendPacketHex(t, brokerConn, "300400016432") // "d": "2"
+	sendPacketHex(t, brokerConn, "300400017a33") // "z": "3"
+	<-lastDone
+	client.Close()
+	<-serveDone
+
+	if want := "c: 1"; strings.Join(got, "\n") != want {
+		t.Errorf("got dispatches:\n%s\nwant:\n%s", strings.Join(got, "\n"), want)
+	}
+}
+
+// SendBigPublish writes a PUBLISH with an at-most-once delivery.
+func sendBigPublish(t *testing.T, conn net.Conn, topic string, size int) {
+	t.Helper()
+	if _, err := conn.Write(bigPublishPacket(topic, make([]byte, size))); err != nil {
+		t.Fatal("broker write error:", err)
+	}
+}
+
+// BigPublishPacket returns a PUBLISH with an at-most-once delivery.
+func bigPublishPacket(topic string, message []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0x30)
+	for l := 2 + len(topic) + len(message); ; l >>= 7 {
+		if l < 0x80 {
+			buf.WriteByte(byte(l))
+			break
+		}
+		buf.WriteByte(byte(l) | 0x80)
+	}
+	buf.Write([]byte{byte(len(topic) >> 8), byte(len(topic))})
+	buf.WriteString(topic)
+	buf.Write(message)
+	return buf.Bytes()
+}
@@ -0,0 +1,122 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBuffered means that a PUBLISH was held in the offline buffer, because the
+// Client is down [ErrDown]. The message is submitted on the next connect, unless
+// evicted by Config.OfflineDropOldest.
+var ErrBuffered = errors.New("mqtt: PUBLISH buffered while offline")
+
+// OfflineBuffer holds PUBLISH packets without packet identifier while the
+// Client is down.
+type offlineBuffer struct {
+	sync.Mutex
+	packets [][]byte // in order of appearance
+	size    int      // byte count of packets
+}
+
+// BufferDown puts the packet in the offline buffer when the Client is down. The
+// return is ErrBuffered on success. Any other error implies that the packet was
+// not buffered.
+func (c *Client) bufferDown(quit <-chan struct{}, packet net.Buffers) error {
+	for {
+		select {
+		case <-quit:
+			return ErrCanceled
+		case conn, ok := <-c.writeSem: // locks writes
+			if !ok {
+				return ErrClosed
+			}
+			if conn != nil {
+				// got connected in the mean time
+				c.writeSem <- conn // unlocks writes
+				err := c.writeBuffers(quit, packet)
+				if err != ErrDown {
+					return err
+				}
+				continue
+			}
+
+			err := c.offlineBuffer.push(packet, c.OfflineBufferMax, c.OfflineBufferLen, c.OfflineDropOldest)
+			c.writeSem <- nil // unlocks writes
+			return err
+		}
+	}
+}
+
+// Push appends the packet, with ErrBuffered on success.
+func (b *offlineBuffer) push(packet net.Buffers, sizeMax, lenMax int, dropOldest bool) error {
+	var size int
+	for _, buf := range packet {
+		size += len(buf)
+	}
+	if size > sizeMax {
+		return ErrDown
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for b.size+size > sizeMax || (lenMax > 0 && len(b.packets) >= lenMax) {
+		if !dropOldest {
+			return ErrDown
+		}
+		b.size -= len(b.packets[0])
+		b.packets[0] = nil // release
+		b.packets = b.packets[1:]
+	}
+
+	p := make([]byte, 0, size)
+	for _, buf := range packet {
+		p = append(p, buf...)
+	}
+	b.packets = append(b.packets, p)
+	b.size += size
+	return ErrBuffered
+}
+
+// FlushOffline submits the offline buffer, if any, in one write. The write
+// lock must be held by conn. Packets not written in full remain in the buffer
+// on error, as a partial packet does not arrive on a broken connection. The
+// ones written in full are discarded, as a retry would cause duplicates.
+func (c *Client) flushOffline(conn net.Conn) error {
+	c.offlineBuffer.Lock()
+	packets := c.offlineBuffer.packets
+	c.offlineBuffer.packets = nil
+	c.offlineBuffer.size = 0
+	c.offlineBuffer.Unlock()
+	if len(packets) == 0 {
+		return nil
+	}
+
+	// The write consumes its buffers.
+	written, err := writeBuffersCount(conn, append(net.Buffers(nil), packets...), c.PauseTimeout)
+	if err != nil {
+		for len(packets) != 0 && int64(len(packets[0])) <= written {
+			written -= int64(len(packets[0]))
+			packets = packets[1:]
+		}
+		c.offlineBuffer.restore(packets)
+		return err
+	}
+	atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+	return nil
+}
+
+// Restore puts packets back in front of the buffer, without any limits.
+func (b *offlineBuffer) restore(packets [][]byte) {
+	var size int
+	for _, p := range packets {
+		size += len(p)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.packets = append(packets, b.packets...)
+	b.size += size
+}
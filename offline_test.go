@@ -0,0 +1,140 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+func TestOfflineBuffer(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	errDial := errors.New("dial test error")
+	dialN := 0
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer: func(context.Context) (net.Conn, error) {
+			dialN++
+			if dialN == 1 {
+				return nil, errDial
+			}
+			return clientConn, nil
+		},
+		OfflineBufferMax:  16,
+		OfflineBufferLen:  2,
+		OfflineDropOldest: true,
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	if _, _, _, err := client.ReadSlices(); !errors.Is(err, errDial) {
+		t.Fatalf("ReadSlices got error %v, want dial error", err)
+	}
+
+	for _, message := range []string{"1", "2", "3"} {
+		var err error
+		if message == "3" {
+			err = client.PublishFrom(nil, strings.NewReader(message), len(message), "x")
+		} else {
+			err = client.Publish(nil, []byte(message), "x")
+		}
+		if !errors.Is(err, mqtt.ErrBuffered) {
+			t.Errorf("publish %q got error %v, want mqtt.ErrBuffered", message, err)
+		}
+	}
+	err = client.Publish(nil, []byte(strings.Repeat("z", 16)), "x")
+	if !errors.Is(err, mqtt.ErrDown) {
+		t.Errorf("publish beyond buffer capacity got error %v, want mqtt.ErrDown", err)
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, pipeCONNECTHex)
+		sendPacketHex(t, brokerConn, "20020000")        // CONNACK
+		wantPacketHex(t, brokerConn, "3004000178"+"32") // PUBLISH 2nd
+		wantPacketHex(t, brokerConn, "3004000178"+"33") // PUBLISH 3rd
+		wantPacketHex(t, brokerConn, "3004000178"+"34") // PUBLISH online
+	})
+	readRoutineDone := testRoutine(t, func() {
+		for {
+			_, _, _, err := client.ReadSlices()
+			if errors.Is(err, mqtt.ErrClosed) {
+				return
+			}
+		}
+	})
+	<-client.Online()
+	if err := client.Publish(nil, []byte("4"), "x"); err != nil {
+		t.Error("publish online got error:", err)
+	}
+	<-brokerMockDone
+	client.Close()
+	<-readRoutineDone
+}
+
+func TestOfflineBufferFlushFault(t *testing.T) {
+	t.Parallel()
+
+	clientConn1, brokerConn1 := net.Pipe()
+	clientConn2, brokerConn2 := net.Pipe()
+	errDial := errors.New("dial test error")
+	var dialN int32
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer: func(context.Context) (net.Conn, error) {
+			switch atomic.AddInt32(&dialN, 1) {
+			case 1:
+				return nil, errDial
+			case 2:
+				return clientConn1, nil
+			default:
+				return clientConn2, nil
+			}
+		},
+		OfflineBufferMax: 16,
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	if _, _, _, err := client.ReadSlices(); !errors.Is(err, errDial) {
+		t.Fatalf("ReadSlices got error %v, want dial error", err)
+	}
+	for _, message := range []string{"1", "2"} {
+		err := client.Publish(nil, []byte(message), "x")
+		if !errors.Is(err, mqtt.ErrBuffered) {
+			t.Errorf("publish %q got error %v, want mqtt.ErrBuffered", message, err)
+		}
+	}
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn1, pipeCONNECTHex)
+		sendPacketHex(t, brokerConn1, "20020000")        // CONNACK
+		wantPacketHex(t, brokerConn1, "3004000178"+"31") // PUBLISH 1st
+		brokerConn1.Close()
+
+		wantPacketHex(t, brokerConn2, pipeCONNECTHex)
+		sendPacketHex(t, brokerConn2, "20020000")        // CONNACK
+		wantPacketHex(t, brokerConn2, "3004000178"+"32") // PUBLISH 2nd only
+	})
+	readRoutineDone := testRoutine(t, func() {
+		for {
+			_, _, _, err := client.ReadSlices()
+			if errors.Is(err, mqtt.ErrClosed) {
+				return
+			}
+		}
+	})
+	<-brokerMockDone
+	client.Close()
+	<-readRoutineDone
+}
@@ -0,0 +1,302 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PendingState is the progress of an outbound transfer.
+type PendingState uint8
+
+// Transfer states in order of appearance.
+const (
+	// PendingPUBLISH awaits a PUBACK or a PUBREC from the broker.
+	PendingPUBLISH PendingState = iota + 1
+	// PendingPUBREL awaits a PUBCOMP from the broker.
+	PendingPUBREL
+)
+
+// String returns the name of the packet submitted last.
+func (s PendingState) String() string {
+	switch s {
+	case PendingPUBLISH:
+		return "PUBLISH"
+	case PendingPUBREL:
+		return "PUBREL"
+	default:
+		return "<invalid>"
+	}
+}
+
+// Pending is an outbound transfer, from either PublishAtLeastOnce or
+// PublishExactlyOnce, which awaits confirmation from the broker.
+type Pending struct {
+	// The submission number is counted per quality-of-service level.
+	// Records from a Persistence continue on their packet identifier,
+	// without the identifier space, i.e., the 14 least-significant bits.
+	SeqNo    uint
+	PacketID uint16
+	QoS      byte // either 1 or 2
+
+	State PendingState
+	Topic string // empty for PendingPUBREL from Persistence
+	Size  int    // PUBLISH packet in bytes; zero when unknown
+
+	// Records from a Persistence have no enqueue time [zero].
+	Since time.Time
+}
+
+// Outbound tracks the pending transfers per packet identifier.
+type outbound struct {
+	sync.Mutex
+	perPacketID map[uint]*Pending
+
+	// Transfers from Persistence have no enqueue time.
+	adopted time.Time
+
+	// PurgeAtLeastOnce sets a threshold for the next connect.
+	purgeBefore time.Time
+}
+
+// Add registers an enqueued PUBLISH packet, with size bytes from a body, if any.
+func (o *outbound) add(packetID, seqNo uint, packet net.Buffers, bodySize int) {
+	p := &Pending{
+		SeqNo:    seqNo,
+		PacketID: uint16(packetID),
+		QoS:      qosOfKey(packetID),
+		State:    PendingPUBLISH,
+		Topic:    publishTopic(packet[0]),
+		Size:     bodySize,
+		Since:    time.Now(),
+	}
+	for _, buf := range packet {
+		p.Size += len(buf)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	if o.perPacketID == nil {
+		o.perPacketID = make(map[uint]*Pending)
+	}
+	o.perPacketID[packetID] = p
+}
+
+// Release registers a PUBREL submission.
+func (o *outbound) release(packetID uint) {
+	o.Lock()
+	defer o.Unlock()
+	if p, ok := o.perPacketID[packetID]; ok {
+		p.State = PendingPUBREL
+	}
+}
+
+// Remove ends the registration.
+func (o *outbound) remove(packetID uint) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.perPacketID, packetID)
+}
+
+// EnqueuedBefore returns whether a registration is older than the threshold.
+func (o *outbound) enqueuedBefore(packetID uint, threshold time.Time) bool {
+	o.Lock()
+	defer o.Unlock()
+	p, ok := o.perPacketID[packetID]
+	if !ok {
+		return false
+	}
+	since := p.Since
+	if since.IsZero() {
+		since = o.adopted
+	}
+	return since.Before(threshold)
+}
+
+// PurgeAtLeastOnce drops pending PublishAtLeastOnce transfers which are older
+// than the duration. The respective exchange channels receive ErrExpired. Any
+// PUBLISH submitted can not be withdrawn from a live connection.
+//
+// The purge waits for the next (re)connect, where it applies before the resends.
+// Transfers remain pending until then, including the ones which were never
+// submitted, as the Client was offline. The purge applies to the head of the
+// queue only, like Config.AtLeastOnceExpiry, i.e., it stops at the first
+// transfer which is not older than the duration. This keeps the order of packet
+// identifiers intact.
+func (c *Client) PurgeAtLeastOnce(olderThan time.Duration) {
+	c.outbound.Lock()
+	defer c.outbound.Unlock()
+	c.outbound.purgeBefore = time.Now().Add(-olderThan)
+}
+
+// ExpireAtLeastOnce drops pending transfers from the head of the queue, as far
+// as they expired or got purged. The order of packet identifiers remains intact.
+// The read routine must hold the submission lock.
+func (c *Client) expireAtLeastOnce() {
+	c.outbound.Lock()
+	threshold := c.outbound.purgeBefore
+	c.outbound.purgeBefore = time.Time{}
+	c.outbound.Unlock()
+	if c.AtLeastOnceExpiry > 0 {
+		t := time.Now().Add(-c.AtLeastOnceExpiry)
+		if t.After(threshold) {
+			threshold = t
+		}
+	}
+	if threshold.IsZero() {
+		return
+	}
+
+	for len(c.atLeastOnce.q) != 0 {
+		key := c.orderedTxs.Acked&publishIDMask | atLeastOnceIDSpace
+		if !c.outbound.enqueuedBefore(key, threshold) {
+			return
+		}
+		if err := c.persistence.Delete(key); err != nil {
+			// retry on next connect
+			c.outbound.Lock()
+			if c.outbound.purgeBefore.Before(threshold) {
+				c.outbound.purgeBefore = threshold
+			}
+			c.outbound.Unlock()
+			return
+		}
+		c.outbound.remove(key)
+		c.orderedTxs.Acked++
+		ch := <-c.atLeastOnce.q
+		select {
+		case ch <- ErrExpired:
+		default: // full
+		}
+		close(ch)
+		c.drainProgress()
+	}
+}
+
+// Pending lists the outbound transfers which await confirmation from the
+// broker, ordered by QoS level and SeqNo.
+func (c *Client) Pending() []Pending {
+	c.outbound.Lock()
+	list := make([]Pending, 0, len(c.outbound.perPacketID))
+	for _, p := range c.outbound.perPacketID {
+		list = append(list, *p)
+	}
+	c.outbound.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].QoS != list[j].QoS {
+			return list[i].QoS < list[j].QoS
+		}
+		return list[i].SeqNo < list[j].SeqNo
+	})
+	return list
+}
+
+// PendingFrom lists the outbound transfers from a Persistence which had an
+// InitSession, ordered by QoS level and SeqNo. The Persistence is not modified,
+// which means that records could be in conflict with each other. AdoptSession
+// resolves any such conflicts.
+func PendingFrom(p Persistence) ([]Pending, error) {
+	keys, err := p.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Pending
+	var persistSeqNos []uint64 // per list entry
+	for _, key := range keys {
+		if qosOfKey(key) == 0 {
+			continue
+		}
+		value, err := p.Load(key)
+		if err != nil {
+			return nil, err
+		}
+		packet, seqNo, _, err := decodeValue(key, value)
+		if err != nil || len(packet) == 0 {
+			continue // AdoptSession deletes
+		}
+		if packet[0]>>4 == typePUBREC {
+			continue // ended with failure [MQTT 5.0]
+		}
+		list = append(list, persistedPending(key, packet))
+		persistSeqNos = append(persistSeqNos, seqNo)
+	}
+
+	// The packet identifiers wrap, unlike the persistence sequence numbers.
+	sort.Sort(&pendingBySeqNo{list, persistSeqNos})
+	return list, nil
+}
+
+// PendingBySeqNo sorts by QoS level and persistence sequence numbers.
+type pendingBySeqNo struct {
+	list   []Pending
+	seqNos []uint64
+}
+
+// Len implements sort.Interface.
+func (a *pendingBySeqNo) Len() int { return len(a.list) }
+
+// Less implements sort.Interface.
+func (a *pendingBySeqNo) Less(i, j int) bool {
+	if a.list[i].QoS != a.list[j].QoS {
+		return a.list[i].QoS < a.list[j].QoS
+	}
+	return a.seqNos[i] < a.seqNos[j]
+}
+
+// Swap implements sort.Interface.
+func (a *pendingBySeqNo) Swap(i, j int) {
+	a.list[i], a.list[j] = a.list[j], a.list[i]
+	a.seqNos[i], a.seqNos[j] = a.seqNos[j], a.seqNos[i]
+}
+
+// PersistedPending returns the transfer of a decoded Persistence record.
+func persistedPending(key uint, packet []byte) Pending {
+	p := Pending{
+		SeqNo:    key & publishIDMask,
+		PacketID: uint16(key),
+		QoS:      qosOfKey(key),
+		State:    PendingPUBLISH,
+	}
+	if packet[0]>>4 == typePUBREL {
+		p.State = PendingPUBREL
+	} else {
+		p.Topic = publishTopic(packet)
+		p.Size = len(packet)
+	}
+	return p
+}
+
+// QoSOfKey returns the quality-of-service level of an outbound packet
+// identifier, with zero for any other key.
+func qosOfKey(key uint) byte {
+	switch key &^ publishIDMask {
+	case atLeastOnceIDSpace:
+		return atLeastOnceLevel
+	case exactlyOnceIDSpace:
+		return exactlyOnceLevel
+	}
+	return 0
+}
+
+// PublishTopic returns the topic name of a PUBLISH packet, with an empty string
+// for malformed content.
+func publishTopic(packet []byte) string {
+	i := 1 // skip fixed header
+	for i < len(packet) && packet[i]&0x80 != 0 {
+		i++ // remaining length continuation
+	}
+	i++ // remaining length end
+	if i+2 > len(packet) {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(packet[i:]))
+	i += 2
+	if i+n > len(packet) {
+		return ""
+	}
+	return string(packet[i : i+n])
+}
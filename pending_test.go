@@ -0,0 +1,101 @@
+package mqtt_test
+
+import (
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+func TestPending(t *testing.T) {
+	t.Parallel()
+
+	p := mqtt.FileSystem(t.TempDir())
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.InitSession("test-client", p, &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		AtLeastOnceMax: 2,
+		ExactlyOnceMax: 2,
+		Dialer:         newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("InitSession error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101700044d51545404000000000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, hex.EncodeToString([]byte{
+			0x32, 6,
+			0, 1, 'x',
+			0x80, 0x00, // packet identifier
+			'1'}))
+		wantPacketHex(t, brokerConn, hex.EncodeToString([]byte{
+			0x34, 6,
+			0, 1, 'y',
+			0xc0, 0x00, // packet identifier
+			'2'}))
+		sendPacketHex(t, brokerConn, "5002c000") // PUBREC
+		wantPacketHex(t, brokerConn, "6202c000") // PUBREL
+	})
+
+	start := time.Now()
+	if _, err := client.PublishAtLeastOnce([]byte{'1'}, "x"); err != nil {
+		t.Fatal("publish #1 error:", err)
+	}
+	if _, err := client.PublishExactlyOnce([]byte{'2'}, "y"); err != nil {
+		t.Fatal("publish #2 error:", err)
+	}
+	<-brokerMockDone
+
+	got := client.Pending()
+	for i := range got {
+		if got[i].Since.Before(start) || got[i].Since.After(time.Now()) {
+			t.Errorf("pending %d got enqueue time %s, want around %s", i, got[i].Since, start)
+		}
+		got[i].Since = time.Time{}
+	}
+	want := []mqtt.Pending{
+		{SeqNo: 0, PacketID: 0x8000, QoS: 1, State: mqtt.PendingPUBLISH, Topic: "x", Size: 8},
+		{SeqNo: 0, PacketID: 0xc000, QoS: 2, State: mqtt.PendingPUBREL, Topic: "y", Size: 8},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got pending:\n%+v\nwant:\n%+v", got, want)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal("Close error:", err)
+	}
+	got, err = mqtt.PendingFrom(p)
+	if err != nil {
+		t.Fatal("PendingFrom error:", err)
+	}
+	want = []mqtt.Pending{
+		{SeqNo: 0, PacketID: 0x8000, QoS: 1, State: mqtt.PendingPUBLISH, Topic: "x", Size: 8},
+		{SeqNo: 0, PacketID: 0xc000, QoS: 2, State: mqtt.PendingPUBREL},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got pending from persistence:\n%+v\nwant:\n%+v", got, want)
+	}
+
+	client, warn, err := mqtt.AdoptSession(p, &mqtt.Config{
+		AtLeastOnceMax: 2,
+		ExactlyOnceMax: 2,
+		Dialer:         newTestDialer(t),
+	})
+	if err != nil {
+		t.Fatal("AdoptSession error:", err)
+	}
+	defer client.Close()
+	for _, err := range warn {
+		t.Error("AdoptSession warning:", err)
+	}
+	if got := client.Pending(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got pending from adopted session:\n%+v\nwant:\n%+v", got, want)
+	}
+}
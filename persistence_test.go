@@ -0,0 +1,58 @@
+package mqtt_test
+
+import (
+	"testing"
+
+	"github.com/pascaldekloe/mqtt"
+	"github.com/pascaldekloe/mqtt/mqtttest"
+)
+
+func TestPersistence(t *testing.T) {
+	t.Run("volatile", func(t *testing.T) {
+		mqtttest.VerifyPersistence(t, func(*testing.T) func() mqtt.Persistence {
+			p := mqtt.NewVolatile()
+			return func() mqtt.Persistence { return p }
+		})
+	})
+
+	t.Run("fileSystem", func(t *testing.T) {
+		mqtttest.VerifyPersistence(t, func(t *testing.T) func() mqtt.Persistence {
+			dir := t.TempDir()
+			return func() mqtt.Persistence { return mqtt.FileSystem(dir) }
+		})
+	})
+
+	t.Run("rugged", func(t *testing.T) {
+		mqtttest.VerifyPersistence(t, func(t *testing.T) func() mqtt.Persistence {
+			dir := t.TempDir()
+			return func() mqtt.Persistence { return mqtt.NewRugged(mqtt.FileSystem(dir)) }
+		})
+	})
+
+	t.Run("appendLog", func(t *testing.T) {
+		mqtttest.VerifyPersistence(t, func(t *testing.T) func() mqtt.Persistence {
+			dir := t.TempDir()
+			return func() mqtt.Persistence {
+				l, err := mqtt.OpenAppendLog(dir, 1<<10)
+				if err != nil {
+					t.Fatal("OpenAppendLog error:", err)
+				}
+				t.Cleanup(func() { l.Close() })
+				return l
+			}
+		})
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		mqtttest.VerifyPersistence(t, func(t *testing.T) func() mqtt.Persistence {
+			dir := t.TempDir()
+			return func() mqtt.Persistence {
+				p, err := mqtt.EncryptedPersistence(mqtt.FileSystem(dir), make([]byte, 16))
+				if err != nil {
+					t.Fatal("EncryptedPersistence error:", err)
+				}
+				return p
+			}
+		})
+	})
+}
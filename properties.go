@@ -0,0 +1,426 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MQTT 5.0 packets carry properties, identified by a single byte.
+// See MQTT Version 5.0, subsection 2.2.2.2 “Property”.
+const (
+	propPayloadFormat        = 0x01 // byte
+	propMessageExpiry        = 0x02 // four byte integer
+	propContentType          = 0x03 // UTF-8 string
+	propResponseTopic        = 0x08 // UTF-8 string
+	propCorrelationData      = 0x09 // binary data
+	propSubscriptionID       = 0x0b // variable byte integer
+	propSessionExpiry        = 0x11 // four byte integer
+	propAssignedClientID     = 0x12 // UTF-8 string
+	propServerKeepAlive      = 0x13 // two byte integer
+	propAuthMethod           = 0x15 // UTF-8 string
+	propAuthData             = 0x16 // binary data
+	propRequestProblemInfo   = 0x17 // byte
+	propWillDelay            = 0x18 // four byte integer
+	propRequestResponseInfo  = 0x19 // byte
+	propResponseInfo         = 0x1a // UTF-8 string
+	propServerReference      = 0x1c // UTF-8 string
+	propReasonString         = 0x1f // UTF-8 string
+	propReceiveMax           = 0x21 // two byte integer
+	propTopicAliasMax        = 0x22 // two byte integer
+	propTopicAlias           = 0x23 // two byte integer
+	propMaxQoS               = 0x24 // byte
+	propRetainAvailable      = 0x25 // byte
+	propUserProperty         = 0x26 // UTF-8 string pair
+	propMaxPacketSize        = 0x27 // four byte integer
+	propWildcardSubAvailable = 0x28 // byte
+	propSubIDAvailable       = 0x29 // byte
+	propSharedSubAvailable   = 0x2a // byte
+)
+
+// ErrProperties denies properties on protocol levels without support.
+var errProperties = errors.New("properties require protocol level 5")
+
+// EmptyProperties is the encoding of a property length zero.
+var emptyProperties = []byte{0}
+
+// Properties are the MQTT 5.0 extensions to an application message. The zero
+// value omits all of them.
+type Properties struct {
+	// PayloadUTF8 flags the message as UTF-8 encoded character data.
+	PayloadUTF8 bool
+
+	// MessageExpiry is the lifetime of the message in seconds.
+	// Zero means no expiry.
+	MessageExpiry uint32
+
+	ContentType string // MIME type, if any
+
+	// The response topic and the correlation data, if any, apply
+	// to the request–response pattern.
+	ResponseTopic   string
+	CorrelationData []byte
+
+	// UserProperties are name–value pairs in order of appearance.
+	UserProperties []UserProperty
+
+	// SubscriptionIDs has the identifiers of each subscription that
+	// matched, if any. The field is ignored on outbound messages.
+	SubscriptionIDs []uint32
+}
+
+// UserProperty is an application-defined name–value pair.
+type UserProperty struct {
+	Key, Value string
+}
+
+// Append returns the property length plus the properties appended to buf.
+func (p *Properties) append(buf []byte) ([]byte, error) {
+	size := 0
+	if p.PayloadUTF8 {
+		size += 2
+	}
+	if p.MessageExpiry != 0 {
+		size += 5
+	}
+	if p.ContentType != "" {
+		if err := stringCheck(p.ContentType); err != nil {
+			return nil, fmt.Errorf("content type: %w", err)
+		}
+		size += 3 + len(p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		if err := stringCheck(p.ResponseTopic); err != nil {
+			return nil, fmt.Errorf("response topic: %w", err)
+		}
+		size += 3 + len(p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		if len(p.CorrelationData) > stringMax {
+			return nil, fmt.Errorf("correlation data: %w", errStringMax)
+		}
+		size += 3 + len(p.CorrelationData)
+	}
+	for _, u := range p.UserProperties {
+		if err := stringCheck(u.Key); err != nil {
+			return nil, fmt.Errorf("user property key: %w", err)
+		}
+		if err := stringCheck(u.Value); err != nil {
+			return nil, fmt.Errorf("user property value: %w", err)
+		}
+		size += 5 + len(u.Key) + len(u.Value)
+	}
+	if size > packetMax {
+		return nil, errPacketMax
+	}
+
+	buf = appendVarint(buf, uint(size))
+	if p.PayloadUTF8 {
+		buf = append(buf, propPayloadFormat, 1)
+	}
+	if p.MessageExpiry != 0 {
+		buf = append(buf, propMessageExpiry,
+			byte(p.MessageExpiry>>24), byte(p.MessageExpiry>>16),
+			byte(p.MessageExpiry>>8), byte(p.MessageExpiry))
+	}
+	if p.ContentType != "" {
+		buf = appendString(append(buf, propContentType), p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		buf = appendString(append(buf, propResponseTopic), p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		buf = append(buf, propCorrelationData, byte(len(p.CorrelationData)>>8), byte(len(p.CorrelationData)))
+		buf = append(buf, p.CorrelationData...)
+	}
+	for _, u := range p.UserProperties {
+		buf = appendString(append(buf, propUserProperty), u.Key)
+		buf = appendString(buf, u.Value)
+	}
+	return buf, nil
+}
+
+// DecodeProperties parses a property sequence which passed walkProperties.
+func decodeProperties(raw []byte) *Properties {
+	p := new(Properties)
+	walkProperties(raw, func(id byte, value []byte) error {
+		switch id {
+		case propPayloadFormat:
+			p.PayloadUTF8 = value[0] == 1
+		case propMessageExpiry:
+			p.MessageExpiry = binary.BigEndian.Uint32(value)
+		case propContentType:
+			p.ContentType = string(value)
+		case propResponseTopic:
+			p.ResponseTopic = string(value)
+		case propCorrelationData:
+			p.CorrelationData = append([]byte{}, value...)
+		case propUserProperty:
+			keyEnd := 2 + int(binary.BigEndian.Uint16(value))
+			p.UserProperties = append(p.UserProperties, UserProperty{
+				Key:   string(value[2:keyEnd]),
+				Value: string(value[keyEnd+2:]),
+			})
+		case propSubscriptionID:
+			id, _, _ := decodeVarint(value)
+			p.SubscriptionIDs = append(p.SubscriptionIDs, uint32(id))
+		}
+		return nil
+	})
+	return p
+}
+
+// WalkProperties invokes f for each property in order of appearance. Values
+// exclude the size prefix of strings and binary data. User properties keep the
+// size prefixes, as they consist of two strings.
+func walkProperties(props []byte, f func(id byte, value []byte) error) error {
+	for len(props) != 0 {
+		id := props[0]
+		props = props[1:]
+
+		var n int
+		var prefixed bool // string or binary data
+		switch id {
+		case propPayloadFormat, propRequestProblemInfo, propRequestResponseInfo, propMaxQoS, propRetainAvailable, propWildcardSubAvailable, propSubIDAvailable, propSharedSubAvailable:
+			n = 1
+		case propServerKeepAlive, propReceiveMax, propTopicAliasMax, propTopicAlias:
+			n = 2
+		case propMessageExpiry, propSessionExpiry, propWillDelay, propMaxPacketSize:
+			n = 4
+		case propSubscriptionID:
+			_, size, err := decodeVarint(props)
+			if err != nil {
+				return fmt.Errorf("%w: subscription identifier %s", errProtoReset, err)
+			}
+			n = size
+		case propContentType, propResponseTopic, propCorrelationData, propAssignedClientID, propAuthMethod, propAuthData, propResponseInfo, propServerReference, propReasonString:
+			if len(props) < 2 {
+				return fmt.Errorf("%w: property %#02x exceeds property length", errProtoReset, id)
+			}
+			n = 2 + int(binary.BigEndian.Uint16(props))
+			prefixed = true
+		case propUserProperty:
+			if len(props) < 2 {
+				return fmt.Errorf("%w: user property exceeds property length", errProtoReset)
+			}
+			n = 2 + int(binary.BigEndian.Uint16(props))
+			if len(props) < n+2 {
+				return fmt.Errorf("%w: user property exceeds property length", errProtoReset)
+			}
+			n += 2 + int(binary.BigEndian.Uint16(props[n:]))
+		default:
+			return fmt.Errorf("%w: unknown property identifier %#02x", errProtoReset, id)
+		}
+		if n > len(props) {
+			return fmt.Errorf("%w: property %#02x exceeds property length", errProtoReset, id)
+		}
+
+		value := props[:n]
+		if prefixed {
+			value = value[2:]
+		}
+		if err := f(id, value); err != nil {
+			return err
+		}
+		props = props[n:]
+	}
+	return nil
+}
+
+// SliceProperties splits the property length plus the properties from buf.
+func sliceProperties(buf []byte) (props, remaining []byte, err error) {
+	size, n, err := decodeVarint(buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: property length %s", errProtoReset, err)
+	}
+	if size > len(buf)-n {
+		return nil, nil, fmt.Errorf("%w: property length exceeds remaining length", errProtoReset)
+	}
+	return buf[n : n+size], buf[n+size:], nil
+}
+
+// DecodeVarint parses a variable byte integer, with n the number of bytes read.
+func decodeVarint(buf []byte) (value, n int, err error) {
+	for shift := uint(0); n < len(buf); shift += 7 {
+		b := buf[n]
+		n++
+		value |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, n, nil
+		}
+		if n == 4 {
+			return 0, 0, errors.New("encoding exceeds 4 bytes")
+		}
+	}
+	return 0, 0, errors.New("encoding incomplete")
+}
+
+func appendVarint(buf []byte, l uint) []byte {
+	for ; l > 0x7f; l >>= 7 {
+		buf = append(buf, byte(l|0x80))
+	}
+	return append(buf, byte(l))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+// ReasonCode is an MQTT 5.0 result status. Values of 0x80 and up indicate a
+// failure. Such failures are passed as an error on exchange channels from the
+// publish methods, as a final notice before the channel closes.
+type ReasonCode byte
+
+// Error implements the standard error interface.
+func (code ReasonCode) Error() string {
+	return fmt.Sprintf("mqtt: reason code %#02x “%s”", byte(code), code.text())
+}
+
+func (code ReasonCode) text() string {
+	switch code {
+	case 0x00:
+		return "Success"
+	case 0x01:
+		return "Granted QoS 1"
+	case 0x02:
+		return "Granted QoS 2"
+	case 0x04:
+		return "Disconnect with Will Message"
+	case 0x10:
+		return "No matching subscribers"
+	case 0x11:
+		return "No subscription existed"
+	case 0x18:
+		return "Continue authentication"
+	case 0x19:
+		return "Re-authenticate"
+	case 0x80:
+		return "Unspecified error"
+	case 0x81:
+		return "Malformed Packet"
+	case 0x82:
+		return "Protocol Error"
+	case 0x83:
+		return "Implementation specific error"
+	case 0x84:
+		return "Unsupported Protocol Version"
+	case 0x85:
+		return "Client Identifier not valid"
+	case 0x86:
+		return "Bad User Name or Password"
+	case 0x87:
+		return "Not authorized"
+	case 0x88:
+		return "Server unavailable"
+	case 0x89:
+		return "Server busy"
+	case 0x8a:
+		return "Banned"
+	case 0x8b:
+		return "Server shutting down"
+	case 0x8c:
+		return "Bad authentication method"
+	case 0x8d:
+		return "Keep Alive timeout"
+	case 0x8e:
+		return "Session taken over"
+	case 0x8f:
+		return "Topic Filter invalid"
+	case 0x90:
+		return "Topic Name invalid"
+	case 0x91:
+		return "Packet Identifier in use"
+	case 0x92:
+		return "Packet Identifier not found"
+	case 0x93:
+		return "Receive Maximum exceeded"
+	case 0x94:
+		return "Topic Alias invalid"
+	case 0x95:
+		return "Packet too large"
+	case 0x96:
+		return "Message rate too high"
+	case 0x97:
+		return "Quota exceeded"
+	case 0x98:
+		return "Administrative action"
+	case 0x99:
+		return "Payload format invalid"
+	case 0x9a:
+		return "Retain not supported"
+	case 0x9b:
+		return "QoS not supported"
+	case 0x9c:
+		return "Use another server"
+	case 0x9d:
+		return "Server moved"
+	case 0x9e:
+		return "Shared Subscriptions not supported"
+	case 0x9f:
+		return "Connection rate exceeded"
+	case 0xa0:
+		return "Maximum connect time"
+	case 0xa1:
+		return "Subscription Identifiers not supported"
+	case 0xa2:
+		return "Wildcard Subscriptions not supported"
+	default:
+		return "reserved"
+	}
+}
+
+// PeekAck parses the packet identifier and the reason code from either PUBACK,
+// PUBREC, PUBREL or PUBCOMP in Client.peek. Only MQTT 5.0 may have more than
+// the packet identifier, in which case an absent reason code means success.
+func (c *Client) peekAck(name string) (packetID uint, code ReasonCode, err error) {
+	if len(c.peek) < 2 || (len(c.peek) != 2 && c.ProtocolLevel != 5) {
+		return 0, 0, fmt.Errorf("%w: %s with %d byte remaining length", errProtoReset, name, len(c.peek))
+	}
+	packetID = uint(binary.BigEndian.Uint16(c.peek))
+	if len(c.peek) > 2 {
+		code = ReasonCode(c.peek[2])
+	}
+	if len(c.peek) > 3 {
+		props, remaining, err := sliceProperties(c.peek[3:])
+		if err == nil && len(remaining) != 0 {
+			err = fmt.Errorf("%w: %s with %d bytes after the properties", errProtoReset, name, len(remaining))
+		}
+		if err == nil {
+			err = walkProperties(props, func(byte, []byte) error { return nil })
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return packetID, code, nil
+}
+
+// PublishProperties returns the encoding for PUBLISH packets, which is nil for
+// protocol levels without properties.
+func (c *Client) publishProperties(p *Properties) ([]byte, error) {
+	if c.ProtocolLevel != 5 {
+		if p != nil {
+			return nil, fmt.Errorf("mqtt: PUBLISH request denied: %w", errProperties)
+		}
+		return nil, nil
+	}
+	if p == nil {
+		return emptyProperties, nil
+	}
+	buf, err := p.append(nil)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: PUBLISH request denied due property: %w", err)
+	}
+	return buf, nil
+}
+
+// ReadProperties returns the MQTT 5.0 properties of the message from the latest
+// ReadSlices, which includes any BigMessage. The return is nil when the message
+// has no properties. Topic aliases are resolved by ReadSlices already.
+func (c *Client) ReadProperties() *Properties {
+	if len(c.messageProps) == 0 {
+		return nil
+	}
+	return decodeProperties(c.messageProps)
+}
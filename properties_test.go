@@ -0,0 +1,51 @@
+package mqtt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPropertiesRoundtrip(t *testing.T) {
+	want := &Properties{
+		PayloadUTF8:     true,
+		MessageExpiry:   3600,
+		ContentType:     "text/plain",
+		ResponseTopic:   "reply/to",
+		CorrelationData: []byte{0, 1, 2},
+		UserProperties:  []UserProperty{{"a", "1"}, {"a", "2"}, {"", ""}},
+	}
+	buf, err := want.append(nil)
+	if err != nil {
+		t.Fatal("append error:", err)
+	}
+	props, remaining, err := sliceProperties(buf)
+	if err != nil {
+		t.Fatal("slice error:", err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("got %#x remaining", remaining)
+	}
+	if err := walkProperties(props, func(byte, []byte) error { return nil }); err != nil {
+		t.Fatal("walk error:", err)
+	}
+	if got := decodeProperties(props); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestWalkPropertiesMalformed(t *testing.T) {
+	golden := []string{
+		"\x00",                   // unknown identifier
+		"\x02\x00\x00\x00",       // message expiry truncated
+		"\x03\x00\x05abc",        // content type truncated
+		"\x26\x00\x01k\x00\x02v", // user property value truncated
+		"\x0b\x80\x80\x80\x80",   // subscription identifier overflow
+	}
+	for _, props := range golden {
+		err := walkProperties([]byte(props), func(byte, []byte) error { return nil })
+		if !errors.Is(err, errProtoReset) {
+			t.Errorf("properties %q got error %v, want errProtoReset", props, err)
+		}
+	}
+}
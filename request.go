@@ -1,12 +1,18 @@
 package mqtt
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pascaldekloe/mqtt/topics"
 )
 
 // ErrMax denies a request on transit capacity, which prevents the Client from
@@ -23,6 +29,11 @@ var ErrCanceled = errors.New("mqtt: request canceled before submission")
 // The broker received the request, yet the result/response remains unknown.
 var ErrAbandoned = errors.New("mqtt: request abandoned after submission")
 
+// ErrExpired means that a PublishAtLeastOnce got dropped before confirmation,
+// either due to Config.AtLeastOnceExpiry or due to PurgeAtLeastOnce. The broker
+// may or may not have received the message.
+var ErrExpired = errors.New("mqtt: PUBLISH expired before confirmation")
+
 // ErrBreak means that the connection broke up after the request was send.
 // The broker received the request, yet the result/response remains unknown.
 var ErrBreak = errors.New("mqtt: connection lost while awaiting response")
@@ -76,6 +87,7 @@ func (c *Client) onPINGRESP() error {
 	if len(c.peek) != 0 {
 		return fmt.Errorf("%w: PINGRESP with %d byte remaining length", errProtoReset, len(c.peek))
 	}
+	atomic.AddInt64(&c.pongN, 1)
 	select {
 	case ack := <-c.pingAck:
 		close(ack)
@@ -143,18 +155,12 @@ type unorderedTxs struct {
 type unorderedCallback struct {
 	done         chan<- error
 	topicFilters []string
+	levelMax     byte // subscribe only
 }
 
-// StartTx assigns a slot for either a subscribe or an unsubscribe.
-// The filter slice is nil for unsubscribes only.
-func (txs *unorderedTxs) startTx(topicFilters []string) (packetID uint16, done <-chan error, err error) {
-	var space uint
-	if topicFilters == nil {
-		space = unsubscribeIDSpace
-	} else {
-		space = subscribeIDSpace
-	}
-
+// StartTx assigns a slot for either a subscribe or an unsubscribe, as defined
+// by the packet identifier space.
+func (txs *unorderedTxs) startTx(space uint, topicFilters []string, levelMax byte) (packetID uint16, done <-chan error, err error) {
 	// Only one response error can be applied on done.
 	ch := make(chan error, 1)
 
@@ -177,19 +183,20 @@ func (txs *unorderedTxs) startTx(topicFilters []string) (packetID uint16, done <
 		}
 		txs.perPacketID[packetID] = unorderedCallback{
 			topicFilters: topicFilters,
+			levelMax:     levelMax,
 			done:         ch,
 		}
 		return packetID, ch, nil
 	}
 }
 
-// EndTx releases a slot. The filter slice is nil for unsubscribe requests.
-func (txs *unorderedTxs) endTx(packetID uint16) (done chan<- error, topicFilters []string) {
+// EndTx releases a slot. The done channel is nil for unknown packet identifiers.
+func (txs *unorderedTxs) endTx(packetID uint16) unorderedCallback {
 	txs.Lock()
 	defer txs.Unlock()
 	callback := txs.perPacketID[packetID]
 	delete(txs.perPacketID, packetID)
-	return callback.done, callback.topicFilters
+	return callback
 }
 
 func (txs *unorderedTxs) breakAll() {
@@ -201,8 +208,298 @@ func (txs *unorderedTxs) breakAll() {
 	}
 }
 
+// Subscription is a topic filter confirmed by the broker.
+type Subscription struct {
+	TopicFilter string
+	// The maximum quality-of-service level granted by the broker is
+	// either 0 for “at most once”, 1 for “at least once” or 2 for
+	// “exactly once”.
+	Level int
+}
+
+// Subscriptions tracks the topic filters confirmed by the broker, plus the ones
+// requested without a response, either to subscribe or to unsubscribe. The
+// latter are resubmitted on reconnect.
+type subscriptions struct {
+	sync.Mutex
+	perFilter map[string]subscription
+}
+
+type subscription struct {
+	levelMax byte // as requested
+	granted  byte // as confirmed, or grantedNone, or grantedGone
+}
+
+const (
+	// GrantedNone marks a subscription without confirmation from the broker.
+	grantedNone = 0x80
+	// GrantedGone marks an unsubscribe without confirmation from the broker.
+	grantedGone = 0x81
+)
+
+func (subs *subscriptions) list() []Subscription {
+	subs.Lock()
+	defer subs.Unlock()
+	a := make([]Subscription, 0, len(subs.perFilter))
+	for filter, sub := range subs.perFilter {
+		if sub.granted == grantedNone || sub.granted == grantedGone {
+			continue
+		}
+		a = append(a, Subscription{TopicFilter: filter, Level: int(sub.granted)})
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].TopicFilter < a[j].TopicFilter })
+	return a
+}
+
+// Update applies the return codes from a SUBACK, or the removal by UNSUBACK
+// when codes is nil. The Persistence value is nil when nothing changed.
+func (subs *subscriptions) update(topicFilters []string, codes []byte, levelMax byte) (value []byte) {
+	subs.Lock()
+	defer subs.Unlock()
+
+	var changed bool
+	for i, filter := range topicFilters {
+		sub, ok := subs.perFilter[filter]
+		switch {
+		case codes == nil:
+			if ok {
+				delete(subs.perFilter, filter)
+				changed = true
+			}
+		case codes[i]&0x80 != 0:
+			// A failed SUBSCRIBE leaves any existing
+			// subscription on the broker in place.
+			if ok && sub.granted == grantedNone {
+				delete(subs.perFilter, filter)
+				changed = true
+			}
+		case !ok || sub.levelMax != levelMax || sub.granted != codes[i]:
+			subs.perFilter[filter] = subscription{levelMax: levelMax, granted: codes[i]}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return subs.value()
+}
+
+// Unconfirmed registers topic filters which were requested without response.
+// Confirmed subscriptions are left as is. The Persistence value is nil when
+// nothing changed.
+func (subs *subscriptions) unconfirmed(topicFilters []string, levelMax byte) (value []byte) {
+	subs.Lock()
+	defer subs.Unlock()
+
+	var changed bool
+	for _, filter := range topicFilters {
+		sub, ok := subs.perFilter[filter]
+		if !ok || sub.granted == grantedGone || sub.granted == grantedNone && sub.levelMax != levelMax {
+			subs.perFilter[filter] = subscription{levelMax: levelMax, granted: grantedNone}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return subs.value()
+}
+
+// Gone registers topic filters which were unsubscribed without response. The
+// Persistence value is nil when nothing changed.
+func (subs *subscriptions) gone(topicFilters []string) (value []byte) {
+	subs.Lock()
+	defer subs.Unlock()
+
+	var changed bool
+	for _, filter := range topicFilters {
+		if sub, ok := subs.perFilter[filter]; !ok || sub.granted != grantedGone {
+			subs.perFilter[filter] = subscription{granted: grantedGone}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return subs.value()
+}
+
+// UnconfirmAll drops the confirmation of each subscription, as the broker has
+// no session to match. Unsubscribes without response are dropped, for the same
+// reason. The Persistence value is nil when nothing changed.
+func (subs *subscriptions) unconfirmAll() (value []byte) {
+	subs.Lock()
+	defer subs.Unlock()
+
+	var changed bool
+	for filter, sub := range subs.perFilter {
+		switch sub.granted {
+		case grantedNone:
+			break
+		case grantedGone:
+			delete(subs.perFilter, filter)
+			changed = true
+		default:
+			subs.perFilter[filter] = subscription{levelMax: sub.levelMax, granted: grantedNone}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return subs.value()
+}
+
+// Value returns the Persistence encoding. The lock must be held.
+func (subs *subscriptions) value() []byte {
+	// Each entry has the requested level, the granted level,
+	// and the topic filter with a 16-bit size prefix.
+	size := 0
+	for filter := range subs.perFilter {
+		size += 4 + len(filter)
+	}
+	value := make([]byte, 0, size)
+	for filter, sub := range subs.perFilter {
+		value = append(value, sub.levelMax, sub.granted, byte(len(filter)>>8), byte(len(filter)))
+		value = append(value, filter...)
+	}
+	return value
+}
+
+// DecodeSubscriptions parses a Persistence value from subscriptions update.
+func decodeSubscriptions(value []byte) (map[string]subscription, error) {
+	perFilter := make(map[string]subscription)
+	for len(value) != 0 {
+		if len(value) < 4 {
+			return nil, errors.New("mqtt: subscription record truncated")
+		}
+		sub := subscription{levelMax: value[0], granted: value[1]}
+		if sub.levelMax > exactlyOnceLevel || sub.granted > exactlyOnceLevel && sub.granted != grantedNone && sub.granted != grantedGone {
+			return nil, errors.New("mqtt: subscription record with illegal quality-of-service level")
+		}
+		end := 4 + int(binary.BigEndian.Uint16(value[2:]))
+		if end > len(value) {
+			return nil, errors.New("mqtt: subscription record truncated")
+		}
+		perFilter[string(value[4:end])] = sub
+		value = value[end:]
+	}
+	return perFilter, nil
+}
+
+// UnconfirmedPerLevel groups the topic filters without confirmation on their
+// requested level.
+func (subs *subscriptions) unconfirmedPerLevel() (a [exactlyOnceLevel + 1][]string) {
+	subs.Lock()
+	defer subs.Unlock()
+	for filter, sub := range subs.perFilter {
+		if sub.granted == grantedNone {
+			a[sub.levelMax] = append(a[sub.levelMax], filter)
+		}
+	}
+	return a
+}
+
+// GoneFilters returns the topic filters unsubscribed without confirmation.
+func (subs *subscriptions) goneFilters() []string {
+	subs.Lock()
+	defer subs.Unlock()
+	var a []string
+	for filter, sub := range subs.perFilter {
+		if sub.granted == grantedGone {
+			a = append(a, filter)
+		}
+	}
+	return a
+}
+
+// Subscriptions returns the topic filters confirmed by the broker, sorted by
+// their name. The Client subscribes to each of them again when a reconnect
+// does not resume the session [ErrSessionLost]. Subscribe requests without a
+// response [ErrAbandoned or ErrBreak] are resubmitted on reconnect, and they
+// get listed once confirmed. Unsubscribe requests without a response get
+// resubmitted too, and their topic filters are omitted right away.
+func (c *Client) Subscriptions() []Subscription {
+	return c.subscriptions.list()
+}
+
+// UnconfirmSubscriptions marks all subscriptions for resubmission, as the broker
+// has no session to match.
+func (c *Client) unconfirmSubscriptions() error {
+	if value := c.subscriptions.unconfirmAll(); value != nil {
+		return c.persistence.Save(subscriptionsKey, net.Buffers{value})
+	}
+	return nil
+}
+
+// Resubscribe requests all unconfirmed subscriptions and unsubscribes on the
+// current connection. Responses are applied to the subscriptions with nobody
+// awaiting the result.
+func (c *Client) resubscribe() error {
+	filters := c.subscriptions.goneFilters()
+	for len(filters) != 0 {
+		// split on packet size limit
+		size := 2
+		if c.ProtocolLevel == 5 {
+			size++ // property length
+		}
+		n := 0
+		for ; n < len(filters) && size+2+len(filters[n]) <= packetMax; n++ {
+			size += 2 + len(filters[n])
+		}
+
+		packetID, _, err := c.unorderedTxs.startTx(unsubscribeIDSpace, filters[:n], 0)
+		if err != nil {
+			return fmt.Errorf("%w; UNSUBSCRIBE unavailable", err)
+		}
+		buf := bufPool.Get().(*[bufSize]byte)
+		err = c.write(nil, c.unsubscribePacket(buf[:0], packetID, size, filters[:n]))
+		bufPool.Put(buf)
+		if err != nil {
+			c.unorderedTxs.endTx(packetID) // releases slot
+			return fmt.Errorf("%w; UNSUBSCRIBE request interrupted", err)
+		}
+
+		filters = filters[n:]
+	}
+
+	for levelMax, filters := range c.subscriptions.unconfirmedPerLevel() {
+		for len(filters) != 0 {
+			// split on packet size limit
+			size := 2
+			if c.ProtocolLevel == 5 {
+				size++ // property length
+			}
+			n := 0
+			for ; n < len(filters) && size+3+len(filters[n]) <= packetMax; n++ {
+				size += 3 + len(filters[n])
+			}
+
+			packetID, _, err := c.unorderedTxs.startTx(subscribeIDSpace, filters[:n], byte(levelMax))
+			if err != nil {
+				return fmt.Errorf("%w; SUBSCRIBE unavailable", err)
+			}
+			buf := bufPool.Get().(*[bufSize]byte)
+			err = c.write(nil, c.subscribePacket(buf[:0], packetID, size, filters[:n], byte(levelMax)))
+			bufPool.Put(buf)
+			if err != nil {
+				c.unorderedTxs.endTx(packetID) // releases slot
+				return fmt.Errorf("%w; SUBSCRIBE request interrupted", err)
+			}
+
+			filters = filters[n:]
+		}
+	}
+	return nil
+}
+
 // Subscribe requests subscription for all topics that match any of the filter
-// arguments.
+// arguments. Persistence failures on the subscriptions record cause an error,
+// even though the broker did apply the subscription.
+//
+// Requests without a response, i.e., ErrAbandoned or ErrBreak, continue in the
+// background. The Client resubmits them on reconnect until the broker either
+// confirms or rejects. Subscriptions lists the confirmed outcome.
 //
 // Quit is optional, as nil just blocks. Appliance of quit will strictly result
 // in either ErrCanceled or ErrAbandoned.
@@ -227,8 +524,11 @@ func (c *Client) subscribeLevel(quit <-chan struct{}, topicFilters []string, lev
 		return errSubscribeNone
 	}
 	size := 2 + len(topicFilters)*3
+	if c.ProtocolLevel == 5 {
+		size++ // property length
+	}
 	for _, s := range topicFilters {
-		if err := topicCheck(s); err != nil {
+		if err := topics.CheckFilter(s); err != nil {
 			return fmt.Errorf("mqtt: SUBSCRIBE request denied on topic filter: %w", err)
 		}
 		size += len(s)
@@ -238,7 +538,7 @@ func (c *Client) subscribeLevel(quit <-chan struct{}, topicFilters []string, lev
 	}
 
 	// slot assignment
-	packetID, done, err := c.unorderedTxs.startTx(topicFilters)
+	packetID, done, err := c.unorderedTxs.startTx(subscribeIDSpace, topicFilters, levelMax)
 	if err != nil {
 		return fmt.Errorf("%w; SUBSCRIBE unavailable", err)
 	}
@@ -246,32 +546,61 @@ func (c *Client) subscribeLevel(quit <-chan struct{}, topicFilters []string, lev
 	// request packet composition
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet := append(buf[:0], typeSUBSCRIBE<<4|atLeastOnceLevel<<1)
-	l := uint(size)
-	for ; l > 0x7f; l >>= 7 {
-		packet = append(packet, byte(l|0x80))
-	}
-	packet = append(packet, byte(l))
-	packet = append(packet, byte(packetID>>8), byte(packetID))
-	for _, s := range topicFilters {
-		packet = append(packet, byte(len(s)>>8), byte(len(s)))
-		packet = append(packet, s...)
-		packet = append(packet, levelMax)
-	}
+	packet := c.subscribePacket(buf[:0], packetID, size, topicFilters, levelMax)
 
 	// network submission
 	if err = c.write(quit, packet); err != nil {
 		c.unorderedTxs.endTx(packetID) // releases slot
-		return fmt.Errorf("%w; SUBSCRIBE request interrupted", err)
+		err = fmt.Errorf("%w; SUBSCRIBE request interrupted", err)
+		if errors.Is(err, ErrBreak) {
+			err = c.subscribeUnconfirmed(err, topicFilters, levelMax)
+		}
+		return err
 	}
 
 	select {
 	case err := <-done:
+		if errors.Is(err, ErrBreak) {
+			err = c.subscribeUnconfirmed(err, topicFilters, levelMax)
+		}
 		return err
 	case <-quit:
+		// Resubmission on reconnect covers any SUBACK missed.
 		c.unorderedTxs.endTx(packetID) // releases slot
-		return fmt.Errorf("%w; SUBSCRIBE not confirmed", ErrAbandoned)
+		err := fmt.Errorf("%w; SUBSCRIBE not confirmed", ErrAbandoned)
+		return c.subscribeUnconfirmed(err, topicFilters, levelMax)
+	}
+}
+
+// SubscribeUnconfirmed registers a SUBSCRIBE without response for resubmission.
+func (c *Client) subscribeUnconfirmed(err error, topicFilters []string, levelMax byte) error {
+	if value := c.subscriptions.unconfirmed(topicFilters, levelMax); value != nil {
+		if saveErr := c.persistence.Save(subscriptionsKey, net.Buffers{value}); saveErr != nil {
+			return subscriptionsSaveErr(err, saveErr)
+		}
+	}
+	return err
+}
+
+func (c *Client) subscribePacket(buf []byte, packetID uint16, size int, topicFilters []string, levelMax byte) []byte {
+	packet := append(buf, typeSUBSCRIBE<<4|atLeastOnceLevel<<1)
+	l := uint(size)
+	for ; l > 0x7f; l >>= 7 {
+		packet = append(packet, byte(l|0x80))
+	}
+	packet = append(packet, byte(l))
+	packet = append(packet, byte(packetID>>8), byte(packetID))
+	if c.ProtocolLevel == 5 {
+		// The subscription options of MQTT 5.0 default to zero,
+		// which leaves the quality-of-service level only.
+		packet = append(packet, emptyProperties...)
+	}
+	for _, s := range topicFilters {
+		packet = append(packet, byte(len(s)>>8), byte(len(s)))
+		packet = append(packet, s...)
+		packet = append(packet, levelMax)
 	}
+	return packet
 }
 
 func (c *Client) onSUBACK() error {
@@ -287,12 +616,24 @@ func (c *Client) onSUBACK() error {
 	}
 
 	returnCodes := c.peek[2:]
+	if c.ProtocolLevel == 5 {
+		props, remaining, err := sliceProperties(returnCodes)
+		if err == nil {
+			err = walkProperties(props, func(byte, []byte) error { return nil })
+		}
+		if err != nil {
+			return err
+		}
+		returnCodes = remaining
+	}
 	var failN int
 	for _, code := range returnCodes {
-		switch code {
-		case atMostOnceLevel, atLeastOnceLevel, exactlyOnceLevel:
+		switch {
+		case code <= exactlyOnceLevel:
 			break
-		case 0x80:
+		case code == 0x80 && c.ProtocolLevel != 3: // not in MQTT 3.1
+			failN++
+		case code > 0x80 && c.ProtocolLevel == 5:
 			failN++
 		default:
 			return fmt.Errorf("%w: SUBACK with illegal return code %#02x", errProtoReset, code)
@@ -300,8 +641,9 @@ func (c *Client) onSUBACK() error {
 	}
 
 	// commit
-	done, topicFilters := c.unorderedTxs.endTx(packetID)
-	if done == nil { // hopefully due ErrAbandoned
+	callback := c.unorderedTxs.endTx(packetID)
+	done, topicFilters := callback.done, callback.topicFilters
+	if done == nil { // unknown packet identifier
 		return nil
 	}
 
@@ -313,21 +655,61 @@ func (c *Client) onSUBACK() error {
 		return errProtoReset
 	}
 
+	// Persist before confirmation. Save errors don't change the outcome.
+	// They go to the requester, as the connection is fine.
+	var saveErr error
+	if value := c.subscriptions.update(topicFilters, returnCodes, callback.levelMax); value != nil {
+		saveErr = c.persistence.Save(subscriptionsKey, net.Buffers{value})
+	}
+
+	var err error
 	if failN != 0 {
-		var err SubscribeError
+		var subscribeErr SubscribeError
 		for i, code := range returnCodes {
-			if code == 0x80 {
-				err = append(err, topicFilters[i])
+			if code&0x80 != 0 {
+				subscribeErr = append(subscribeErr, topicFilters[i])
 			}
 		}
+		err = subscribeErr
+	}
+	if err = subscriptionsSaveErr(err, saveErr); err != nil {
 		done <- err
 	}
 	close(done)
 	return nil
 }
 
+// SubscriptionsSaveErr appends a persistence failure, if any, to err.
+func subscriptionsSaveErr(err, saveErr error) error {
+	switch {
+	case saveErr == nil:
+		return err
+	case err == nil:
+		return subscriptionsSaveError{saveErr}
+	default:
+		return fmt.Errorf("%w; subscriptions not persisted: %s", err, saveErr)
+	}
+}
+
+// SubscriptionsSaveError is a persistence failure on a (un)subscribe which was
+// applied by the broker nonetheless.
+type subscriptionsSaveError struct{ err error }
+
+// Error implements the standard error interface.
+func (e subscriptionsSaveError) Error() string {
+	return "mqtt: subscriptions not persisted: " + e.err.Error()
+}
+
+// Unwrap implements the errors.Unwrap convention.
+func (e subscriptionsSaveError) Unwrap() error { return e.err }
+
 // Unsubscribe requests subscription cancelation for each of the filter
-// arguments.
+// arguments. Persistence failures on the subscriptions record cause an error,
+// even though the broker did apply the cancelation.
+//
+// Requests without a response, i.e., ErrAbandoned or ErrBreak, continue in the
+// background. Subscriptions omits the topic filters right away, and the Client
+// resubmits the request on reconnect until the broker confirms.
 //
 // Quit is optional, as nil just blocks. Appliance of quit will strictly result
 // in either ErrCanceled or ErrAbandoned.
@@ -336,9 +718,12 @@ func (c *Client) Unsubscribe(quit <-chan struct{}, topicFilters ...string) error
 		return errUnsubscribeNone
 	}
 	size := 2 + len(topicFilters)*2
+	if c.ProtocolLevel == 5 {
+		size++ // property length
+	}
 	for _, s := range topicFilters {
 		size += len(s)
-		if err := topicCheck(s); err != nil {
+		if err := topics.CheckFilter(s); err != nil {
 			return fmt.Errorf("mqtt: UNSUBSCRIBE request denied on topic filter: %w", err)
 		}
 	}
@@ -347,7 +732,7 @@ func (c *Client) Unsubscribe(quit <-chan struct{}, topicFilters ...string) error
 	}
 
 	// slot assignment
-	packetID, done, err := c.unorderedTxs.startTx(nil)
+	packetID, done, err := c.unorderedTxs.startTx(unsubscribeIDSpace, topicFilters, 0)
 	if err != nil {
 		return fmt.Errorf("%w; UNSUBSCRIBE unavailable", err)
 	}
@@ -355,39 +740,76 @@ func (c *Client) Unsubscribe(quit <-chan struct{}, topicFilters ...string) error
 	// request packet composition
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	// header
-	packet := append(buf[:0], typeUNSUBSCRIBE<<4|atLeastOnceLevel<<1)
-	l := uint(size)
-	for ; l > 0x7f; l >>= 7 {
-		packet = append(packet, byte(l|0x80))
-	}
-	packet = append(packet, byte(l))
-	packet = append(packet, byte(packetID>>8), byte(packetID))
-	// payload
-	for _, s := range topicFilters {
-		packet = append(packet, byte(len(s)>>8), byte(len(s)))
-		packet = append(packet, s...)
-	}
+	packet := c.unsubscribePacket(buf[:0], packetID, size, topicFilters)
 
 	// network submission
 	if err = c.write(quit, packet); err != nil {
 		c.unorderedTxs.endTx(packetID) // releases slot
-		return fmt.Errorf("%w; UNSUBSCRIBE request interrupted", err)
+		err = fmt.Errorf("%w; UNSUBSCRIBE request interrupted", err)
+		if errors.Is(err, ErrBreak) {
+			err = c.unsubscribeUnconfirmed(err, topicFilters)
+		}
+		return err
 	}
 
 	select {
 	case err := <-done:
+		if errors.Is(err, ErrBreak) {
+			err = c.unsubscribeUnconfirmed(err, topicFilters)
+		}
 		return err
 	case <-quit:
+		// Resubmission on reconnect covers any UNSUBACK missed.
 		c.unorderedTxs.endTx(packetID) // releases slot
-		return fmt.Errorf("%w; UNSUBSCRIBE not confirmed", ErrAbandoned)
+		err := fmt.Errorf("%w; UNSUBSCRIBE not confirmed", ErrAbandoned)
+		return c.unsubscribeUnconfirmed(err, topicFilters)
+	}
+}
+
+// UnsubscribeUnconfirmed registers an UNSUBSCRIBE without response for
+// resubmission.
+func (c *Client) unsubscribeUnconfirmed(err error, topicFilters []string) error {
+	if value := c.subscriptions.gone(topicFilters); value != nil {
+		if saveErr := c.persistence.Save(subscriptionsKey, net.Buffers{value}); saveErr != nil {
+			return subscriptionsSaveErr(err, saveErr)
+		}
 	}
+	return err
+}
+
+func (c *Client) unsubscribePacket(buf []byte, packetID uint16, size int, topicFilters []string) []byte {
+	packet := append(buf, typeUNSUBSCRIBE<<4|atLeastOnceLevel<<1)
+	l := uint(size)
+	for ; l > 0x7f; l >>= 7 {
+		packet = append(packet, byte(l|0x80))
+	}
+	packet = append(packet, byte(l))
+	packet = append(packet, byte(packetID>>8), byte(packetID))
+	if c.ProtocolLevel == 5 {
+		packet = append(packet, emptyProperties...)
+	}
+	for _, s := range topicFilters {
+		packet = append(packet, byte(len(s)>>8), byte(len(s)))
+		packet = append(packet, s...)
+	}
+	return packet
 }
 
 func (c *Client) onUNSUBACK() error {
-	if len(c.peek) != 2 {
+	if len(c.peek) < 2 || (len(c.peek) != 2 && c.ProtocolLevel != 5) {
 		return fmt.Errorf("%w: UNSUBACK with %d byte remaining length", errProtoReset, len(c.peek))
 	}
+	if c.ProtocolLevel == 5 {
+		// The reason codes of MQTT 5.0 are ignored. The subscription
+		// is gone either way.
+		props, _, err := sliceProperties(c.peek[2:])
+		if err == nil {
+			err = walkProperties(props, func(byte, []byte) error { return nil })
+		}
+		if err != nil {
+			return err
+		}
+	}
 	packetID := binary.BigEndian.Uint16(c.peek)
 	switch {
 	case packetID == 0:
@@ -395,10 +817,20 @@ func (c *Client) onUNSUBACK() error {
 	case packetID&^unorderedIDMask != unsubscribeIDSpace:
 		return errPacketIDSpace
 	}
-	done, _ := c.unorderedTxs.endTx(packetID)
-	if done != nil {
-		close(done)
+	callback := c.unorderedTxs.endTx(packetID)
+	if callback.done == nil { // unknown packet identifier
+		return nil
 	}
+
+	// Persist before confirmation. Save errors don't change the outcome.
+	// They go to the requester, as the connection is fine.
+	if value := c.subscriptions.update(callback.topicFilters, nil, 0); value != nil {
+		saveErr := c.persistence.Save(subscriptionsKey, net.Buffers{value})
+		if saveErr != nil {
+			callback.done <- subscriptionsSaveErr(nil, saveErr)
+		}
+	}
+	close(callback.done)
 	return nil
 }
 
@@ -408,6 +840,10 @@ type orderedTxs struct {
 	Acked     uint // confirm count for PublishAtLeastOnce
 	Received  uint // confirm count 1/2 for PublishExactlyOnce
 	Completed uint // confirm count 2/2 for PublishExactlyOnce
+
+	// PUBREC failures [MQTT 5.0] end without PUBREL. Their exchange awaits
+	// the PUBCOMP of any preceding transfers.
+	Failed map[uint]ReasonCode
 }
 
 type holdup struct {
@@ -424,11 +860,11 @@ type holdup struct {
 func (c *Client) Publish(quit <-chan struct{}, message []byte, topic string) error {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := publishPacket(buf, message, topic, 0, typePUBLISH<<4)
+	packet, err := c.publishPacket(buf, message, topic, 0, typePUBLISH<<4, nil)
 	if err != nil {
 		return err
 	}
-	return c.writeBuffers(quit, packet)
+	return c.writePublish(quit, packet)
 }
 
 // PublishRetained is like Publish, but the broker should store the message, so
@@ -439,11 +875,11 @@ func (c *Client) Publish(quit <-chan struct{}, message []byte, topic string) err
 func (c *Client) PublishRetained(quit <-chan struct{}, message []byte, topic string) error {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := publishPacket(buf, message, topic, 0, typePUBLISH<<4|retainFlag)
+	packet, err := c.publishPacket(buf, message, topic, 0, typePUBLISH<<4|retainFlag, nil)
 	if err != nil {
 		return err
 	}
-	return c.writeBuffers(quit, packet)
+	return c.writePublish(quit, packet)
 }
 
 // PublishAtLeastOnce delivers the message with an “at least once” guarantee.
@@ -456,7 +892,7 @@ func (c *Client) PublishRetained(quit <-chan struct{}, message []byte, topic str
 func (c *Client) PublishAtLeastOnce(message []byte, topic string) (exchange <-chan error, err error) {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := publishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1)
+	packet, err := c.publishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -471,7 +907,7 @@ func (c *Client) PublishAtLeastOnce(message []byte, topic string) (exchange <-ch
 func (c *Client) PublishAtLeastOnceRetained(message []byte, topic string) (exchange <-chan error, err error) {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := publishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1|retainFlag)
+	packet, err := c.publishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1|retainFlag, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -484,7 +920,7 @@ func (c *Client) PublishAtLeastOnceRetained(message []byte, topic string) (excha
 func (c *Client) PublishExactlyOnce(message []byte, topic string) (exchange <-chan error, err error) {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := publishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1)
+	packet, err := c.publishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -499,25 +935,162 @@ func (c *Client) PublishExactlyOnce(message []byte, topic string) (exchange <-ch
 func (c *Client) PublishExactlyOnceRetained(message []byte, topic string) (exchange <-chan error, err error) {
 	buf := bufPool.Get().(*[bufSize]byte)
 	defer bufPool.Put(buf)
-	packet, err := publishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1|retainFlag)
+	packet, err := c.publishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1|retainFlag, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.submitPersisted(packet, &c.exactlyOnce)
+}
+
+// PublishWithProperties is like Publish, but with MQTT 5.0 properties. Protocol
+// levels other than 5 deny properties with an IsDeny error.
+func (c *Client) PublishWithProperties(quit <-chan struct{}, message []byte, topic string, p *Properties) error {
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := c.publishPacket(buf, message, topic, 0, typePUBLISH<<4, p)
+	if err != nil {
+		return err
+	}
+	return c.writePublish(quit, packet)
+}
+
+// PublishAtLeastOnceWithProperties is like PublishAtLeastOnce, but with MQTT
+// 5.0 properties. Protocol levels other than 5 deny properties with an IsDeny
+// error.
+func (c *Client) PublishAtLeastOnceWithProperties(message []byte, topic string, p *Properties) (exchange <-chan error, err error) {
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := c.publishPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1, p)
+	if err != nil {
+		return nil, err
+	}
+	return c.submitPersisted(packet, &c.atLeastOnce)
+}
+
+// PublishExactlyOnceWithProperties is like PublishExactlyOnce, but with MQTT
+// 5.0 properties. Protocol levels other than 5 deny properties with an IsDeny
+// error.
+func (c *Client) PublishExactlyOnceWithProperties(message []byte, topic string, p *Properties) (exchange <-chan error, err error) {
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := c.publishPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1, p)
+	if err != nil {
+		return nil, err
+	}
+	return c.submitPersisted(packet, &c.exactlyOnce)
+}
+
+// PublishBuffers is like Publish, yet the message consists of buffers in order
+// of appearance. The buffers are written as is, without any concatenation.
+func (c *Client) PublishBuffers(quit <-chan struct{}, message net.Buffers, topic string) error {
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := c.publishBuffersPacket(buf, message, topic, 0, typePUBLISH<<4)
+	if err != nil {
+		return err
+	}
+	return c.writePublish(quit, packet)
+}
+
+// PublishAtLeastOnceBuffers is like PublishAtLeastOnce, yet the message
+// consists of buffers in order of appearance. The buffers go to both the
+// Persistence and the network as is, without any concatenation. They must
+// not be modified until the call returns.
+func (c *Client) PublishAtLeastOnceBuffers(message net.Buffers, topic string) (exchange <-chan error, err error) {
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := c.publishBuffersPacket(buf, message, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1)
+	if err != nil {
+		return nil, err
+	}
+	return c.submitPersisted(packet, &c.atLeastOnce)
+}
+
+// PublishExactlyOnceBuffers is like PublishExactlyOnce, yet the message
+// consists of buffers in order of appearance. The buffers go to both the
+// Persistence and the network as is, without any concatenation. They must
+// not be modified until the call returns.
+func (c *Client) PublishExactlyOnceBuffers(message net.Buffers, topic string) (exchange <-chan error, err error) {
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	packet, err := c.publishBuffersPacket(buf, message, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1)
 	if err != nil {
 		return nil, err
 	}
 	return c.submitPersisted(packet, &c.exactlyOnce)
 }
 
+// PublishFrom is like Publish, yet the message consists of size bytes from r.
+// The bytes stream through without a copy in memory. Errors from r are fatal to
+// the connection, as the PUBLISH can not complete. Config.CoalesceMax, and the
+// offline buffer from Config.OfflineBufferMax when down, do read the message
+// into memory instead.
+func (c *Client) PublishFrom(quit <-chan struct{}, r io.Reader, size int, topic string) error {
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	head, err := c.publishHead(buf, size, topic, 0, typePUBLISH<<4, nil)
+	if err != nil {
+		return err
+	}
+	return c.writePublishFrom(quit, head, r, size)
+}
+
+// PublishAtLeastOnceFrom is like PublishAtLeastOnce, yet the message consists
+// of size bytes from r. The bytes are spooled into the Persistence, which must
+// implement Spooler [IsDeny otherwise], and they stream from there onto the
+// network. Resends after a reconnect do load the message into memory.
+func (c *Client) PublishAtLeastOnceFrom(r io.Reader, size int, topic string) (exchange <-chan error, err error) {
+	if _, ok := spoolerOf(c.persistence); !ok {
+		return nil, errNoSpooler
+	}
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	head, err := c.publishHead(buf, size, topic, atLeastOnceIDSpace, typePUBLISH<<4|atLeastOnceLevel<<1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.submitPersistedFrom(head, r, size, &c.atLeastOnce)
+}
+
+// PublishExactlyOnceFrom is like PublishExactlyOnce, yet the message consists
+// of size bytes from r. The bytes are spooled into the Persistence, which must
+// implement Spooler [IsDeny otherwise], and they stream from there onto the
+// network. Resends after a reconnect do load the message into memory.
+func (c *Client) PublishExactlyOnceFrom(r io.Reader, size int, topic string) (exchange <-chan error, err error) {
+	if _, ok := spoolerOf(c.persistence); !ok {
+		return nil, errNoSpooler
+	}
+	buf := bufPool.Get().(*[bufSize]byte)
+	defer bufPool.Put(buf)
+	head, err := c.publishHead(buf, size, topic, exactlyOnceIDSpace, typePUBLISH<<4|exactlyOnceLevel<<1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.submitPersistedFrom(head, r, size, &c.exactlyOnce)
+}
+
 func (c *Client) submitPersisted(packet net.Buffers, t *transfer) (exchange <-chan error, err error) {
+	return c.submitPersistedFrom(packet, nil, 0, t)
+}
+
+// SubmitPersistedFrom is like submitPersisted, yet with size bytes from body
+// as the message. Nil body implies that the packet includes the message.
+func (c *Client) submitPersistedFrom(packet net.Buffers, body io.Reader, size int, t *transfer) (exchange <-chan error, err error) {
 	select {
 	case seqNo, ok := <-t.seqNoSem:
 		if !ok {
 			return nil, fmt.Errorf("%w; PUBLISH unavailable", ErrClosed)
 		}
-		done, err := c.applySeqNoAndEnqueue(packet, seqNo, t)
+		done, err := c.applySeqNoAndEnqueue(packet, body, size, seqNo, t)
 		if err != nil {
 			t.seqNoSem <- seqNo // unlock
 			return nil, err
 		}
-		err = c.writeBuffers(c.Offline(), packet)
+		if body == nil {
+			err = c.writeBuffers(c.Offline(), packet)
+		} else {
+			err = c.writePersisted(packet)
+		}
 		if err != nil {
 			// don't report down
 			if !errors.Is(err, ErrCanceled) && !errors.Is(err, ErrDown) {
@@ -530,7 +1103,7 @@ func (c *Client) submitPersisted(packet net.Buffers, t *transfer) (exchange <-ch
 		return done, nil
 
 	case holdup := <-t.block:
-		done, err := c.applySeqNoAndEnqueue(packet, holdup.UntilSeqNo+1, t)
+		done, err := c.applySeqNoAndEnqueue(packet, body, size, holdup.UntilSeqNo+1, t)
 		if err != nil {
 			t.block <- holdup // unlock
 			return nil, err
@@ -541,10 +1114,28 @@ func (c *Client) submitPersisted(packet net.Buffers, t *transfer) (exchange <-ch
 	}
 }
 
-func (c *Client) applySeqNoAndEnqueue(packet net.Buffers, seqNo uint, t *transfer) (done chan error, err error) {
+// ApplySeqNoAndEnqueue must be called with the sequence number lock of t held,
+// either from the seqNoSem or from the block.
+func (c *Client) applySeqNoAndEnqueue(packet net.Buffers, body io.Reader, size int, seqNo uint, t *transfer) (done chan error, err error) {
+	// The lock makes DisconnectDrain await any submission in progress.
+	if c.isDraining() {
+		return nil, fmt.Errorf("%w; PUBLISH unavailable", ErrClosed)
+	}
 	if cap(t.q) == len(t.q) {
 		return nil, fmt.Errorf("%w; PUBLISH unavailable", ErrMax)
 	}
+	if max := atomic.LoadUint32(&c.receiveMax); max != 0 {
+		// “The Client MUST NOT send more than Receive Maximum QoS 1
+		// and QoS 2 PUBLISH packets for which it has not received
+		// PUBACK, PUBCOMP, or PUBREC with a Reason Code of 128 or
+		// greater from the Server.”
+		// — MQTT Version 5.0, conformance statement MQTT-3.3.4-7
+		c.receiveMaxLock.Lock()
+		defer c.receiveMaxLock.Unlock()
+		if uint32(len(c.atLeastOnce.q)+len(c.exactlyOnce.q)) >= max {
+			return nil, fmt.Errorf("%w; PUBLISH unavailable due broker Receive Maximum", ErrMax)
+		}
+	}
 
 	// apply sequence number to packet
 	buf := packet[0]
@@ -553,25 +1144,95 @@ func (c *Client) applySeqNoAndEnqueue(packet net.Buffers, seqNo uint, t *transfe
 	packetID |= seqNo & publishIDMask
 	binary.BigEndian.PutUint16(buf[i:], uint16(packetID))
 
-	err = c.persistence.Save(packetID, packet)
+	if body == nil {
+		err = c.persistence.Save(packetID, packet)
+	} else {
+		err = c.spool(packetID, packet, body, size)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("%w; PUBLISH dropped", err)
 	}
+	c.outbound.add(packetID, seqNo, packet, size)
 
-	done = make(chan error, 2) // receives at most 1 write error + ErrClosed
-	t.q <- done                // won't block due ErrMax check
+	// receives at most 1 write error, plus either a reason code or ErrClosed
+	done = make(chan error, 2)
+	t.q <- done // won't block due ErrMax check
 	return done, nil
 }
 
-func publishPacket(buf *[bufSize]byte, message []byte, topic string, packetID uint, head byte) (net.Buffers, error) {
-	if err := topicCheck(topic); err != nil {
+// Spool saves the packet with size bytes from body as the message.
+func (c *Client) spool(packetID uint, packet net.Buffers, body io.Reader, size int) error {
+	s, ok := spoolerOf(c.persistence)
+	if !ok {
+		return errNoSpooler
+	}
+	readers := make([]io.Reader, 0, len(packet)+1)
+	valueSize := size
+	for _, buf := range packet {
+		readers = append(readers, bytes.NewReader(buf))
+		valueSize += len(buf)
+	}
+	readers = append(readers, io.LimitReader(body, int64(size)))
+	return s.SaveFrom(packetID, io.MultiReader(readers...), valueSize)
+}
+
+// WritePersisted submits a spooled packet from the Persistence, identified by
+// the packet identifier at the end of the first buffer.
+func (c *Client) writePersisted(packet net.Buffers) error {
+	s, ok := spoolerOf(c.persistence)
+	if !ok {
+		return errNoSpooler
+	}
+	buf := packet[0]
+	key := uint(binary.BigEndian.Uint16(buf[len(buf)-2:]))
+	value, size, err := s.Open(key)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return fmt.Errorf("mqtt: persistence key %#04x gone missing 👻", key)
+	}
+	defer value.Close()
+	return c.writeFrom(c.Offline(), nil, value, size)
+}
+
+// PublishPacket composes a PUBLISH with the packet identifier (if any) at the
+// end of the first buffer. MQTT 5.0 puts the properties in a dedicated buffer.
+func (c *Client) publishPacket(buf *[bufSize]byte, message []byte, topic string, packetID uint, head byte, p *Properties) (net.Buffers, error) {
+	packet, err := c.publishHead(buf, len(message), topic, packetID, head, p)
+	if err != nil {
+		return nil, err
+	}
+	return append(packet, message), nil
+}
+
+// PublishBuffersPacket is like publishPacket, yet with the message in buffers.
+func (c *Client) publishBuffersPacket(buf *[bufSize]byte, message net.Buffers, topic string, packetID uint, head byte) (net.Buffers, error) {
+	var size int
+	for _, b := range message {
+		size += len(b)
+	}
+	packet, err := c.publishHead(buf, size, topic, packetID, head, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(packet, message...), nil
+}
+
+// PublishHead is like publishPacket, yet without the message itself.
+func (c *Client) publishHead(buf *[bufSize]byte, messageSize int, topic string, packetID uint, head byte, p *Properties) (net.Buffers, error) {
+	if err := topics.CheckName(topic); err != nil {
 		return nil, fmt.Errorf("mqtt: PUBLISH request denied due topic: %w", err)
 	}
-	size := 2 + len(topic) + len(message)
+	props, err := c.publishProperties(p)
+	if err != nil {
+		return nil, err
+	}
+	size := 2 + len(topic) + len(props) + messageSize
 	if packetID != 0 {
 		size += 2
 	}
-	if size < 0 || size > packetMax {
+	if messageSize < 0 || size < 0 || size > packetMax {
 		return nil, fmt.Errorf("mqtt: PUBLISH request denied: %w", errPacketMax)
 	}
 
@@ -581,21 +1242,27 @@ func publishPacket(buf *[bufSize]byte, message []byte, topic string, packetID ui
 		packet = append(packet, byte(l|0x80))
 	}
 	packet = append(packet, byte(l))
+	if max := atomic.LoadUint32(&c.packetSizeMax); max != 0 && uint64(len(packet)+size) > uint64(max) {
+		return nil, fmt.Errorf("mqtt: PUBLISH request denied due broker Maximum Packet Size: %w", errPacketMax)
+	}
 	packet = append(packet, byte(len(topic)>>8), byte(len(topic)))
 	packet = append(packet, topic...)
 	if packetID != 0 {
 		packet = append(packet, byte(packetID>>8), byte(packetID))
 	}
-	return net.Buffers{packet, message}, nil
+	if props != nil {
+		return net.Buffers{packet, props}, nil
+	}
+	return net.Buffers{packet}, nil
 }
 
 // OnPUBACK applies the confirm of a PublishAtLeastOnce.
 func (c *Client) onPUBACK() error {
 	// parse packet
-	if len(c.peek) != 2 {
-		return fmt.Errorf("%w: PUBACK with %d byte remaining length", errProtoReset, len(c.peek))
+	packetID, code, err := c.peekAck("PUBACK")
+	if err != nil {
+		return err
 	}
-	packetID := uint(binary.BigEndian.Uint16(c.peek))
 
 	// match identifier
 	expect := c.orderedTxs.Acked&publishIDMask | atLeastOnceIDSpace
@@ -611,22 +1278,33 @@ func (c *Client) onPUBACK() error {
 	}
 
 	// ceil transaction
-	err := c.persistence.Delete(packetID)
+	err = c.persistence.Delete(packetID)
 	if err != nil {
 		return err // causes resubmission of PUBLISH
 	}
+	c.outbound.remove(packetID)
 	c.orderedTxs.Acked++
-	close(<-c.atLeastOnce.q)
+	reject(<-c.atLeastOnce.q, code)
+	c.drainProgress()
 	return nil
 }
 
+// Reject passes a failure reason code, if any, to the exchange channel, and it
+// closes the channel.
+func reject(ch chan<- error, code ReasonCode) {
+	if code >= 0x80 {
+		ch <- code // won't block due exchange capacity
+	}
+	close(ch)
+}
+
 // OnPUBREC applies the first confirm of a PublishExactlyOnce.
 func (c *Client) onPUBREC() error {
 	// parse packet
-	if len(c.peek) != 2 {
-		return fmt.Errorf("%w: PUBREC with %d byte remaining length", errProtoReset, len(c.peek))
+	packetID, code, err := c.peekAck("PUBREC")
+	if err != nil {
+		return err
 	}
-	packetID := uint(binary.BigEndian.Uint16(c.peek))
 
 	// match identifier
 	expect := c.orderedTxs.Received&publishIDMask | exactlyOnceIDSpace
@@ -641,13 +1319,34 @@ func (c *Client) onPUBREC() error {
 		return fmt.Errorf("%w: PUBREC precedes PUBLISH", errProtoReset)
 	}
 
+	// “If PUBACK or PUBREC is received containing a Reason Code of 0x80 or
+	// greater the corresponding PUBLISH packet is treated as acknowledged,
+	// and MUST NOT be retransmitted.”
+	// — MQTT Version 5.0, conformance statement MQTT-4.4.0-2
+	if code >= 0x80 {
+		// The PUBREC replaces the PUBLISH in Persistence. A delete
+		// would leave a gap in the sequence until the exchange ends.
+		err = c.persistence.Save(packetID, net.Buffers{failedMarker(packetID, code)})
+		if err != nil {
+			return err // causes resubmission of PUBLISH
+		}
+		c.outbound.remove(packetID)
+		c.orderedTxs.Received++
+		if c.orderedTxs.Failed == nil {
+			c.orderedTxs.Failed = make(map[uint]ReasonCode)
+		}
+		c.orderedTxs.Failed[packetID] = code
+		return c.endFailed()
+	}
+
 	// Use pendingAck as a buffer here.
 	c.pendingAck = append(c.pendingAck[:0], typePUBREL<<4|atLeastOnceLevel<<1, 2, byte(packetID>>8), byte(packetID))
-	err := c.persistence.Save(packetID, net.Buffers{c.pendingAck})
+	err = c.persistence.Save(packetID, net.Buffers{c.pendingAck})
 	if err != nil {
 		c.pendingAck = c.pendingAck[:0]
 		return err // causes resubmission of PUBLISH (from persistence)
 	}
+	c.outbound.release(packetID)
 	c.orderedTxs.Received++
 
 	err = c.write(nil, c.pendingAck)
@@ -658,13 +1357,42 @@ func (c *Client) onPUBREC() error {
 	return nil
 }
 
+// FailedMarker returns the Persistence value of a PUBREC failure [MQTT 5.0],
+// which is the PUBREC packet without properties.
+func failedMarker(packetID uint, code ReasonCode) []byte {
+	return []byte{typePUBREC << 4, 3, byte(packetID >> 8), byte(packetID), byte(code)}
+}
+
+// EndFailed completes any PUBREC failures [MQTT 5.0] from the head of the
+// exactly-once queue, as the exchanges are in order of submission. Delete
+// errors leave the remainder for the next attempt.
+func (c *Client) endFailed() error {
+	for c.orderedTxs.Completed != c.orderedTxs.Received {
+		packetID := c.orderedTxs.Completed&publishIDMask | exactlyOnceIDSpace
+		code, ok := c.orderedTxs.Failed[packetID]
+		if !ok {
+			return nil // awaits PUBCOMP
+		}
+		if err := c.persistence.Delete(packetID); err != nil {
+			return err
+		}
+		delete(c.orderedTxs.Failed, packetID)
+		c.orderedTxs.Completed++
+		reject(<-c.exactlyOnce.q, code)
+		c.drainProgress()
+	}
+	return nil
+}
+
 // OnPUBCOMP applies the second (and final) confirm of a PublishExactlyOnce.
 func (c *Client) onPUBCOMP() error {
 	// parse packet
-	if len(c.peek) != 2 {
-		return fmt.Errorf("%w: PUBCOMP with %d byte remaining length", errProtoReset, len(c.peek))
+	// The reason code is ignored, because the PUBREC confirmed reception
+	// already. Packet Identifier not found may occur on PUBREL resends.
+	packetID, _, err := c.peekAck("PUBCOMP")
+	if err != nil {
+		return err
 	}
-	packetID := uint(binary.BigEndian.Uint16(c.peek))
 
 	// match identifier
 	expect := c.orderedTxs.Completed&publishIDMask | exactlyOnceIDSpace
@@ -680,13 +1408,15 @@ func (c *Client) onPUBCOMP() error {
 	}
 
 	// ceil transaction
-	err := c.persistence.Delete(packetID)
+	err = c.persistence.Delete(packetID)
 	if err != nil {
 		return err // causes resubmission of PUBREL (from Persistence)
 	}
+	c.outbound.remove(packetID)
 	c.orderedTxs.Completed++
 	close(<-c.exactlyOnce.q)
-	return nil
+	c.drainProgress()
+	return c.endFailed()
 }
 
 // InitSession configures the Persistence for first use. Brokers use clientID to
@@ -712,6 +1442,11 @@ func initSession(clientID string, p Persistence, c *Config) (*Client, error) {
 	if err := stringCheck(clientID); err != nil {
 		return nil, fmt.Errorf("mqtt: illegal client identifier: %w", err)
 	}
+	if c.ProtocolLevel == 3 {
+		if err := clientIDCheck31(clientID); err != nil {
+			return nil, err
+		}
+	}
 	if err := c.valid(); err != nil {
 		return nil, err
 	}
@@ -734,12 +1469,51 @@ func initSession(clientID string, p Persistence, c *Config) (*Client, error) {
 	return newClient(p, c), nil
 }
 
+// ClientIDCheck31 enforces the size limits of MQTT 3.1.
+func clientIDCheck31(clientID string) error {
+	// “The Client Identifier (Client ID) is between 1 and 23 characters
+	// long, …”
+	// — MQTT V3.1 Protocol Specification, subsection 3.1
+	if clientID == "" || len(clientID) > 23 {
+		return fmt.Errorf("mqtt: illegal client identifier: MQTT 3.1 requires 1 to 23 bytes, got %d", len(clientID))
+	}
+	return nil
+}
+
 // AdoptSession continues with a Persistence which had an InitSession already.
+// Corrupt records are deleted, with a warning for each. Integrity violations
+// match *CorruptionError with errors.As. Records from previous versions of this
+// package get rewritten in the current format.
 func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal error) {
 	if err := c.valid(); err != nil {
 		return nil, warn, err
 	}
 
+	if r, ok := p.(keyRotator); ok {
+		rotateWarn, err := r.rotateKeys()
+		warn = append(warn, rotateWarn...)
+		if err != nil {
+			return nil, warn, err
+		}
+	}
+
+	if c.ProtocolLevel == 3 {
+		value, err := p.Load(clientIDKey)
+		if err != nil {
+			return nil, warn, err
+		}
+		var clientID []byte
+		if value != nil {
+			clientID, _, _, err = decodeValue(clientIDKey, value)
+			if err != nil {
+				return nil, warn, err
+			}
+		}
+		if err := clientIDCheck31(string(clientID)); err != nil {
+			return nil, warn, err
+		}
+	}
+
 	keys, err := p.List()
 	if err != nil {
 		return nil, warn, err
@@ -749,22 +1523,43 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 	seqNos := make(seqNos, 0, len(keys))
 	keyPerSeqNo := make(map[uint64]uint, len(keys))
 	PUBRELPerKey := make(map[uint][]byte)
+	failedPerKey := make(map[uint]ReasonCode)
+	pendingPerKey := make(map[uint]Pending)
+	var subscriptionsPerFilter map[string]subscription
 	for _, key := range keys {
 		if key == clientIDKey || key&remoteIDKeyFlag != 0 {
+			// content is loaded on demand
+			if err := migrateKey(p, key); err != nil {
+				warn = append(warn, err)
+			}
+			continue
+		}
+		if key == subscriptionsKey {
+			subscriptionsPerFilter, err = loadSubscriptions(p)
+			if err != nil {
+				warn = append(warn, err)
+			}
 			continue
 		}
 		value, err := p.Load(key)
-		if err != nil {
+		var corrupt *CorruptionError
+		if err != nil && !errors.As(err, &corrupt) {
 			return nil, warn, err
 		}
+		var packet []byte
+		var seqNo uint64
+		var version byte
+		if err == nil {
+			packet, seqNo, version, err = decodeValue(key, value)
+		}
 
-		switch packet, seqNo, ok := decodeValue(value); {
-		case !ok:
-			err := p.Delete(key)
-			if err != nil {
-				warn = append(warn, fmt.Errorf("mqtt: corrupt persistence record %#x not deleted: %w", key, err))
+		switch {
+		case err != nil:
+			deleteErr := p.Delete(key)
+			if deleteErr != nil {
+				warn = append(warn, fmt.Errorf("%w; not deleted: %s", err, deleteErr))
 			} else {
-				warn = append(warn, fmt.Errorf("mqtt: corrupt persistence record %#x deleted", key))
+				warn = append(warn, fmt.Errorf("%w; deleted", err))
 			}
 
 		case len(packet) == 0:
@@ -776,10 +1571,27 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 			}
 
 		default:
+			if version != envelopeCRC32C {
+				if err := migrateValue(p, key, packet, seqNo); err != nil {
+					warn = append(warn, err)
+				}
+			}
 			seqNos = append(seqNos, seqNo)
 			keyPerSeqNo[seqNo] = key
-			if packet[0]>>4 == typePUBREL {
+			switch packet[0] >> 4 {
+			case typePUBREL:
 				PUBRELPerKey[key] = packet
+			case typePUBREC:
+				// failure marker from onPUBREC
+				code := ReasonCode(0x80)
+				if len(packet) > 4 {
+					code = ReasonCode(packet[4])
+				}
+				failedPerKey[key] = code
+				continue
+			}
+			if qosOfKey(key) != 0 {
+				pendingPerKey[key] = persistedPending(key, packet)
 			}
 		}
 	}
@@ -795,6 +1607,21 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 			exactlyOnceKeys = append(exactlyOnceKeys, key)
 		}
 	}
+	// PUBREL and PUBREC failure records replace their PUBLISH. They
+	// precede any PUBLISH, regardless of their (later) sequence number.
+	received := make([]uint, 0, len(exactlyOnceKeys))
+	var published []uint
+	for _, key := range exactlyOnceKeys {
+		_, isPUBREL := PUBRELPerKey[key]
+		_, isFailed := failedPerKey[key]
+		if isPUBREL || isFailed {
+			received = append(received, key)
+		} else {
+			published = append(published, key)
+		}
+	}
+	exactlyOnceKeys = append(received, published...)
+
 	atLeastOnceKeys = cleanSeq(atLeastOnceKeys, "at-least-once", p, &warn)
 	exactlyOnceKeys = cleanSeq(exactlyOnceKeys, "exactly-once", p, &warn)
 
@@ -805,6 +1632,22 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 		return nil, warn, fmt.Errorf("mqtt: %d ExactlyOnceMax is less than %d pending from Persistence", c.ExactlyOnceMax, len(exactlyOnceKeys))
 	}
 	client = newClient(&ruggedPersistence{Persistence: p}, c)
+	client.sessionExpect = !c.CleanSession
+	if subscriptionsPerFilter != nil {
+		// requested again when the session is not present
+		client.subscriptions.perFilter = subscriptionsPerFilter
+	}
+	client.outbound.adopted = time.Now()
+	client.outbound.perPacketID = make(map[uint]*Pending, len(atLeastOnceKeys)+len(exactlyOnceKeys))
+	for _, keys := range [][]uint{atLeastOnceKeys, exactlyOnceKeys} {
+		for _, key := range keys {
+			p, ok := pendingPerKey[key]
+			if !ok {
+				continue // failure marker
+			}
+			client.outbound.perPacketID[key] = &p
+		}
+	}
 
 	// “When a Client reconnects with CleanSession set to 0, both the Client
 	// and Server MUST re-send any unacknowledged PUBLISH Packets (where QoS
@@ -814,7 +1657,7 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 	if len(atLeastOnceKeys) != 0 {
 		client.orderedTxs.Acked = atLeastOnceKeys[0] & publishIDMask
 		for range atLeastOnceKeys {
-			client.atLeastOnce.q <- make(chan<- error, 1) // won't block due Max check above
+			client.atLeastOnce.q <- make(chan<- error, 2) // won't block due Max check above
 		}
 		<-client.atLeastOnce.seqNoSem
 		client.atLeastOnce.block <- holdup{
@@ -826,10 +1669,19 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 	if len(exactlyOnceKeys) != 0 {
 		client.orderedTxs.Completed = exactlyOnceKeys[0] & publishIDMask
 		for range exactlyOnceKeys {
-			client.exactlyOnce.q <- make(chan<- error, 1) // won't block due Max check above
+			client.exactlyOnce.q <- make(chan<- error, 2) // won't block due Max check above
+		}
+		for key, code := range failedPerKey {
+			if client.orderedTxs.Failed == nil {
+				client.orderedTxs.Failed = make(map[uint]ReasonCode)
+			}
+			client.orderedTxs.Failed[key] = code
 		}
 		var pubN int
 		for i, key := range exactlyOnceKeys {
+			if _, ok := failedPerKey[key]; ok {
+				continue // received
+			}
 			packet, ok := PUBRELPerKey[key]
 			if !ok {
 				pubN = len(exactlyOnceKeys) - i
@@ -851,11 +1703,58 @@ func AdoptSession(p Persistence, c *Config) (client *Client, warn []error, fatal
 				UntilSeqNo: exactlyOnceKeys[len(exactlyOnceKeys)-1],
 			}
 		}
+		// failures at the head of the queue end here
+		if err := client.endFailed(); err != nil {
+			warn = append(warn, fmt.Errorf("mqtt: PUBREC failure record not deleted: %w", err))
+		}
 	}
 
 	return client, warn, nil
 }
 
+// MigrateKey rewrites a record from a legacy envelope, if any, in the current
+// format. Integrity violations are left for the load on demand.
+func migrateKey(p Persistence, key uint) error {
+	value, err := p.Load(key)
+	if err != nil {
+		return fmt.Errorf("mqtt: persistence value from key %#x not migrated: %w", key, err)
+	}
+	packet, seqNo, version, err := decodeValue(key, value)
+	if err != nil || version == envelopeCRC32C {
+		return nil
+	}
+	return migrateValue(p, key, packet, seqNo)
+}
+
+// LoadSubscriptions reads the subscriptionsKey record. Any errors are warnings,
+// as the broker session may still have the subscriptions.
+func loadSubscriptions(p Persistence) (map[string]subscription, error) {
+	value, err := p.Load(subscriptionsKey)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: subscriptions lost on persistence load: %w", err)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	packet, seqNo, version, err := decodeValue(subscriptionsKey, value)
+	if err == nil {
+		var perFilter map[string]subscription
+		perFilter, err = decodeSubscriptions(packet)
+		if err == nil {
+			if version != envelopeCRC32C {
+				// loss of migration is harmless
+				migrateValue(p, subscriptionsKey, packet, seqNo)
+			}
+			return perFilter, nil
+		}
+	}
+
+	if deleteErr := p.Delete(subscriptionsKey); deleteErr != nil {
+		return nil, fmt.Errorf("%w; not deleted: %s", err, deleteErr)
+	}
+	return nil, fmt.Errorf("%w; deleted", err)
+}
+
 // SeqNos sorts ruggedPersistence sequence numbers chronologicaly.
 type seqNos []uint64
 
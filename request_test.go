@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -147,6 +149,60 @@ func TestPublish(t *testing.T) {
 	<-brokerMockDone
 }
 
+func TestPublishBuffers(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x30, 12,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			'h', 'e', 'l', 'l', 'o'}))
+	})
+
+	err := client.PublishBuffers(nil, net.Buffers{[]byte("he"), nil, []byte("llo")}, "greet")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+}
+
+func TestPublishFrom(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x30, 12,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			'h', 'e', 'l', 'l', 'o'}))
+	})
+
+	err := client.PublishFrom(nil, strings.NewReader("hello"), 5, "greet")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+}
+
+func TestPublishFromShort(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		var buf [9]byte // PUBLISH header only
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			t.Fatal("broker read error:", err)
+		}
+		if got, want := hex.EncodeToString(buf[:]), "300c00056772656574"; got != want {
+			t.Errorf("got partial packet %s, want %s", got, want)
+		}
+		if n, err := conn.Read(buf[:]); err == nil {
+			t.Errorf("broker read got %#x after short message, want connection close", buf[:n])
+		}
+	})
+
+	err := client.PublishFrom(nil, strings.NewReader("hel"), 5, "greet")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v, want an io.ErrUnexpectedEOF", err)
+	}
+	<-brokerMockDone
+}
+
 func TestPublishReqTimeout(t *testing.T) {
 	client, conn := newClientPipe(t)
 	testRoutine(t, func() {
@@ -186,6 +242,82 @@ func TestPublishAtLeastOnce(t *testing.T) {
 	<-brokerMockDone
 }
 
+func TestPublishAtLeastOnceBuffers(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x32, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0x80, 0x00, // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+		sendPacketHex(t, conn, "40028000") // PUBACK
+	})
+
+	ack, err := client.PublishAtLeastOnceBuffers(net.Buffers{[]byte("hel"), []byte("lo")}, "greet")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	testAck(t, ack)
+	<-brokerMockDone
+}
+
+func TestPublishAtLeastOnceBuffersPersisted(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.InitSession("test-client", mqtt.FileSystem(t.TempDir()), &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		AtLeastOnceMax: 2,
+		Dialer:         newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("InitSession error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101700044d51545404000000000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+
+	// many buffers leave spare capacity in the packet
+	message := make(net.Buffers, 10)
+	for i := range message {
+		message[i] = []byte{'a' + byte(i)}
+	}
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, hex.EncodeToString(append([]byte{
+			0x32, 15,
+			0, 1, 'x',
+			0x80, 0x00}, // packet identifier
+			"abcdefghij"...)))
+		sendPacketHex(t, brokerConn, "40028000") // PUBACK
+	})
+
+	ack, err := client.PublishAtLeastOnceBuffers(message, "x")
+	if err != nil {
+		t.Fatalf("got error %q [%T]", err, err)
+	}
+	testAck(t, ack)
+	<-brokerMockDone
+}
+
+func TestPublishAtLeastOnceFrom(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x32, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0x80, 0x00, // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+		sendPacketHex(t, conn, "40028000") // PUBACK
+	})
+
+	ack, err := client.PublishAtLeastOnceFrom(strings.NewReader("hello"), 5, "greet")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	testAck(t, ack)
+	<-brokerMockDone
+}
+
 func TestPublishAtLeastOnceReqTimeout(t *testing.T) {
 	client, conn := newClientPipe(t)
 	brokerMockDone := testRoutine(t, func() {
@@ -233,7 +365,7 @@ func TestPublishAtLeastOnceResend(t *testing.T) {
 		}
 
 		wantPacketHex(t, conns[1], pipeCONNECTHex)
-		sendPacketHex(t, conns[1], "20020000") // CONNACK
+		sendPacketHex(t, conns[1], "20020100") // CONNACK with session present
 		wantPacketHex(t, conns[1], hex.EncodeToString([]byte{
 			0x3a, 6, // with duplicate [DUP] flag
 			0, 1, 'y',
@@ -250,6 +382,59 @@ func TestPublishAtLeastOnceResend(t *testing.T) {
 	<-brokerMockDone
 }
 
+func TestPublishAtLeastOncePurge(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF})
+	purged := make(chan struct{})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conns[0], hex.EncodeToString([]byte{
+			0x32, 6,
+			0, 1, 'x',
+			0x80, 0x00, // 1st packet identifier
+			'1'}))
+		wantPacketHex(t, conns[0], hex.EncodeToString([]byte{
+			0x32, 6,
+			0, 1, 'x',
+			0x80, 0x01, // 2nd packet identifier
+			'2'}))
+		<-purged
+		if err := conns[0].Close(); err != nil {
+			t.Fatal("broker got error on first connection close:", err)
+		}
+
+		wantPacketHex(t, conns[1], pipeCONNECTHex)
+		sendPacketHex(t, conns[1], "20020100") // CONNACK with session present
+		wantPacketHex(t, conns[1], hex.EncodeToString([]byte{
+			0x3a, 6, // with duplicate [DUP] flag
+			0, 1, 'x',
+			0x80, 0x01, // 2nd packet identifier
+			'2'}))
+		sendPacketHex(t, conns[1], "40028001") // PUBACK 2nd
+	})
+
+	ack1, err := client.PublishAtLeastOnce([]byte{'1'}, "x")
+	if err != nil {
+		t.Errorf("publish #1 got error %q [%T]", err, err)
+	}
+	time.Sleep(time.Second / 16)
+	ack2, err := client.PublishAtLeastOnce([]byte{'2'}, "x")
+	if err != nil {
+		t.Errorf("publish #2 got error %q [%T]", err, err)
+	}
+	client.PurgeAtLeastOnce(time.Second / 32)
+	close(purged)
+
+	select {
+	case <-time.After(time.Second):
+		t.Error("publish #1 exchange timeout")
+	case err := <-ack1:
+		if !errors.Is(err, mqtt.ErrExpired) {
+			t.Errorf("publish #1 got exchange error %v, want mqtt.ErrExpired", err)
+		}
+	}
+	testAck(t, ack2)
+	<-brokerMockDone
+}
+
 func TestPublishAtLeastOnceRestart(t *testing.T) {
 	t.Parallel()
 
@@ -329,7 +514,7 @@ func TestPublishAtLeastOnceRestart(t *testing.T) {
 	}
 	testClient(t, client)
 	wantPacketHex(t, brokerConn, "101700044d51545404000000000b746573742d636c69656e74")
-	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+	sendPacketHex(t, brokerConn, "20020100") // CONNACK with session present
 	wantPacketHex(t, brokerConn, hex.EncodeToString([]byte{
 		0x3a, 6, // with duplicate [DUP] flag
 		0, 1, 'x',
@@ -365,6 +550,48 @@ func TestPublishExactlyOnce(t *testing.T) {
 	<-brokerMockDone
 }
 
+func TestPublishExactlyOnceBuffers(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x34, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0xc0, 0x00, // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+		sendPacketHex(t, conn, "5002c000") // PUBREC
+		wantPacketHex(t, conn, "6202c000") // PUBREL
+		sendPacketHex(t, conn, "7002c000") // PUBCOMP
+	})
+
+	ack, err := client.PublishExactlyOnceBuffers(net.Buffers{[]byte("h"), []byte("ell"), []byte("o")}, "greet")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	testAck(t, ack)
+	<-brokerMockDone
+}
+
+func TestPublishExactlyOnceFrom(t *testing.T) {
+	client, conn := newClientPipe(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x34, 14,
+			0, 5, 'g', 'r', 'e', 'e', 't',
+			0xc0, 0x00, // packet identifier
+			'h', 'e', 'l', 'l', 'o'}))
+		sendPacketHex(t, conn, "5002c000") // PUBREC
+		wantPacketHex(t, conn, "6202c000") // PUBREL
+		sendPacketHex(t, conn, "7002c000") // PUBCOMP
+	})
+
+	ack, err := client.PublishExactlyOnceFrom(strings.NewReader("hello"), 5, "greet")
+	if err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	testAck(t, ack)
+	<-brokerMockDone
+}
+
 func TestPublishExactlyOnceReqTimeout(t *testing.T) {
 	client, conn := newClientPipe(t)
 	brokerMockDone := testRoutine(t, func() {
@@ -443,9 +670,10 @@ func TestAbandon(t *testing.T) {
 }
 
 func TestBreak(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF})
+	// timeout starts after the parallel wait of newClientPipeN
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF})
 
 	pingDone := testRoutine(t, func() {
 		err := client.Ping(ctx.Done())
@@ -505,6 +733,20 @@ func TestDeny(t *testing.T) {
 		t.Errorf("subscribe with broken UTF-8 got error %q [%T], want an mqtt.IsDeny", err, err)
 	}
 
+	// wildcard validation
+	err = client.Publish(nil, nil, "topic/with/#")
+	if !mqtt.IsDeny(err) {
+		t.Errorf("publish with wildcard in topic got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+	err = client.Subscribe(nil, "filter/#/not/last")
+	if !mqtt.IsDeny(err) {
+		t.Errorf("subscribe with multi-level wildcard not last got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+	err = client.Unsubscribe(nil, "filter/with+/mix")
+	if !mqtt.IsDeny(err) {
+		t.Errorf("unsubscribe with wildcard mix got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+
 	err = client.Subscribe(nil)
 	if !mqtt.IsDeny(err) {
 		t.Errorf("subscribe with nothing got error %q [%T], want an mqtt.IsDeny", err, err)
@@ -582,3 +824,468 @@ func testAckClosed(t *testing.T, ack <-chan error) {
 		}
 	}
 }
+
+func TestResubscribe(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF}, mqtttest.Transfer{Err: mqtt.ErrSessionLost})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conns[0], "820c60000003612f2b0100012301") // SUBSCRIBE
+		sendPacketHex(t, conns[0], "900460000180")                 // SUBACK
+	})
+	err := client.SubscribeLimitAtLeastOnce(nil, "a/+", "#")
+	var subscribeErr mqtt.SubscribeError
+	if !errors.As(err, &subscribeErr) || len(subscribeErr) != 1 || subscribeErr[0] != "#" {
+		t.Errorf("got error %q [%T], want a SubscribeError for \"#\"", err, err)
+	}
+	<-brokerMockDone
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, conns[0], "8206600100017802") // SUBSCRIBE
+		sendPacketHex(t, conns[0], "9003600102")       // SUBACK
+	})
+	if err := client.Subscribe(nil, "x"); err != nil {
+		t.Errorf("got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+
+	want := []mqtt.Subscription{{TopicFilter: "a/+", Level: 1}, {TopicFilter: "x", Level: 2}}
+	if got := client.Subscriptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got subscriptions %+v, want %+v", got, want)
+	}
+
+	if err := conns[0].Close(); err != nil {
+		t.Fatal("broker got error on first connection close:", err)
+	}
+	wantPacketHex(t, conns[1], pipeCONNECTHex)
+	sendPacketHex(t, conns[1], "20020000")             // CONNACK without session present
+	wantPacketHex(t, conns[1], "820860020003612f2b01") // SUBSCRIBE level 1 again
+	wantPacketHex(t, conns[1], "8206600300017802")     // SUBSCRIBE level 2 again
+	sendPacketHex(t, conns[1], "9003600200")           // SUBACK with downgrade
+	sendPacketHex(t, conns[1], "9003600380")           // SUBACK with failure
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, conns[1], "c000") // PINGREQ
+		sendPacketHex(t, conns[1], "d000") // PINGRESP
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Errorf("ping got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+
+	want = []mqtt.Subscription{{TopicFilter: "a/+", Level: 0}}
+	if got := client.Subscriptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got subscriptions %+v after reconnect, want %+v", got, want)
+	}
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, conns[1], "a20740040003612f2b") // UNSUBSCRIBE
+		sendPacketHex(t, conns[1], "b0024004")           // UNSUBACK
+	})
+	if err := client.Unsubscribe(nil, "a/+"); err != nil {
+		t.Errorf("unsubscribe got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	if got := client.Subscriptions(); len(got) != 0 {
+		t.Errorf("got subscriptions %+v after unsubscribe, want none", got)
+	}
+}
+
+func TestSubscribeUnconfirmed(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF})
+	quit := make(chan struct{})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conns[0], "8206600000016102") // SUBSCRIBE
+		close(quit)
+	})
+	if err := client.Subscribe(quit, "a"); !errors.Is(err, mqtt.ErrAbandoned) {
+		t.Errorf("subscribe got error %q [%T], want an mqtt.ErrAbandoned", err, err)
+	}
+	<-brokerMockDone
+	if got := client.Subscriptions(); len(got) != 0 {
+		t.Errorf("got subscriptions %+v without SUBACK, want none", got)
+	}
+
+	if err := conns[0].Close(); err != nil {
+		t.Fatal("broker got error on first connection close:", err)
+	}
+	wantPacketHex(t, conns[1], pipeCONNECTHex)
+	sendPacketHex(t, conns[1], "20020100")         // CONNACK with session present
+	wantPacketHex(t, conns[1], "8206600100016102") // SUBSCRIBE again
+	sendPacketHex(t, conns[1], "9003600101")       // SUBACK with downgrade
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, conns[1], "c000") // PINGREQ
+		sendPacketHex(t, conns[1], "d000") // PINGRESP
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Errorf("ping got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	want := []mqtt.Subscription{{TopicFilter: "a", Level: 1}}
+	if got := client.Subscriptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got subscriptions %+v after reconnect, want %+v", got, want)
+	}
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, conns[1], "8206600200016100") // SUBSCRIBE
+		sendPacketHex(t, conns[1], "9003600280")       // SUBACK with failure
+	})
+	err := client.SubscribeLimitAtMostOnce(nil, "a")
+	var subscribeErr mqtt.SubscribeError
+	if !errors.As(err, &subscribeErr) {
+		t.Errorf("subscribe got error %q [%T], want a SubscribeError", err, err)
+	}
+	<-brokerMockDone
+	// broker retains the existing subscription
+	if got := client.Subscriptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got subscriptions %+v after failed subscribe, want %+v", got, want)
+	}
+}
+
+func TestUnsubscribeUnconfirmed(t *testing.T) {
+	client, conns := newClientPipeN(t, 2, mqtttest.Transfer{Err: io.EOF})
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conns[0], "8206600000016102") // SUBSCRIBE
+		sendPacketHex(t, conns[0], "9003600002")       // SUBACK
+	})
+	if err := client.Subscribe(nil, "a"); err != nil {
+		t.Errorf("subscribe got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+
+	quit := make(chan struct{})
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, conns[0], "a2054001000161") // UNSUBSCRIBE
+		close(quit)
+	})
+	if err := client.Unsubscribe(quit, "a"); !errors.Is(err, mqtt.ErrAbandoned) {
+		t.Errorf("unsubscribe got error %q [%T], want an mqtt.ErrAbandoned", err, err)
+	}
+	<-brokerMockDone
+	if got := client.Subscriptions(); len(got) != 0 {
+		t.Errorf("got subscriptions %+v without UNSUBACK, want none", got)
+	}
+
+	if err := conns[0].Close(); err != nil {
+		t.Fatal("broker got error on first connection close:", err)
+	}
+	wantPacketHex(t, conns[1], pipeCONNECTHex)
+	sendPacketHex(t, conns[1], "20020100")       // CONNACK with session present
+	wantPacketHex(t, conns[1], "a2054002000161") // UNSUBSCRIBE again
+	sendPacketHex(t, conns[1], "b0024002")       // UNSUBACK
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, conns[1], "c000") // PINGREQ
+		sendPacketHex(t, conns[1], "d000") // PINGRESP
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Errorf("ping got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	if got := client.Subscriptions(); len(got) != 0 {
+		t.Errorf("got subscriptions %+v after reconnect, want none", got)
+	}
+}
+
+func TestSubscribeRestart(t *testing.T) {
+	t.Parallel()
+
+	p := mqtt.FileSystem(t.TempDir())
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.InitSession("test-client", p, &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("InitSession error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101700044d51545404000000000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "820c60000003612f2b0100012301") // SUBSCRIBE
+		sendPacketHex(t, brokerConn, "900460000100")                 // SUBACK
+		wantPacketHex(t, brokerConn, "a2054001000123")               // UNSUBSCRIBE
+		sendPacketHex(t, brokerConn, "b0024001")                     // UNSUBACK
+	})
+	if err := client.SubscribeLimitAtLeastOnce(nil, "a/+", "#"); err != nil {
+		t.Errorf("subscribe got error %q [%T]", err, err)
+	}
+	if err := client.Unsubscribe(nil, "#"); err != nil {
+		t.Errorf("unsubscribe got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	if err := client.Close(); err != nil {
+		t.Fatal("Close error:", err)
+	}
+
+	// continue with another Client
+	clientConn, brokerConn = net.Pipe()
+	client, warn, err := mqtt.AdoptSession(p, &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("AdoptSession error:", err)
+	}
+	for _, err := range warn {
+		t.Error("AdoptSession warning:", err)
+	}
+	want := []mqtt.Subscription{{TopicFilter: "a/+", Level: 1}}
+	if got := client.Subscriptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got subscriptions %+v, want %+v", got, want)
+	}
+	testClient(t, client, mqtttest.Transfer{Err: mqtt.ErrSessionLost})
+	wantPacketHex(t, brokerConn, "101700044d51545404000000000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "20020000")             // CONNACK without session present
+	wantPacketHex(t, brokerConn, "820860000003612f2b01") // SUBSCRIBE again
+	sendPacketHex(t, brokerConn, "9003600001")           // SUBACK
+}
+
+// SaveFault fails on Save when enabled.
+type saveFault struct {
+	mqtt.Persistence
+	enabled bool
+}
+
+func (p *saveFault) Save(key uint, value net.Buffers) error {
+	if p.enabled {
+		return errors.New("save fault")
+	}
+	return p.Persistence.Save(key, value)
+}
+
+func TestSubscribeSaveFault(t *testing.T) {
+	t.Parallel()
+
+	p := &saveFault{Persistence: mqtt.FileSystem(t.TempDir())}
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.InitSession("test-client", p, &mqtt.Config{
+		PauseTimeout: time.Second / 4,
+		Dialer:       newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("InitSession error:", err)
+	}
+	p.enabled = true
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101700044d51545404000000000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "20020000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "820860000003612f2b02") // SUBSCRIBE
+		sendPacketHex(t, brokerConn, "9003600002")           // SUBACK
+		wantPacketHex(t, brokerConn, "a20740010003612f2b")   // UNSUBSCRIBE
+		sendPacketHex(t, brokerConn, "b0024001")             // UNSUBACK
+	})
+	if err := client.Subscribe(nil, "a/+"); err == nil {
+		t.Error("subscribe got no error on save fault")
+	}
+	// connection remains
+	if err := client.Unsubscribe(nil, "a/+"); err == nil {
+		t.Error("unsubscribe got no error on save fault")
+	}
+	<-brokerMockDone
+	if got := client.Subscriptions(); len(got) != 0 {
+		t.Errorf("got subscriptions %+v after unsubscribe, want none", got)
+	}
+}
+
+func TestPublishAtLeastOnceReject(t *testing.T) {
+	client, conn := newClientPipe5(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, hex.EncodeToString([]byte{
+			0x32, 12,
+			0, 1, 'x',
+			0x80, 0x00, // packet identifier
+			5,                // property length
+			0x02, 0, 0, 0, 9, // message expiry
+			'm'}))
+		sendPacketHex(t, conn, "4003800087") // PUBACK with Not authorized
+	})
+
+	exchange, err := client.PublishAtLeastOnceWithProperties([]byte("m"), "x", &mqtt.Properties{MessageExpiry: 9})
+	if err != nil {
+		t.Fatalf("got error %q [%T]", err, err)
+	}
+	select {
+	case err := <-exchange:
+		if code := mqtt.ReasonCode(0); !errors.As(err, &code) || code != 0x87 {
+			t.Errorf("exchange got error %q, want reason code 0x87", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("exchange read timeout")
+	}
+	testAck(t, exchange)
+	<-brokerMockDone
+}
+
+func TestPublishExactlyOnceReject(t *testing.T) {
+	client, conn := newClientPipe5(t)
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, conn, "3407000178c000006d") // PUBLISH 1st
+		wantPacketHex(t, conn, "3407000178c001006e") // PUBLISH 2nd
+		sendPacketHex(t, conn, "5002c000")           // PUBREC 1st
+		wantPacketHex(t, conn, "6202c000")           // PUBREL 1st
+		sendPacketHex(t, conn, "5003c00187")         // PUBREC 2nd with Not authorized
+		sendPacketHex(t, conn, "7002c000")           // PUBCOMP 1st
+	})
+
+	exchange1, err := client.PublishExactlyOnce([]byte("m"), "x")
+	if err != nil {
+		t.Fatalf("publish 1st got error %q [%T]", err, err)
+	}
+	exchange2, err := client.PublishExactlyOnce([]byte("n"), "x")
+	if err != nil {
+		t.Fatalf("publish 2nd got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	testAck(t, exchange1)
+	select {
+	case err := <-exchange2:
+		if code := mqtt.ReasonCode(0); !errors.As(err, &code) || code != 0x87 {
+			t.Errorf("exchange got error %q, want reason code 0x87", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("exchange read timeout")
+	}
+	testAck(t, exchange2)
+
+	// packet identifier available again
+	if n := len(client.Pending()); n != 0 {
+		t.Errorf("got %d pending after PUBREC failure, want none", n)
+	}
+}
+
+func TestPublishExactlyOnceRejectRestart(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	config := mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		ExactlyOnceMax: 3,
+		ProtocolLevel:  5,
+	}
+	clientConn, brokerConn := net.Pipe()
+	config.Dialer = newTestDialer(t, clientConn)
+	client, err := mqtt.InitSession("test-client", mqtt.FileSystem(dir), &config)
+	if err != nil {
+		t.Fatal("InitSession error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101d00044d515454050000000511ffffffff000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "2003000000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "3407000178c000006d") // PUBLISH 1st
+		wantPacketHex(t, brokerConn, "3407000178c001006e") // PUBLISH 2nd
+		wantPacketHex(t, brokerConn, "3407000178c002006f") // PUBLISH 3rd
+		sendPacketHex(t, brokerConn, "5002c000")           // PUBREC 1st
+		wantPacketHex(t, brokerConn, "6202c000")           // PUBREL 1st
+		sendPacketHex(t, brokerConn, "5003c00187")         // PUBREC 2nd with Not authorized
+	})
+	for _, message := range []string{"m", "n", "o"} {
+		if _, err := client.PublishExactlyOnce([]byte(message), "x"); err != nil {
+			t.Fatalf("publish %q got error %q [%T]", message, err, err)
+		}
+	}
+	<-brokerMockDone
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "c000") // PINGREQ
+		sendPacketHex(t, brokerConn, "d000") // PINGRESP
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Fatalf("ping got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	if err := client.Close(); err != nil {
+		t.Fatal("Close error:", err)
+	}
+
+	// restart with PUBREL 1st, the failure of 2nd, and PUBLISH 3rd
+	clientConn, brokerConn = net.Pipe()
+	config.Dialer = newTestDialer(t, clientConn)
+	client, warn, err := mqtt.AdoptSession(mqtt.FileSystem(dir), &config)
+	if err != nil {
+		t.Fatal("AdoptSession error:", err)
+	}
+	for _, err := range warn {
+		t.Error("AdoptSession warning:", err)
+	}
+	var got []string
+	for _, p := range client.Pending() {
+		got = append(got, fmt.Sprintf("%#04x %s", p.PacketID, p.State))
+	}
+	if want := "0xc000 PUBREL, 0xc002 PUBLISH"; strings.Join(got, ", ") != want {
+		t.Errorf("got pending %q, want %q", got, want)
+	}
+
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101d00044d515454050000000511ffffffff000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "2003010000")         // CONNACK with session present
+	wantPacketHex(t, brokerConn, "6202c000")           // PUBREL 1st
+	wantPacketHex(t, brokerConn, "3c07000178c002006f") // PUBLISH 3rd duplicate
+	wantPacketHex(t, brokerConn, "6202c000")           // PUBREL 1st from pendingAck
+	sendPacketHex(t, brokerConn, "7002c000")           // PUBCOMP 1st
+	sendPacketHex(t, brokerConn, "5002c002")           // PUBREC 3rd
+	wantPacketHex(t, brokerConn, "6202c002")           // PUBREL 3rd
+	sendPacketHex(t, brokerConn, "7002c002")           // PUBCOMP 3rd
+
+	brokerMockDone = testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, "c000") // PINGREQ
+		sendPacketHex(t, brokerConn, "d000") // PINGRESP
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Errorf("ping got error %q [%T]", err, err)
+	}
+	<-brokerMockDone
+	if n := len(client.Pending()); n != 0 {
+		t.Errorf("got %d pending after completion, want none", n)
+	}
+}
+
+func TestPublishPropertiesDeny(t *testing.T) {
+	client, _ := newClientPipe(t)
+	err := client.PublishWithProperties(nil, []byte("m"), "x", new(mqtt.Properties))
+	if !mqtt.IsDeny(err) {
+		t.Errorf("got error %q [%T], want an mqtt.IsDeny", err, err)
+	}
+}
+
+func TestPublishAtLeastOncePersisted5(t *testing.T) {
+	t.Parallel()
+
+	clientConn, brokerConn := net.Pipe()
+	client, err := mqtt.InitSession("test-client", mqtt.FileSystem(t.TempDir()), &mqtt.Config{
+		PauseTimeout:   time.Second / 4,
+		AtLeastOnceMax: 2,
+		ProtocolLevel:  5,
+		Dialer:         newTestDialer(t, clientConn),
+	})
+	if err != nil {
+		t.Fatal("InitSession error:", err)
+	}
+	testClient(t, client)
+	wantPacketHex(t, brokerConn, "101d00044d515454050000000511ffffffff000b746573742d636c69656e74")
+	sendPacketHex(t, brokerConn, "2003000000") // CONNACK
+
+	brokerMockDone := testRoutine(t, func() {
+		wantPacketHex(t, brokerConn, hex.EncodeToString([]byte{
+			0x32, 12,
+			0, 1, 'x',
+			0x80, 0x00, // packet identifier
+			5,                // property length
+			0x02, 0, 0, 0, 9, // message expiry
+			'm'}))
+		sendPacketHex(t, brokerConn, "40028000") // PUBACK
+	})
+
+	exchange, err := client.PublishAtLeastOnceWithProperties([]byte("m"), "x", &mqtt.Properties{MessageExpiry: 9})
+	if err != nil {
+		t.Fatalf("got error %q [%T]", err, err)
+	}
+	testAck(t, exchange)
+	<-brokerMockDone
+}
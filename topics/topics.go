@@ -0,0 +1,153 @@
+// Package topics provides validation and matching of MQTT topic names and
+// topic filters, conform section 4.7 “Topic Names and Topic Filters”.
+package topics
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// The validation errors are expected to be prefixed according to the context.
+var (
+	ErrEmpty      = errors.New("topic is empty")
+	ErrMax        = errors.New("topic exceeds 65535 bytes")
+	ErrUTF8       = errors.New("topic has an invalid UTF-8 byte sequence")
+	ErrNull       = errors.New("topic contains null character")
+	ErrWildcard   = errors.New("wildcard character in topic name")
+	ErrMultiLevel = errors.New("multi-level wildcard not last in topic filter")
+	ErrLevelMix   = errors.New("wildcard mixed with other characters in topic level")
+)
+
+// CheckName returns an error if s is not a valid topic name. Names are used in
+// PUBLISH. Such topic must not contain any wildcards.
+func CheckName(s string) error {
+	wildcards, err := check(s)
+	if err != nil {
+		return err
+	}
+	// “The wildcard characters can be used in Topic Filters, but MUST NOT
+	// be used within a Topic Name.”
+	// — MQTT Version 3.1.1, conformance statement MQTT-4.7.1-1
+	if wildcards {
+		return ErrWildcard
+	}
+	return nil
+}
+
+// CheckFilter returns an error if s is not a valid topic filter. Filters are
+// used in SUBSCRIBE and UNSUBSCRIBE.
+func CheckFilter(s string) error {
+	wildcards, err := check(s)
+	if err != nil || !wildcards {
+		return err
+	}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '#':
+			// “The multi-level wildcard character MUST be specified
+			// either on its own or following a topic level separator.
+			// In either case it MUST be the last character specified
+			// in the Topic Filter.”
+			// — MQTT Version 3.1.1, conformance statement MQTT-4.7.1-2
+			if i != len(s)-1 {
+				return ErrMultiLevel
+			}
+			if i != 0 && s[i-1] != '/' {
+				return ErrLevelMix
+			}
+		case '+':
+			// “The single-level wildcard can be used at any level in
+			// the Topic Filter, including first and last levels. Where
+			// it is used it MUST occupy an entire level of the filter.”
+			// — MQTT Version 3.1.1, conformance statement MQTT-4.7.1-3
+			if (i != 0 && s[i-1] != '/') || (i+1 < len(s) && s[i+1] != '/') {
+				return ErrLevelMix
+			}
+		}
+	}
+	return nil
+}
+
+// Check applies the rules for both topic names and topic filters. The return
+// tells whether any wildcard characters are present.
+func check(s string) (wildcards bool, err error) {
+	// “All Topic Names and Topic Filters MUST be at least one character
+	// long.”
+	// — MQTT Version 3.1.1, conformance statement MQTT-4.7.3-1
+	if s == "" {
+		return false, ErrEmpty
+	}
+	// “Topic Names and Topic Filters MUST NOT encode to more than 65535
+	// bytes.”
+	// — MQTT Version 3.1.1, conformance statement MQTT-4.7.3-3
+	if len(s) > 65535 {
+		return false, ErrMax
+	}
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			// “Topic Names and Topic Filters MUST NOT include the
+			// null character (Unicode U+0000).”
+			// — MQTT Version 3.1.1, conformance statement MQTT-4.7.3-2
+			switch c {
+			case 0:
+				return false, ErrNull
+			case '+', '#':
+				wildcards = true
+			}
+			i++
+			continue
+		}
+
+		// “The character data in a UTF-8 encoded string MUST be
+		// well-formed UTF-8 as defined by the Unicode specification
+		// and restated in RFC 3629.”
+		// — MQTT Version 3.1.1, conformance statement MQTT-1.5.3-1
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			return false, ErrUTF8
+		}
+		i += size
+	}
+	return wildcards, nil
+}
+
+// Match returns whether the topic name matches the topic filter. Both arguments
+// are assumed to be valid.
+func Match(filter, name string) bool {
+	// “The Server MUST NOT match Topic Filters starting with a wildcard
+	// character (# or +) with Topic Names beginning with a $ character.”
+	// — MQTT Version 3.1.1, conformance statement MQTT-4.7.2-1
+	if name != "" && name[0] == '$' && filter != "" && (filter[0] == '#' || filter[0] == '+') {
+		return false
+	}
+
+	for {
+		filterLevel := filter
+		i := strings.IndexByte(filter, '/')
+		if i >= 0 {
+			filterLevel = filter[:i]
+		}
+		if filterLevel == "#" {
+			return true
+		}
+
+		nameLevel := name
+		j := strings.IndexByte(name, '/')
+		if j >= 0 {
+			nameLevel = name[:j]
+		}
+		if filterLevel != "+" && filterLevel != nameLevel {
+			return false
+		}
+
+		switch {
+		case j < 0:
+			// “sport/tennis/player1/#” matches “sport/tennis/player1”
+			return i < 0 || filter[i+1:] == "#"
+		case i < 0:
+			return false
+		}
+		filter, name = filter[i+1:], name[j+1:]
+	}
+}
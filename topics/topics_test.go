@@ -0,0 +1,154 @@
+package topics_test
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pascaldekloe/mqtt/topics"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		topic              string
+		nameErr, filterErr error
+	}{
+		{"a", nil, nil},
+		{"/", nil, nil},
+		{"a b/ℂ/�", nil, nil},
+		{"$SYS/a", nil, nil},
+		{"", topics.ErrEmpty, topics.ErrEmpty},
+		{strings.Repeat("a", 65536), topics.ErrMax, topics.ErrMax},
+		{"a\x80", topics.ErrUTF8, topics.ErrUTF8},
+		{"a\x00", topics.ErrNull, topics.ErrNull},
+		{"#", topics.ErrWildcard, nil},
+		{"+", topics.ErrWildcard, nil},
+		{"a/+/#", topics.ErrWildcard, nil},
+		{"+/+", topics.ErrWildcard, nil},
+		{"a#", topics.ErrWildcard, topics.ErrLevelMix},
+		{"#/a", topics.ErrWildcard, topics.ErrMultiLevel},
+		{"a/#/", topics.ErrWildcard, topics.ErrMultiLevel},
+		{"a/+b", topics.ErrWildcard, topics.ErrLevelMix},
+		{"+a", topics.ErrWildcard, topics.ErrLevelMix},
+	}
+	for _, test := range tests {
+		if err := topics.CheckName(test.topic); !errors.Is(err, test.nameErr) {
+			t.Errorf("%.12q got name error %v, want %v", test.topic, err, test.nameErr)
+		}
+		if err := topics.CheckFilter(test.topic); !errors.Is(err, test.filterErr) {
+			t.Errorf("%.12q got filter error %v, want %v", test.topic, err, test.filterErr)
+		}
+	}
+}
+
+var matchTests = []struct {
+	filter, name string
+	want         bool
+}{
+	{"#", "a", true},
+	{"#", "a/b", true},
+	{"#", "/", true},
+	{"a/#", "a", true},
+	{"a/#", "a/b/c", true},
+	{"a/#", "b", false},
+	{"+", "a", true},
+	{"+", "a/b", false},
+	{"+", "/", false},
+	{"+/+", "/a", true},
+	{"/+", "/a", true},
+	{"a/+", "a/", true},
+	{"a/+", "a", false},
+	{"a/+/c", "a/b/c", true},
+	{"a/+/c", "a/b/d", false},
+	{"a/b", "a/b", true},
+	{"a/b", "a/bc", false},
+	{"a/b", "a", false},
+	{"a/b", "a/b/c", false},
+	{"+/#", "a", true},
+	{"#", "$SYS/a", false},
+	{"+/a", "$SYS/a", false},
+	{"$SYS/#", "$SYS/a", true},
+	{"$SYS/+", "$SYS/a", true},
+}
+
+func TestMatch(t *testing.T) {
+	for _, test := range matchTests {
+		if got := topics.Match(test.filter, test.name); got != test.want {
+			t.Errorf("filter %q with name %q got %t, want %t", test.filter, test.name, got, test.want)
+		}
+	}
+}
+
+func TestTrie(t *testing.T) {
+	var trie topics.Trie
+	names := make(map[string]bool)
+	for _, test := range matchTests {
+		if err := trie.Put(test.filter, test.filter); err != nil {
+			t.Fatalf("put %q error: %s", test.filter, err)
+		}
+		names[test.name] = true
+	}
+	if err := trie.Put("a/#/b", "illegal"); !errors.Is(err, topics.ErrMultiLevel) {
+		t.Errorf("put illegal filter got error %v, want topics.ErrMultiLevel", err)
+	}
+	testTrieMatches(t, &trie, names)
+
+	// delete half of the filters
+	for i, test := range matchTests {
+		if i%2 == 0 {
+			trie.Delete(test.filter)
+			if v, ok := trie.Get(test.filter); ok {
+				t.Errorf("get %q after delete got %v", test.filter, v)
+			}
+		}
+	}
+	testTrieMatches(t, &trie, names)
+
+	for _, test := range matchTests {
+		trie.Delete(test.filter)
+	}
+	if n := trie.Len(); n != 0 {
+		t.Errorf("got length %d after deleting all filters", n)
+	}
+	if got := trie.AppendMatches(nil, "a"); len(got) != 0 {
+		t.Errorf("empty trie got matches %q", got)
+	}
+}
+
+// TestTrieMatches compares each name against Match with every filter.
+func testTrieMatches(t *testing.T, trie *topics.Trie, names map[string]bool) {
+	t.Helper()
+	for name := range names {
+		var want []string
+		for _, test := range matchTests {
+			if _, ok := trie.Get(test.filter); ok && topics.Match(test.filter, name) {
+				want = append(want, test.filter)
+			}
+		}
+		sort.Strings(want)
+		want = dedupe(want)
+
+		var got []string
+		for _, v := range trie.AppendMatches(nil, name) {
+			got = append(got, v.(string))
+		}
+		sort.Strings(got)
+
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("name %q got matches %q, want %q", name, got, want)
+		}
+	}
+}
+
+func dedupe(a []string) []string {
+	var n int
+	for i := range a {
+		if i == 0 || a[i] != a[i-1] {
+			a[n] = a[i]
+			n++
+		}
+	}
+	return a[:n]
+}
@@ -0,0 +1,207 @@
+package topics
+
+import "strings"
+
+// Trie maps topic filters to values, with an efficient lookup of all filters
+// which match a topic name. The zero value is an empty Trie ready to use.
+//
+// Multiple goroutines may invoke AppendMatches and Get simultaneously, as long
+// as no modification (with Put or Delete) happens in the meantime.
+type Trie struct {
+	root trieNode
+	n    int // number of filters
+}
+
+// TrieNode represents one topic level.
+type trieNode struct {
+	levels map[string]*trieNode // exact matches
+	plus   *trieNode            // single-level wildcard
+	hash   *trieEntry           // multi-level wildcard
+	entry  *trieEntry           // filter ends on this level
+}
+
+type trieEntry struct {
+	value interface{}
+}
+
+// Len returns the number of topic filters.
+func (t *Trie) Len() int { return t.n }
+
+// Put maps the topic filter to a value. Any previous value is replaced.
+func (t *Trie) Put(filter string, value interface{}) error {
+	if err := CheckFilter(filter); err != nil {
+		return err
+	}
+
+	n := &t.root
+	for {
+		level := filter
+		i := strings.IndexByte(filter, '/')
+		if i >= 0 {
+			level = filter[:i]
+		}
+
+		var slot **trieEntry
+		switch level {
+		case "#":
+			slot = &n.hash
+		case "+":
+			if n.plus == nil {
+				n.plus = new(trieNode)
+			}
+			n = n.plus
+		default:
+			child, ok := n.levels[level]
+			if !ok {
+				if n.levels == nil {
+					n.levels = make(map[string]*trieNode)
+				}
+				child = new(trieNode)
+				n.levels[level] = child
+			}
+			n = child
+		}
+		if i < 0 || slot != nil {
+			if slot == nil {
+				slot = &n.entry
+			}
+			if *slot == nil {
+				t.n++
+			}
+			*slot = &trieEntry{value}
+			return nil
+		}
+		filter = filter[i+1:]
+	}
+}
+
+// Get returns the value of a topic filter, with false for absence.
+func (t *Trie) Get(filter string) (value interface{}, ok bool) {
+	n := &t.root
+	for {
+		level := filter
+		i := strings.IndexByte(filter, '/')
+		if i >= 0 {
+			level = filter[:i]
+		}
+
+		switch level {
+		case "#":
+			if n.hash == nil || i >= 0 {
+				return nil, false
+			}
+			return n.hash.value, true
+		case "+":
+			n = n.plus
+		default:
+			n = n.levels[level]
+		}
+		if n == nil {
+			return nil, false
+		}
+		if i < 0 {
+			if n.entry == nil {
+				return nil, false
+			}
+			return n.entry.value, true
+		}
+		filter = filter[i+1:]
+	}
+}
+
+// Delete removes a topic filter, with false for absence.
+func (t *Trie) Delete(filter string) bool {
+	ok := t.root.delete(filter)
+	if ok {
+		t.n--
+	}
+	return ok
+}
+
+func (n *trieNode) delete(filter string) bool {
+	level, rest := filter, ""
+	i := strings.IndexByte(filter, '/')
+	if i >= 0 {
+		level, rest = filter[:i], filter[i+1:]
+	}
+
+	var child *trieNode
+	switch level {
+	case "#":
+		if i >= 0 || n.hash == nil {
+			return false
+		}
+		n.hash = nil
+		return true
+	case "+":
+		child = n.plus
+	default:
+		child = n.levels[level]
+	}
+	if child == nil {
+		return false
+	}
+
+	if i < 0 {
+		if child.entry == nil {
+			return false
+		}
+		child.entry = nil
+	} else if !child.delete(rest) {
+		return false
+	}
+
+	// prune
+	if child.entry == nil && child.hash == nil && child.plus == nil && len(child.levels) == 0 {
+		if level == "+" {
+			n.plus = nil
+		} else {
+			delete(n.levels, level)
+		}
+	}
+	return true
+}
+
+// AppendMatches appends the value of each topic filter which matches the topic
+// name. The order of the values is undefined.
+func (t *Trie) AppendMatches(dst []interface{}, name string) []interface{} {
+	// “The Server MUST NOT match Topic Filters starting with a wildcard
+	// character (# or +) with Topic Names beginning with a $ character.”
+	// — MQTT Version 3.1.1, conformance statement MQTT-4.7.2-1
+	return t.root.appendMatches(dst, name, name != "" && name[0] == '$')
+}
+
+// AppendMatches resolves the remaining levels of a topic name.
+func (n *trieNode) appendMatches(dst []interface{}, name string, noWildcards bool) []interface{} {
+	if n.hash != nil && !noWildcards {
+		dst = append(dst, n.hash.value)
+	}
+
+	level, rest := name, ""
+	last := true
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		level, rest, last = name[:i], name[i+1:], false
+	}
+	if child, ok := n.levels[level]; ok {
+		dst = child.appendMatchesAfter(dst, rest, last)
+	}
+	if n.plus != nil && !noWildcards {
+		dst = n.plus.appendMatchesAfter(dst, rest, last)
+	}
+	return dst
+}
+
+// AppendMatchesAfter continues with the levels after a node match.
+func (n *trieNode) appendMatchesAfter(dst []interface{}, rest string, last bool) []interface{} {
+	if !last {
+		return n.appendMatches(dst, rest, false)
+	}
+	if n.entry != nil {
+		dst = append(dst, n.entry.value)
+	}
+	// “sport/tennis/player1/#” matches “sport/tennis/player1”
+	if n.hash != nil {
+		dst = append(dst, n.hash.value)
+	}
+	return dst
+}
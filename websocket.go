@@ -0,0 +1,367 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket frames have a 4-bit operation code in the first byte.
+// See RFC 6455, subsection 5.2 “Base Framing Protocol”.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WSFrameMax limits the payload size of outbound frames. MQTT packets may span
+// multiple WebSocket frames.
+const wsFrameMax = 32 * 1024
+
+// “The Client MUST include the value "mqtt" in the list of WebSocket Sub
+// Protocols it offers.”
+// — MQTT Version 3.1.1, conformance statement MQTT-6.0.0-3
+const wsSubprotocol = "mqtt"
+
+// NewWebSocketDialer provides connections with MQTT over WebSocket [RFC 6455].
+// The URL scheme is either "ws", or "wss" for TLS, e.g., "wss://example.com/mqtt".
+// The TLS configuration is optional, as nil applies the defaults. Header is an
+// optional set of HTTP fields for the upgrade request.
+func NewWebSocketDialer(rawURL string, config *tls.Config, header http.Header) (Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: WebSocket URL: %w", err)
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws":
+		break
+	case "wss":
+		secure = true
+	default:
+		return nil, fmt.Errorf("mqtt: WebSocket URL scheme %q not ws nor wss", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("mqtt: WebSocket URL without host")
+	}
+	address := u.Host
+	if u.Port() == "" {
+		if secure {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	return func(ctx context.Context) (net.Conn, error) {
+		// minimize timer use; covered by PauseTimeout
+		netDialer := &net.Dialer{KeepAlive: -1}
+		var conn net.Conn
+		var err error
+		if secure {
+			dialer := tls.Dialer{NetDialer: netDialer, Config: config}
+			conn, err = dialer.DialContext(ctx, "tcp", address)
+		} else {
+			conn, err = netDialer.DialContext(ctx, "tcp", address)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		wsConn, err := wsHandshake(ctx, conn, u, header)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return wsConn, nil
+	}, nil
+}
+
+// WSHandshake applies the opening handshake from RFC 6455, section 4.1.
+func wsHandshake(ctx context.Context, conn net.Conn, u *url.URL, header http.Header) (*wsConn, error) {
+	// apply context expiry and cancelation on the connection
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	defer conn.SetDeadline(time.Time{}) // after interrupt routine exit
+	handshakeDone := make(chan struct{})
+	interruptExit := make(chan struct{})
+	defer func() {
+		close(handshakeDone)
+		<-interruptExit
+	}()
+	go func() {
+		defer close(interruptExit)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0)) // interrupt
+		case <-handshakeDone:
+			break
+		}
+	}()
+
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header, len(header)+5),
+		Host:       u.Host,
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", wsSubprotocol)
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("mqtt: WebSocket upgrade request: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("mqtt: WebSocket upgrade response: %w", err)
+	}
+	resp.Body.Close() // no content with status 101
+
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		return nil, fmt.Errorf("mqtt: WebSocket upgrade denied with HTTP status %q", resp.Status)
+	case !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket"):
+		return nil, errors.New("mqtt: WebSocket upgrade response without websocket upgrade")
+	case !headerHasToken(resp.Header, "Connection", "upgrade"):
+		return nil, errors.New("mqtt: WebSocket upgrade response without connection upgrade")
+	case resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]):
+		return nil, errors.New("mqtt: WebSocket upgrade response with wrong accept key")
+	case resp.Header.Get("Sec-WebSocket-Protocol") != wsSubprotocol:
+		return nil, fmt.Errorf("mqtt: WebSocket upgrade response with subprotocol %q, want %q", resp.Header.Get("Sec-WebSocket-Protocol"), wsSubprotocol)
+	}
+
+	return &wsConn{Conn: conn, r: r}, nil
+}
+
+// HeaderHasToken returns whether a comma-separated field contains the token,
+// case-insensitive.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, s := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WSConn exposes the binary frames of a WebSocket as a stream. Reads strictly
+// peek in the buffer until complete to survive deadline expiry.
+type wsConn struct {
+	net.Conn // underlying transport
+
+	// read state
+	r           *bufio.Reader // buffers Conn
+	payloadLeft int           // pending bytes in current data frame
+
+	// The lock covers write state, as control frames go out from the read
+	// routine too.
+	writeMutex sync.Mutex
+	writeBuf   []byte // frame composition
+	// A frame which got interrupted must complete before any other.
+	writePending []byte
+}
+
+// Read implements the io.Reader interface.
+func (c *wsConn) Read(p []byte) (n int, err error) {
+	for c.payloadLeft == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(p) > c.payloadLeft {
+		p = p[:c.payloadLeft]
+	}
+	n, err = c.r.Read(p)
+	c.payloadLeft -= n
+	return n, err
+}
+
+// NextFrame reads one frame header. Control frames are processed as a whole.
+func (c *wsConn) nextFrame() error {
+	head, err := c.r.Peek(2)
+	if err != nil {
+		return err
+	}
+	if head[1]&0x80 != 0 {
+		// “A client MUST close a connection if it detects a masked
+		// frame.”
+		// — RFC 6455, subsection 5.1
+		return errors.New("mqtt: WebSocket frame from server masked")
+	}
+	if head[0]&0x70 != 0 {
+		return fmt.Errorf("mqtt: WebSocket frame with reserved bits %#x", head[0]&0x70)
+	}
+	opcode := head[0] & 0xf
+
+	headSize := 2
+	payloadSize := int(head[1] & 0x7f)
+	switch payloadSize {
+	case 126:
+		headSize += 2
+	case 127:
+		headSize += 8
+	}
+	head, err = c.r.Peek(headSize)
+	if err != nil {
+		return err
+	}
+	switch payloadSize {
+	case 126:
+		payloadSize = int(binary.BigEndian.Uint16(head[2:]))
+	case 127:
+		size := binary.BigEndian.Uint64(head[2:])
+		if size > 1<<31-1 {
+			return fmt.Errorf("mqtt: WebSocket frame of %d bytes exceeds 2 GiB", size)
+		}
+		payloadSize = int(size)
+	}
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		c.r.Discard(headSize) // no errors guaranteed
+		c.payloadLeft = payloadSize
+		return nil
+
+	case wsText:
+		// “MQTT Control Packets MUST be sent in WebSocket binary data
+		// frames. If any other type of data frame is received the
+		// recipient MUST close the Network Connection.”
+		// — MQTT Version 3.1.1, conformance statement MQTT-6.0.0-1
+		return errors.New("mqtt: WebSocket text frame received")
+
+	case wsClose, wsPing, wsPong:
+		if payloadSize > 125 {
+			return fmt.Errorf("mqtt: WebSocket control frame of %d bytes exceeds 125", payloadSize)
+		}
+		frame, err := c.r.Peek(headSize + payloadSize)
+		if err != nil {
+			return err
+		}
+		payload := append([]byte{}, frame[headSize:]...)
+		c.r.Discard(len(frame)) // no errors guaranteed
+
+		switch opcode {
+		case wsPing:
+			if _, err := c.writeFrame(wsPong, payload); err != nil {
+				return err
+			}
+		case wsClose:
+			// echo the status code, if any
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload) // best effort
+			return io.EOF
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("mqtt: WebSocket frame with reserved operation code %#x", opcode)
+	}
+}
+
+// Write implements the io.Writer interface. Each invocation sends one or more
+// binary frames.
+func (c *wsConn) Write(p []byte) (n int, err error) {
+	for len(p) != 0 {
+		chunk := p
+		if len(chunk) > wsFrameMax {
+			chunk = chunk[:wsFrameMax]
+		}
+		if committed, err := c.writeFrame(wsBinary, chunk); err != nil {
+			if committed {
+				// frame completes on the next write
+				n += len(chunk)
+			}
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// WriteFrame sends a (masked) frame. An interrupted submission remains pending
+// for completion by the next invocation, if any bytes got through, in which case
+// the frame is committed.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) (committed bool, err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.writePending != nil {
+		n, err := c.Conn.Write(c.writePending)
+		c.writePending = c.writePending[n:]
+		if err != nil {
+			return false, err
+		}
+		c.writePending = nil
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+		return false, err
+	}
+
+	buf := append(c.writeBuf[:0], 0x80|opcode)
+	switch l := len(payload); {
+	case l < 126:
+		buf = append(buf, 0x80|byte(l))
+	case l <= 0xffff:
+		buf = append(buf, 0x80|126, byte(l>>8), byte(l))
+	default:
+		buf = append(buf, 0x80|127, 0, 0, 0, 0, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+	buf = append(buf, mask[:]...)
+	offset := len(buf)
+	buf = append(buf, payload...)
+	for i := range buf[offset:] {
+		buf[offset+i] ^= mask[i&3]
+	}
+	c.writeBuf = buf
+
+	n, err := c.Conn.Write(buf)
+	if err != nil && n != 0 {
+		c.writePending = append([]byte{}, buf[n:]...)
+	}
+	return n != 0, err
+}
@@ -0,0 +1,132 @@
+package mqtt_test
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/mqtt"
+)
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Sec-WebSocket-Protocol"); got != "mqtt" {
+			t.Errorf("got subprotocol %q, want mqtt", got)
+		}
+		if got := r.Header.Get("X-Test"); got != "✓" {
+			t.Errorf("got custom header %q, want ✓", got)
+		}
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error("hijack error:", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		buf.WriteString("Sec-WebSocket-Protocol: mqtt\r\nSec-WebSocket-Accept: ")
+		buf.WriteString(base64.StdEncoding.EncodeToString(sum[:]))
+		buf.WriteString("\r\n\r\n")
+		buf.Flush()
+
+		wantFrameHex(t, buf.Reader, 0x2, pipeCONNECTHex)
+		// CONNACK in two frames with a ping in between
+		sendFrameHex(t, conn, 0x02, "2002") // without FIN
+		sendFrameHex(t, conn, 0x89, "abcd")
+		wantFrameHex(t, buf.Reader, 0xa, "abcd")
+		sendFrameHex(t, conn, 0x80, "0000") // continuation
+
+		wantFrameHex(t, buf.Reader, 0x2, "c000") // PINGREQ
+		sendFrameHex(t, conn, 0x82, "d000")      // PINGRESP
+		sendFrameHex(t, conn, 0x88, "03e8")      // close
+		wantFrameHex(t, buf.Reader, 0x8, "03e8")
+	}))
+	defer srv.Close()
+
+	header := make(http.Header)
+	header.Set("X-Test", "✓")
+	dialer, err := mqtt.NewWebSocketDialer(strings.Replace(srv.URL, "http", "ws", 1)+"/mqtt", nil, header)
+	if err != nil {
+		t.Fatal("NewWebSocketDialer error:", err)
+	}
+	client, err := mqtt.VolatileSession("", &mqtt.Config{
+		PauseTimeout: time.Second,
+		Dialer:       dialer,
+	})
+	if err != nil {
+		t.Fatal("volatile session error:", err)
+	}
+	defer client.Close()
+
+	readRoutineDone := testRoutine(t, func() {
+		_, _, _, err := client.ReadSlices()
+		if err == nil {
+			t.Error("ReadSlices got no error on WebSocket close")
+		}
+	})
+	if err := client.Ping(nil); err != nil {
+		t.Error("ping error:", err)
+	}
+	<-readRoutineDone
+}
+
+func TestWebSocketDialerURL(t *testing.T) {
+	for _, s := range []string{"http://example.com/", "ws:///mqtt", "%"} {
+		if _, err := mqtt.NewWebSocketDialer(s, nil, nil); err == nil {
+			t.Errorf("URL %q got no error", s)
+		}
+	}
+}
+
+// WantFrameHex reads a masked frame from the client.
+func wantFrameHex(t *testing.T, r *bufio.Reader, opcode byte, want string) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatal("server read error:", err)
+	}
+	if head[0] != 0x80|opcode {
+		t.Errorf("got frame head %#x, want %#x", head[0], 0x80|opcode)
+	}
+	if head[1]&0x80 == 0 {
+		t.Error("frame from client not masked")
+	}
+	size := int(head[1] & 0x7f)
+	if size > 125 {
+		t.Fatalf("frame size %d too big for test", size)
+	}
+	buf := make([]byte, 4+size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal("server read error:", err)
+	}
+	payload := buf[4:]
+	for i := range payload {
+		payload[i] ^= buf[i&3]
+	}
+	if got := hex.EncodeToString(payload); got != want {
+		t.Errorf("got frame payload 0x%s, want 0x%s", got, want)
+	}
+}
+
+// SendFrameHex writes an unmasked frame to the client.
+func sendFrameHex(t *testing.T, w io.Writer, head byte, payloadHex string) {
+	t.Helper()
+	payload, err := hex.DecodeString(payloadHex)
+	if err != nil {
+		t.Fatal("malformed test data:", err)
+	}
+	frame := append([]byte{head, byte(len(payload))}, payload...)
+	if _, err := w.Write(frame); err != nil {
+		t.Fatal("server write error:", err)
+	}
+}